@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// command runs a subcommand of the plugin binary with its arguments
+type command func(args []string, out io.Writer) error
+
+var commandMap = map[string]command{
+	"inspect":  Inspect,
+	"simulate": Simulate,
+	"validate": Validate,
+}
+
+// IsCommand returns whether the argument is the name of a subcommand. Argo Rollouts starts
+// the plugin only with flags, so any other first argument is left to the plugin
+func IsCommand(name string) bool {
+	_, isOk := commandMap[name]
+	return isOk
+}
+
+// Run runs the subcommand and writes its output to out
+func Run(name string, args []string, out io.Writer) error {
+	command, isOk := commandMap[name]
+	if !isOk {
+		return fmt.Errorf("unknown command %q", name)
+	}
+	return command(args, out)
+}
+
+// readYAMLDocuments returns the documents of a YAML file separated by "---"
+func readYAMLDocuments(path string) ([][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(file))
+	var documentList [][]byte
+	for {
+		document, err := reader.Read()
+		if err == io.EOF {
+			return documentList, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if len(bytes.TrimSpace(document)) != 0 {
+			documentList = append(documentList, document)
+		}
+	}
+}
+
+// stringListFlag collects the values of a flag that can be repeated
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return fmt.Sprint([]string(*f))
+}
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
@@ -0,0 +1,466 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	rolloutsFake "github.com/argoproj/argo-rollouts/pkg/client/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+	"sigs.k8s.io/gateway-api/apis/v1alpha2"
+	gwFake "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned/fake"
+
+	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/internal/defaults"
+	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/pkg/plugin"
+)
+
+const rolloutManifest = `
+apiVersion: argoproj.io/v1alpha1
+kind: Rollout
+metadata:
+  name: rollouts-demo
+  namespace: default
+spec:
+  strategy:
+    canary:
+      canaryService: argo-rollouts-canary-service
+      stableService: argo-rollouts-stable-service
+      trafficRouting:
+        managedRoutes:
+          - name: header-route
+        plugins:
+          argoproj-labs/gatewayAPI:
+            namespace: default
+            httpRoutes:
+              - name: argo-rollouts-http-route
+                useHeaderRoutes: true
+      steps:
+        - setWeight: 30
+        - setHeaderRoute:
+            name: header-route
+            match:
+              - headerName: X-Test
+                headerValue:
+                  exact: test
+        - pause: {}
+`
+
+const routeManifest = `
+apiVersion: gateway.networking.k8s.io/v1
+kind: HTTPRoute
+metadata:
+  name: argo-rollouts-http-route
+spec:
+  parentRefs:
+    - name: traefik-gateway
+  rules:
+    - backendRefs:
+        - name: argo-rollouts-stable-service
+          port: 80
+        - name: argo-rollouts-canary-service
+          port: 80
+`
+
+func TestSimulate(t *testing.T) {
+	rolloutPath := writeTestFile(t, "rollout.yaml", rolloutManifest)
+	routePath := writeTestFile(t, "route.yaml", routeManifest)
+	t.Run("YAMLOutput", func(t *testing.T) {
+		out := &bytes.Buffer{}
+
+		err := Run("simulate", []string{"--rollout", rolloutPath, "--route", routePath}, out)
+
+		assert.NoError(t, err)
+		assert.Contains(t, out.String(), "# Step 1: setWeight 30\n")
+		assert.Contains(t, out.String(), "weight: 70\n")
+		assert.Contains(t, out.String(), "# Step 2: setHeaderRoute header-route\n")
+		assert.Contains(t, out.String(), "value: test\n")
+		assert.Contains(t, out.String(), "# Step 3: doesn't change routes\n")
+		assert.Contains(t, out.String(), "# Promotion\n")
+	})
+	t.Run("DiffOutput", func(t *testing.T) {
+		out := &bytes.Buffer{}
+
+		err := Run("simulate", []string{"--rollout", rolloutPath, "--route", routePath, "--output", "diff"}, out)
+
+		assert.NoError(t, err)
+		assert.Contains(t, out.String(), "+      weight: 70\n")
+		assert.Contains(t, out.String(), "-      weight: 70\n")
+	})
+	t.Run("UnsupportedKind", func(t *testing.T) {
+		servicePath := writeTestFile(t, "service.yaml", "apiVersion: v1\nkind: Service\nmetadata:\n  name: test\n")
+
+		err := Run("simulate", []string{"--rollout", rolloutPath, "--route", servicePath}, &bytes.Buffer{})
+
+		assert.ErrorContains(t, err, `kind "Service" is not supported`)
+	})
+}
+
+func TestValidate(t *testing.T) {
+	routePath := writeTestFile(t, "route.yaml", routeManifest)
+	t.Run("ValidRollout", func(t *testing.T) {
+		rolloutPath := writeTestFile(t, "rollout.yaml", rolloutManifest)
+		out := &bytes.Buffer{}
+
+		err := Run("validate", []string{"--rollout", rolloutPath, "--route", routePath}, out)
+
+		assert.NoError(t, err)
+		assert.Empty(t, out.String())
+	})
+	t.Run("InvalidRollout", func(t *testing.T) {
+		rolloutPath := writeTestFile(t, "rollout.yaml", `apiVersion: argoproj.io/v1alpha1
+kind: Rollout
+metadata:
+  name: rollouts-demo
+spec:
+  strategy:
+    canary:
+      canaryService: argo-rollouts-canary-service
+      stableService: other-stable-service
+      trafficRouting:
+        plugins:
+          argoproj-labs/gatewayAPI:
+            httpRoute: argo-rollouts-http-route
+            tcpRoutes:
+              - name: tcp-route
+                useHeaderRoutes: true
+`)
+		out := &bytes.Buffer{}
+
+		err := Run("validate", []string{"--rollout", rolloutPath, "--route", routePath}, out)
+
+		assert.ErrorContains(t, err, "found 3 problems")
+		assert.Contains(t, out.String(), rolloutPath+`:15: TCPRoute "tcp-route" has useHeaderRoutes`)
+		assert.Contains(t, out.String(), rolloutPath+`:15: TCPRoute "tcp-route" is not in the route files`)
+		assert.Contains(t, out.String(), routePath+`:2: HTTPRoute "argo-rollouts-http-route" has no rule with backendRefs "other-stable-service" and "argo-rollouts-canary-service"`)
+	})
+	t.Run("SetHeaderRouteWithoutHeaderRoutes", func(t *testing.T) {
+		rolloutPath := writeTestFile(t, "rollout.yaml", `apiVersion: argoproj.io/v1alpha1
+kind: Rollout
+metadata:
+  name: rollouts-demo
+spec:
+  strategy:
+    canary:
+      trafficRouting:
+        managedRoutes:
+          - name: header-route
+        plugins:
+          argoproj-labs/gatewayAPI:
+            httpRoutes:
+              - name: argo-rollouts-http-route
+      steps:
+        - setHeaderRoute:
+            name: header-route
+`)
+		out := &bytes.Buffer{}
+
+		err := Run("validate", []string{"--rollout", rolloutPath}, out)
+
+		assert.ErrorContains(t, err, "found 1 problems")
+		assert.Contains(t, out.String(), rolloutPath+`:16: setHeaderRoute step has no effect`)
+	})
+	t.Run("SetHeaderRouteOfCanaryHostname", func(t *testing.T) {
+		rolloutPath := writeTestFile(t, "rollout.yaml", `apiVersion: argoproj.io/v1alpha1
+kind: Rollout
+metadata:
+  name: rollouts-demo
+spec:
+  strategy:
+    canary:
+      trafficRouting:
+        managedRoutes:
+          - name: canary-hostname
+        plugins:
+          argoproj-labs/gatewayAPI:
+            httpRoutes:
+              - name: argo-rollouts-http-route
+                canaryHostname:
+                  prefix: canary.
+                  managedRoute: canary-hostname
+      steps:
+        - setHeaderRoute:
+            name: canary-hostname
+`)
+		out := &bytes.Buffer{}
+
+		err := Run("validate", []string{"--rollout", rolloutPath}, out)
+
+		assert.NoError(t, err)
+		assert.Empty(t, out.String())
+	})
+	t.Run("BackendRefReference", func(t *testing.T) {
+		rolloutPath := writeTestFile(t, "rollout.yaml", `apiVersion: argoproj.io/v1alpha1
+kind: Rollout
+metadata:
+  name: rollouts-demo
+spec:
+  strategy:
+    canary:
+      canaryService: argo-rollouts-canary-service
+      stableService: argo-rollouts-stable-service
+      trafficRouting:
+        plugins:
+          argoproj-labs/gatewayAPI:
+            httpRoute: argo-rollouts-http-route
+            stableBackendRef:
+              port: 8080
+`)
+		out := &bytes.Buffer{}
+
+		err := Run("validate", []string{"--rollout", rolloutPath, "--route", routePath}, out)
+
+		assert.ErrorContains(t, err, "found 1 problems")
+		assert.Contains(t, out.String(), routePath+`:2: HTTPRoute "argo-rollouts-http-route" has no rule with backendRefs`)
+	})
+	t.Run("DeprecatedRouteCombination", func(t *testing.T) {
+		rolloutPath := writeTestFile(t, "rollout.yaml", `apiVersion: argoproj.io/v1alpha1
+kind: Rollout
+metadata:
+  name: rollouts-demo
+spec:
+  strategy:
+    canary:
+      trafficRouting:
+        plugins:
+          argoproj-labs/gatewayAPI:
+            httpRoute: argo-rollouts-http-route
+            httpRoutes:
+              - name: other-http-route
+`)
+		out := &bytes.Buffer{}
+
+		err := Run("validate", []string{"--rollout", rolloutPath}, out)
+
+		assert.NoError(t, err)
+		assert.Contains(t, out.String(), rolloutPath+`:11: warning: "httpRoute" and "httpRoutes" are both set`)
+	})
+	t.Run("InvalidPluginConfig", func(t *testing.T) {
+		rolloutPath := writeTestFile(t, "rollout.yaml", `apiVersion: argoproj.io/v1alpha1
+kind: Rollout
+metadata:
+  name: rollouts-demo
+spec:
+  strategy:
+    canary:
+      trafficRouting:
+        plugins:
+          argoproj-labs/gatewayAPI:
+            httpRoutes:
+              - useHeaderRoutes: true
+              - name: other-http-route
+                nmae: typo
+`)
+		out := &bytes.Buffer{}
+
+		err := Run("validate", []string{"--rollout", rolloutPath}, out)
+
+		assert.Error(t, err)
+		assert.Contains(t, out.String(), rolloutPath+`:14: unknown field "httpRoutes[1].nmae"`)
+	})
+	t.Run("InvalidPluginConfigValue", func(t *testing.T) {
+		rolloutPath := writeTestFile(t, "rollout.yaml", `apiVersion: argoproj.io/v1alpha1
+kind: Rollout
+metadata:
+  name: rollouts-demo
+spec:
+  strategy:
+    canary:
+      trafficRouting:
+        plugins:
+          argoproj-labs/gatewayAPI:
+            httpRoute: argo-rollouts-http-route
+            grpcRoutes:
+              - useHeaderRoutes: true
+            weightScale: 2000000
+`)
+		out := &bytes.Buffer{}
+
+		err := Run("validate", []string{"--rollout", rolloutPath}, out)
+
+		assert.ErrorContains(t, err, "found 2 problems")
+		assert.Contains(t, out.String(), rolloutPath+":13: grpcRoutes[0].name is required")
+		assert.Contains(t, out.String(), rolloutPath+":14: weightScale must be at most 1000000")
+	})
+	t.Run("SingleTCPRoute", func(t *testing.T) {
+		rolloutPath := writeTestFile(t, "rollout.yaml", `apiVersion: argoproj.io/v1alpha1
+kind: Rollout
+metadata:
+  name: rollouts-demo
+spec:
+  strategy:
+    canary:
+      trafficRouting:
+        plugins:
+          argoproj-labs/gatewayAPI:
+            tcpRoute: argo-rollouts-tcp-route
+`)
+		out := &bytes.Buffer{}
+
+		err := Run("validate", []string{"--rollout", rolloutPath}, out)
+
+		assert.NoError(t, err)
+		assert.Empty(t, out.String())
+	})
+}
+
+func TestInspect(t *testing.T) {
+	rollout, err := readRollout(writeTestFile(t, "rollout.yaml", rolloutManifest))
+	assert.NoError(t, err)
+	routeList, err := readRouteList([]string{writeTestFile(t, "route.yaml", routeManifest)}, metav1.NamespaceDefault)
+	assert.NoError(t, err)
+	httpRoute := routeList[0].(*gatewayv1.HTTPRoute)
+	weight := int32(70)
+	httpRoute.Spec.Rules[0].BackendRefs[0].Weight = &weight
+	headerMatchType := gatewayv1.HeaderMatchExact
+	httpRoute.Spec.Rules = append(httpRoute.Spec.Rules, gatewayv1.HTTPRouteRule{
+		Matches: []gatewayv1.HTTPRouteMatch{{
+			Headers: []gatewayv1.HTTPHeaderMatch{{
+				Type:  &headerMatchType,
+				Name:  "X-Test",
+				Value: "test",
+			}},
+		}},
+		BackendRefs: []gatewayv1.HTTPBackendRef{httpRoute.Spec.Rules[0].BackendRefs[1]},
+	})
+	// The header route step has been executed
+	currentStepIndex := int32(2)
+	rollout.Status.CurrentStepIndex = &currentStepIndex
+	configMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      defaults.ConfigMap,
+			Namespace: metav1.NamespaceDefault,
+		},
+		Data: map[string]string{
+			plugin.HTTPConfigMapKey: `{"header-route":{"argo-rollouts-http-route":1},"other-route":{"argo-rollouts-http-route":5,"missing-route":0}}`,
+		},
+	}
+	newInspector := func(out *bytes.Buffer) *inspector {
+		return &inspector{
+			clientset:           fake.NewSimpleClientset(configMap),
+			gatewayAPIClientset: gwFake.NewSimpleClientset(httpRoute),
+			rolloutsClientset:   rolloutsFake.NewSimpleClientset(rollout),
+			out:                 out,
+		}
+	}
+	t.Run("Namespace", func(t *testing.T) {
+		out := &bytes.Buffer{}
+
+		err := newInspector(out).inspect(context.TODO(), inspectOptions{
+			namespace: metav1.NamespaceDefault,
+			configMap: defaults.ConfigMap,
+		})
+
+		assert.NoError(t, err)
+		assert.Regexp(t, `header-route +HTTPRoute +argo-rollouts-http-route +1 +argo-rollouts-canary-service=1 +in sync\n`, out.String())
+		assert.Regexp(t, `other-route +HTTPRoute +argo-rollouts-http-route +5 +- +rule not found\n`, out.String())
+		assert.Regexp(t, `other-route +HTTPRoute +missing-route +0 +- +route not found\n`, out.String())
+		assert.NotContains(t, out.String(), WeightedRuleName)
+	})
+	t.Run("Rollout", func(t *testing.T) {
+		out := &bytes.Buffer{}
+
+		err := newInspector(out).inspect(context.TODO(), inspectOptions{
+			namespace:   metav1.NamespaceDefault,
+			rolloutName: rollout.Name,
+		})
+
+		assert.NoError(t, err)
+		assert.Regexp(t, `\(weighted\) +HTTPRoute +argo-rollouts-http-route +0 +argo-rollouts-stable-service=70,argo-rollouts-canary-service=1 +-\n`, out.String())
+		assert.Regexp(t, `header-route +HTTPRoute +argo-rollouts-http-route +1 +argo-rollouts-canary-service=1 +in sync\n`, out.String())
+		assert.NotContains(t, out.String(), "other-route")
+	})
+	t.Run("RuleDiffers", func(t *testing.T) {
+		changedHTTPRoute := httpRoute.DeepCopy()
+		changedHTTPRoute.Spec.Rules[1].Matches[0].Headers[0].Value = "other"
+		out := &bytes.Buffer{}
+		i := newInspector(out)
+		i.gatewayAPIClientset = gwFake.NewSimpleClientset(changedHTTPRoute)
+
+		err := i.inspect(context.TODO(), inspectOptions{
+			namespace:   metav1.NamespaceDefault,
+			rolloutName: rollout.Name,
+		})
+
+		assert.NoError(t, err)
+		assert.Regexp(t, `header-route +HTTPRoute +argo-rollouts-http-route +1 +argo-rollouts-canary-service=1 +rule differs\n`, out.String())
+	})
+	t.Run("TCPRoute", func(t *testing.T) {
+		tcpRollout := rollout.DeepCopy()
+		tcpRollout.Spec.Strategy.Canary.TrafficRouting.Plugins[plugin.PluginName] = []byte(`{"namespace":"default","tcpRoutes":[{"name":"tcp-route"}]}`)
+		serviceImportKind := gatewayv1.Kind("ServiceImport")
+		tcpRoute := &v1alpha2.TCPRoute{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "tcp-route",
+				Namespace: metav1.NamespaceDefault,
+			},
+			Spec: v1alpha2.TCPRouteSpec{
+				Rules: []v1alpha2.TCPRouteRule{
+					{
+						BackendRefs: []gatewayv1.BackendRef{httpRoute.Spec.Rules[0].BackendRefs[0].BackendRef},
+					},
+					{
+						BackendRefs: []gatewayv1.BackendRef{{
+							BackendObjectReference: gatewayv1.BackendObjectReference{
+								Kind: &serviceImportKind,
+								Name: "argo-rollouts-stable-service",
+							},
+						}},
+					},
+				},
+			},
+		}
+		out := &bytes.Buffer{}
+		i := newInspector(out)
+		i.gatewayAPIClientset = gwFake.NewSimpleClientset(tcpRoute)
+		i.rolloutsClientset = rolloutsFake.NewSimpleClientset(tcpRollout)
+
+		err := i.inspect(context.TODO(), inspectOptions{
+			namespace:   metav1.NamespaceDefault,
+			rolloutName: rollout.Name,
+		})
+
+		assert.NoError(t, err)
+		assert.Regexp(t, `\(weighted\) +TCPRoute +tcp-route +0 +argo-rollouts-stable-service=70 +-\n`, out.String())
+		assert.NotRegexp(t, `tcp-route +1 `, out.String())
+	})
+	t.Run("DedicatedRoute", func(t *testing.T) {
+		dedicatedHTTPRoute := &gatewayv1.HTTPRoute{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "header-route",
+				Namespace: metav1.NamespaceDefault,
+				Labels: map[string]string{
+					plugin.ManagedByLabel: plugin.ManagedByLabelValue,
+				},
+			},
+			Spec: gatewayv1.HTTPRouteSpec{
+				Rules: []gatewayv1.HTTPRouteRule{{
+					BackendRefs: []gatewayv1.HTTPBackendRef{httpRoute.Spec.Rules[0].BackendRefs[1]},
+				}},
+			},
+		}
+		out := &bytes.Buffer{}
+		i := newInspector(out)
+		i.gatewayAPIClientset = gwFake.NewSimpleClientset(httpRoute, dedicatedHTTPRoute)
+
+		err := i.inspect(context.TODO(), inspectOptions{
+			namespace: metav1.NamespaceDefault,
+			configMap: defaults.ConfigMap,
+		})
+
+		assert.NoError(t, err)
+		assert.Regexp(t, `- +HTTPRoute +header-route +0 +argo-rollouts-canary-service=1 +-\n`, out.String())
+	})
+}
+
+func writeTestFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0o600)
+	assert.NoError(t, err)
+	return path
+}
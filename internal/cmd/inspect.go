@@ -0,0 +1,497 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+	rolloutsClientset "github.com/argoproj/argo-rollouts/pkg/client/clientset/versioned"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+	gatewayApiClientset "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned"
+
+	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/internal/defaults"
+	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/internal/utils"
+	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/pkg/plugin"
+)
+
+const (
+	InSyncState        = "in sync"
+	RouteNotFoundState = "route not found"
+	RuleNotFoundState  = "rule not found"
+	RuleDiffersState   = "rule differs"
+	// NotComparedState is shown for the rules that have no entry in the config map to compare with
+	NotComparedState = "-"
+	// WeightedRuleName is shown instead of a managed route name for the rule with the stable backendRef
+	WeightedRuleName = "(weighted)"
+)
+
+// inspector reads the managed routes from the config map and compares them with the live routes
+type inspector struct {
+	clientset           kubernetes.Interface
+	gatewayAPIClientset gatewayApiClientset.Interface
+	rolloutsClientset   rolloutsClientset.Interface
+	out                 io.Writer
+}
+
+// inspectOptions refers to what is inspected. Without rollout every entry of the config map is shown
+type inspectOptions struct {
+	namespace   string
+	configMap   string
+	rolloutName string
+}
+
+// liveRoute is the route of one of the kinds with the backendRefs of its rules. TCPRoutes have no header rules,
+// so only their backendRefs are kept
+type liveRoute struct {
+	httpRoute       *gatewayv1.HTTPRoute
+	grpcRoute       *gatewayv1.GRPCRoute
+	ruleBackendRefs [][]gatewayv1.BackendRef
+}
+
+// inspectedRule is a row of the inspect output
+type inspectedRule struct {
+	managedRoute string
+	kind         string
+	route        string
+	rule         string
+	weights      string
+	state        string
+}
+
+// Inspect prints the managed rules of a namespace or a rollout together with their live state
+func Inspect(args []string, out io.Writer) error {
+	flagSet := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	flagSet.SetOutput(out)
+	options := inspectOptions{}
+	flagSet.StringVar(&options.namespace, "namespace", metav1.NamespaceDefault, "The namespace of the plugin config map or the rollout.")
+	flagSet.StringVar(&options.configMap, "configMap", defaults.ConfigMap, "The plugin config map. It is taken from the rollout when the rollout is set.")
+	flagSet.StringVar(&options.rolloutName, "rollout", "", "The rollout to show the managed rules of.")
+	err := flagSet.Parse(args)
+	if err != nil {
+		return err
+	}
+	kubeConfig, err := utils.GetKubeConfig()
+	if err != nil {
+		return err
+	}
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return err
+	}
+	gatewayAPIClientset, err := gatewayApiClientset.NewForConfig(kubeConfig)
+	if err != nil {
+		return err
+	}
+	rolloutsClientset, err := rolloutsClientset.NewForConfig(kubeConfig)
+	if err != nil {
+		return err
+	}
+	i := &inspector{
+		clientset:           clientset,
+		gatewayAPIClientset: gatewayAPIClientset,
+		rolloutsClientset:   rolloutsClientset,
+		out:                 out,
+	}
+	return i.inspect(context.TODO(), options)
+}
+
+func (i *inspector) inspect(ctx context.Context, options inspectOptions) error {
+	var rollout *v1alpha1.Rollout
+	var gatewayAPIConfig *plugin.GatewayAPITrafficRouting
+	routeNamespace := options.namespace
+	if options.rolloutName != "" {
+		var err error
+		rollout, err = i.rolloutsClientset.ArgoprojV1alpha1().Rollouts(options.namespace).Get(ctx, options.rolloutName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		gatewayAPIConfig, err = plugin.GetGatewayAPITrafficRoutingConfig(rollout)
+		if err != nil {
+			return fmt.Errorf("rollout %s/%s: %w", rollout.Namespace, rollout.Name, err)
+		}
+		routeNamespace = gatewayAPIConfig.Namespace
+		options.configMap = gatewayAPIConfig.ConfigMap
+	}
+	// Without config map nothing was managed yet, so only the routes are shown
+	configMap, err := i.clientset.CoreV1().ConfigMaps(routeNamespace).Get(ctx, options.configMap, metav1.GetOptions{})
+	if kubeErrors.IsNotFound(err) {
+		configMap = &v1.ConfigMap{}
+	} else if err != nil {
+		return err
+	}
+	var inspectedRuleList []inspectedRule
+	for kind, configMapKey := range map[string]string{plugin.HTTPRouteKind: plugin.HTTPConfigMapKey, plugin.GRPCRouteKind: plugin.GRPCConfigMapKey} {
+		managedRouteMap := make(plugin.ManagedRouteMap)
+		err = utils.GetConfigMapData(configMap, configMapKey, &managedRouteMap)
+		if err != nil {
+			return err
+		}
+		for managedRouteName, routeMap := range managedRouteMap {
+			if rollout != nil && !isManagedRouteOfRollout(rollout, managedRouteName) {
+				continue
+			}
+			for routeName, ruleIndex := range routeMap {
+				if gatewayAPIConfig != nil && !slices.Contains(getRouteNameList(gatewayAPIConfig, kind), routeName) {
+					continue
+				}
+				inspectedRule, err := i.inspectManagedRule(ctx, routeNamespace, kind, routeName, managedRouteName, ruleIndex, rollout, gatewayAPIConfig)
+				if err != nil {
+					return err
+				}
+				inspectedRuleList = append(inspectedRuleList, inspectedRule)
+			}
+		}
+	}
+	dedicatedRuleList, err := i.inspectDedicatedRoutes(ctx, routeNamespace, gatewayAPIConfig, rollout)
+	if err != nil {
+		return err
+	}
+	inspectedRuleList = append(inspectedRuleList, dedicatedRuleList...)
+	if gatewayAPIConfig != nil {
+		weightedRuleList, err := i.inspectWeightedRules(ctx, routeNamespace, gatewayAPIConfig, rollout)
+		if err != nil {
+			return err
+		}
+		inspectedRuleList = append(inspectedRuleList, weightedRuleList...)
+	}
+	sort.SliceStable(inspectedRuleList, func(a, b int) bool {
+		ruleA, ruleB := inspectedRuleList[a], inspectedRuleList[b]
+		if ruleA.kind+ruleA.route != ruleB.kind+ruleB.route {
+			return ruleA.kind+ruleA.route < ruleB.kind+ruleB.route
+		}
+		return ruleA.rule < ruleB.rule
+	})
+	return i.print(inspectedRuleList)
+}
+
+// inspectManagedRule compares the config map entry with the rule of the live route. The header rule
+// the entry points to has to have a single backendRef. When the rollout is known, the rule has to be the one
+// the plugin builds for the last setHeaderRoute step of the managed route the rollout has executed
+func (i *inspector) inspectManagedRule(ctx context.Context, namespace string, kind string, routeName string, managedRouteName string, ruleIndex int, rollout *v1alpha1.Rollout, gatewayAPIConfig *plugin.GatewayAPITrafficRouting) (inspectedRule, error) {
+	inspectedRule := inspectedRule{
+		managedRoute: managedRouteName,
+		kind:         kind,
+		route:        routeName,
+		rule:         strconv.Itoa(ruleIndex),
+	}
+	route, err := i.getRoute(ctx, namespace, kind, routeName)
+	if kubeErrors.IsNotFound(err) {
+		inspectedRule.state = RouteNotFoundState
+		return inspectedRule, nil
+	}
+	if err != nil {
+		return inspectedRule, err
+	}
+	if ruleIndex < 0 || ruleIndex >= len(route.ruleBackendRefs) {
+		inspectedRule.state = RuleNotFoundState
+		return inspectedRule, nil
+	}
+	backendRefList := route.ruleBackendRefs[ruleIndex]
+	inspectedRule.weights = formatWeights(backendRefList)
+	inspectedRule.state = InSyncState
+	isInSync := len(backendRefList) == 1
+	if isInSync && rollout != nil {
+		isInSync = isHeaderRuleInSync(route, ruleIndex, managedRouteName, rollout, gatewayAPIConfig)
+	}
+	if !isInSync {
+		inspectedRule.state = RuleDiffersState
+	}
+	return inspectedRule, nil
+}
+
+// isHeaderRuleInSync compares the rule with the header rule the plugin builds from the live route. The weights
+// aren't compared, because they change with every step, and the defaults of Gateway API are applied to the matches
+func isHeaderRuleInSync(route *liveRoute, ruleIndex int, managedRouteName string, rollout *v1alpha1.Rollout, gatewayAPIConfig *plugin.GatewayAPITrafficRouting) bool {
+	headerRouting := getLastHeaderRouting(rollout, managedRouteName)
+	if headerRouting == nil || headerRouting.Match == nil {
+		return false
+	}
+	if route.httpRoute != nil {
+		expectedRule, err := plugin.GetHTTPHeaderRouteRule(rollout, headerRouting, route.httpRoute, gatewayAPIConfig)
+		if err != nil {
+			return false
+		}
+		liveRule := route.httpRoute.Spec.Rules[ruleIndex]
+		return equality.Semantic.DeepEqual(getDefaultedHTTPRouteMatchList(expectedRule.Matches), getDefaultedHTTPRouteMatchList(liveRule.Matches)) &&
+			equality.Semantic.DeepEqual(expectedRule.Filters, liveRule.Filters) &&
+			equality.Semantic.DeepEqual(expectedRule.Timeouts, liveRule.Timeouts) &&
+			equality.Semantic.DeepEqual(getBackendObjectReferenceList(expectedRule.BackendRefs, getHTTPBackendObjectReference), getBackendObjectReferenceList(liveRule.BackendRefs, getHTTPBackendObjectReference))
+	}
+	if route.grpcRoute != nil {
+		expectedRule, err := plugin.GetGRPCHeaderRouteRule(rollout, headerRouting, route.grpcRoute, gatewayAPIConfig)
+		if err != nil {
+			return false
+		}
+		liveRule := route.grpcRoute.Spec.Rules[ruleIndex]
+		return equality.Semantic.DeepEqual(getDefaultedGRPCRouteMatchList(expectedRule.Matches), getDefaultedGRPCRouteMatchList(liveRule.Matches)) &&
+			equality.Semantic.DeepEqual(expectedRule.Filters, liveRule.Filters) &&
+			equality.Semantic.DeepEqual(getBackendObjectReferenceList(expectedRule.BackendRefs, getGRPCBackendObjectReference), getBackendObjectReferenceList(liveRule.BackendRefs, getGRPCBackendObjectReference))
+	}
+	return false
+}
+
+// getLastHeaderRouting returns the last setHeaderRoute step of the managed route before the current step,
+// which is the step the header rule was built for
+func getLastHeaderRouting(rollout *v1alpha1.Rollout, managedRouteName string) *v1alpha1.SetHeaderRoute {
+	stepList := rollout.Spec.Strategy.Canary.Steps
+	executedStepCount := 0
+	if rollout.Status.CurrentStepIndex != nil {
+		executedStepCount = min(int(*rollout.Status.CurrentStepIndex), len(stepList))
+	}
+	var headerRouting *v1alpha1.SetHeaderRoute
+	for _, step := range stepList[:executedStepCount] {
+		if step.SetHeaderRoute != nil && step.SetHeaderRoute.Name == managedRouteName {
+			headerRouting = step.SetHeaderRoute
+		}
+	}
+	return headerRouting
+}
+
+// inspectDedicatedRoutes returns the HTTPRoutes created by the plugin. When the rollout is known,
+// only the routes it owns are returned, except the ones created from its templates, which are weighted
+func (i *inspector) inspectDedicatedRoutes(ctx context.Context, namespace string, gatewayAPIConfig *plugin.GatewayAPITrafficRouting, rollout *v1alpha1.Rollout) ([]inspectedRule, error) {
+	httpRouteList, err := i.gatewayAPIClientset.GatewayV1().HTTPRoutes(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: plugin.ManagedByLabel + "=" + plugin.ManagedByLabelValue,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var inspectedRuleList []inspectedRule
+	for _, httpRoute := range httpRouteList.Items {
+		if rollout != nil && !slices.ContainsFunc(httpRoute.OwnerReferences, func(ownerReference metav1.OwnerReference) bool {
+			return ownerReference.UID == rollout.UID
+		}) {
+			continue
+		}
+		if gatewayAPIConfig != nil && slices.Contains(getRouteNameList(gatewayAPIConfig, plugin.HTTPRouteKind), httpRoute.Name) {
+			continue
+		}
+		for ruleIndex, rule := range httpRoute.Spec.Rules {
+			inspectedRuleList = append(inspectedRuleList, inspectedRule{
+				managedRoute: "-",
+				kind:         plugin.HTTPRouteKind,
+				route:        httpRoute.Name,
+				rule:         strconv.Itoa(ruleIndex),
+				weights:      formatWeights(getBackendRefList(rule.BackendRefs)),
+				state:        NotComparedState,
+			})
+		}
+	}
+	return inspectedRuleList, nil
+}
+
+// inspectWeightedRules returns the rules with the stable backendRef of the routes of the rollout.
+// Their weights change with every step, so only a missing route is reported as state
+func (i *inspector) inspectWeightedRules(ctx context.Context, namespace string, gatewayAPIConfig *plugin.GatewayAPITrafficRouting, rollout *v1alpha1.Rollout) ([]inspectedRule, error) {
+	var inspectedRuleList []inspectedRule
+	_, stableServiceName := plugin.GetServiceNames(rollout)
+	stableBackendRefReference := plugin.GetBackendRefReference(stableServiceName, gatewayAPIConfig.StableBackendRef)
+	for _, kind := range []string{plugin.HTTPRouteKind, plugin.GRPCRouteKind, plugin.TCPRouteKind} {
+		for _, routeName := range getRouteNameList(gatewayAPIConfig, kind) {
+			route, err := i.getRoute(ctx, namespace, kind, routeName)
+			if kubeErrors.IsNotFound(err) {
+				inspectedRuleList = append(inspectedRuleList, inspectedRule{
+					managedRoute: WeightedRuleName,
+					kind:         kind,
+					route:        routeName,
+					rule:         "-",
+					state:        RouteNotFoundState,
+				})
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			for ruleIndex, backendRefList := range route.ruleBackendRefs {
+				if !slices.ContainsFunc(backendRefList, func(backendRef gatewayv1.BackendRef) bool {
+					return stableBackendRefReference.IsMatched(backendRef.BackendObjectReference, namespace)
+				}) {
+					continue
+				}
+				inspectedRuleList = append(inspectedRuleList, inspectedRule{
+					managedRoute: WeightedRuleName,
+					kind:         kind,
+					route:        routeName,
+					rule:         strconv.Itoa(ruleIndex),
+					weights:      formatWeights(backendRefList),
+					state:        NotComparedState,
+				})
+			}
+		}
+	}
+	return inspectedRuleList, nil
+}
+
+// getRoute returns the live route of the kind together with the backendRefs of every rule
+func (i *inspector) getRoute(ctx context.Context, namespace string, kind string, routeName string) (*liveRoute, error) {
+	route := &liveRoute{}
+	switch kind {
+	case plugin.HTTPRouteKind:
+		httpRoute, err := i.gatewayAPIClientset.GatewayV1().HTTPRoutes(namespace).Get(ctx, routeName, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		route.httpRoute = httpRoute
+		for _, rule := range httpRoute.Spec.Rules {
+			route.ruleBackendRefs = append(route.ruleBackendRefs, getBackendRefList(rule.BackendRefs))
+		}
+	case plugin.GRPCRouteKind:
+		grpcRoute, err := i.gatewayAPIClientset.GatewayV1().GRPCRoutes(namespace).Get(ctx, routeName, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		route.grpcRoute = grpcRoute
+		for _, rule := range grpcRoute.Spec.Rules {
+			route.ruleBackendRefs = append(route.ruleBackendRefs, getGRPCBackendRefList(rule.BackendRefs))
+		}
+	default:
+		tcpRoute, err := i.gatewayAPIClientset.GatewayV1alpha2().TCPRoutes(namespace).Get(ctx, routeName, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range tcpRoute.Spec.Rules {
+			route.ruleBackendRefs = append(route.ruleBackendRefs, slices.Clone(rule.BackendRefs))
+		}
+	}
+	return route, nil
+}
+
+func (i *inspector) print(inspectedRuleList []inspectedRule) error {
+	writer := tabwriter.NewWriter(i.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "MANAGED ROUTE\tKIND\tROUTE\tRULE\tWEIGHTS\tSTATE")
+	for _, rule := range inspectedRuleList {
+		weights := rule.weights
+		if weights == "" {
+			weights = "-"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", rule.managedRoute, rule.kind, rule.route, rule.rule, weights, rule.state)
+	}
+	return writer.Flush()
+}
+
+func getBackendRefList(httpBackendRefList []gatewayv1.HTTPBackendRef) []gatewayv1.BackendRef {
+	backendRefList := []gatewayv1.BackendRef{}
+	for _, httpBackendRef := range httpBackendRefList {
+		backendRefList = append(backendRefList, httpBackendRef.BackendRef)
+	}
+	return backendRefList
+}
+
+func getGRPCBackendRefList(grpcBackendRefList []gatewayv1.GRPCBackendRef) []gatewayv1.BackendRef {
+	backendRefList := []gatewayv1.BackendRef{}
+	for _, grpcBackendRef := range grpcBackendRefList {
+		backendRefList = append(backendRefList, grpcBackendRef.BackendRef)
+	}
+	return backendRefList
+}
+
+func getHTTPBackendObjectReference(backendRef gatewayv1.HTTPBackendRef) gatewayv1.BackendObjectReference {
+	return backendRef.BackendObjectReference
+}
+
+func getGRPCBackendObjectReference(backendRef gatewayv1.GRPCBackendRef) gatewayv1.BackendObjectReference {
+	return backendRef.BackendObjectReference
+}
+
+// getDefaultedHTTPRouteMatchList returns the matches with the defaults the API server sets for the missing fields
+func getDefaultedHTTPRouteMatchList(httpRouteMatchList []gatewayv1.HTTPRouteMatch) []gatewayv1.HTTPRouteMatch {
+	defaultedHTTPRouteMatchList := []gatewayv1.HTTPRouteMatch{}
+	for _, httpRouteMatch := range httpRouteMatchList {
+		defaultedHTTPRouteMatch := *httpRouteMatch.DeepCopy()
+		if defaultedHTTPRouteMatch.Path == nil {
+			defaultedHTTPRouteMatch.Path = &gatewayv1.HTTPPathMatch{}
+		}
+		if defaultedHTTPRouteMatch.Path.Type == nil {
+			pathMatchType := gatewayv1.PathMatchPathPrefix
+			defaultedHTTPRouteMatch.Path.Type = &pathMatchType
+		}
+		if defaultedHTTPRouteMatch.Path.Value == nil {
+			pathValue := "/"
+			defaultedHTTPRouteMatch.Path.Value = &pathValue
+		}
+		for j := range defaultedHTTPRouteMatch.Headers {
+			if defaultedHTTPRouteMatch.Headers[j].Type == nil {
+				headerMatchType := gatewayv1.HeaderMatchExact
+				defaultedHTTPRouteMatch.Headers[j].Type = &headerMatchType
+			}
+		}
+		for j := range defaultedHTTPRouteMatch.QueryParams {
+			if defaultedHTTPRouteMatch.QueryParams[j].Type == nil {
+				queryParamMatchType := gatewayv1.QueryParamMatchExact
+				defaultedHTTPRouteMatch.QueryParams[j].Type = &queryParamMatchType
+			}
+		}
+		defaultedHTTPRouteMatchList = append(defaultedHTTPRouteMatchList, defaultedHTTPRouteMatch)
+	}
+	return defaultedHTTPRouteMatchList
+}
+
+// getDefaultedGRPCRouteMatchList returns the matches with the defaults the API server sets for the missing fields
+func getDefaultedGRPCRouteMatchList(grpcRouteMatchList []gatewayv1.GRPCRouteMatch) []gatewayv1.GRPCRouteMatch {
+	defaultedGRPCRouteMatchList := []gatewayv1.GRPCRouteMatch{}
+	for _, grpcRouteMatch := range grpcRouteMatchList {
+		defaultedGRPCRouteMatch := *grpcRouteMatch.DeepCopy()
+		if defaultedGRPCRouteMatch.Method != nil && defaultedGRPCRouteMatch.Method.Type == nil {
+			methodMatchType := gatewayv1.GRPCMethodMatchExact
+			defaultedGRPCRouteMatch.Method.Type = &methodMatchType
+		}
+		for j := range defaultedGRPCRouteMatch.Headers {
+			if defaultedGRPCRouteMatch.Headers[j].Type == nil {
+				headerMatchType := gatewayv1.HeaderMatchExact
+				defaultedGRPCRouteMatch.Headers[j].Type = &headerMatchType
+			}
+		}
+		defaultedGRPCRouteMatchList = append(defaultedGRPCRouteMatchList, defaultedGRPCRouteMatch)
+	}
+	return defaultedGRPCRouteMatchList
+}
+
+// formatWeights returns the backendRefs as name=weight. Gateway API defaults the weight to 1
+func formatWeights(backendRefList []gatewayv1.BackendRef) string {
+	weightList := []string{}
+	for _, backendRef := range backendRefList {
+		weight := int32(1)
+		if backendRef.Weight != nil {
+			weight = *backendRef.Weight
+		}
+		weightList = append(weightList, fmt.Sprintf("%s=%d", backendRef.Name, weight))
+	}
+	return strings.Join(weightList, ",")
+}
+
+func getRouteNameList(gatewayAPIConfig *plugin.GatewayAPITrafficRouting, kind string) []string {
+	routeNameList := []string{}
+	switch kind {
+	case plugin.HTTPRouteKind:
+		for _, route := range gatewayAPIConfig.HTTPRoutes {
+			routeNameList = append(routeNameList, route.Name)
+		}
+	case plugin.GRPCRouteKind:
+		for _, route := range gatewayAPIConfig.GRPCRoutes {
+			routeNameList = append(routeNameList, route.Name)
+		}
+	default:
+		for _, route := range gatewayAPIConfig.TCPRoutes {
+			routeNameList = append(routeNameList, route.Name)
+		}
+	}
+	return routeNameList
+}
+
+func isManagedRouteOfRollout(rollout *v1alpha1.Rollout, managedRouteName string) bool {
+	return slices.ContainsFunc(rollout.Spec.Strategy.Canary.TrafficRouting.ManagedRoutes, func(managedRoute v1alpha1.MangedRoutes) bool {
+		return managedRoute.Name == managedRouteName
+	})
+}
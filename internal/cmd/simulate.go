@@ -0,0 +1,288 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+	pluginTypes "github.com/argoproj/argo-rollouts/utils/plugin/types"
+	"github.com/pmezard/go-difflib/difflib"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+	"sigs.k8s.io/gateway-api/apis/v1alpha2"
+	gwFake "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned/fake"
+	"sigs.k8s.io/yaml"
+
+	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/internal/utils"
+	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/pkg/plugin"
+)
+
+const (
+	YAMLOutput = "yaml"
+	DiffOutput = "diff"
+)
+
+// simulation runs the steps of a rollout with the plugin against in-memory routes
+type simulation struct {
+	rpcPlugin         *plugin.RpcPlugin
+	gatewayAPIClient  *gwFake.Clientset
+	namespace         string
+	output            string
+	out               io.Writer
+	previousRouteYAML string
+}
+
+// Simulate prints the routes after every canary step of the rollout
+func Simulate(args []string, out io.Writer) error {
+	flagSet := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	flagSet.SetOutput(out)
+	rolloutPath := flagSet.String("rollout", "", "The file with the Rollout.")
+	output := flagSet.String("output", YAMLOutput, "The output of every step: yaml or diff.")
+	var routePathList stringListFlag
+	flagSet.Var(&routePathList, "route", "The file with HTTPRoutes, GRPCRoutes or TCPRoutes. Can be repeated.")
+	err := flagSet.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *rolloutPath == "" || len(routePathList) == 0 {
+		return errors.New("the rollout and route flags are required")
+	}
+	if *output != YAMLOutput && *output != DiffOutput {
+		return fmt.Errorf("unknown output %q", *output)
+	}
+	rollout, err := readRollout(*rolloutPath)
+	if err != nil {
+		return err
+	}
+	namespace := getSimulationNamespace(rollout)
+	routeList, err := readRouteList(routePathList, namespace)
+	if err != nil {
+		return err
+	}
+	s := newSimulation(routeList, namespace, *output, out)
+	return s.run(rollout)
+}
+
+func newSimulation(routeList []runtime.Object, namespace string, output string, out io.Writer) *simulation {
+	// The plugin logs every call, which would hide the routes
+	logCtx := utils.SetupLog()
+	log.SetLevel(log.WarnLevel)
+	gatewayAPIClient := gwFake.NewSimpleClientset(routeList...)
+	return &simulation{
+		rpcPlugin: &plugin.RpcPlugin{
+			LogCtx:          logCtx,
+			IsTest:          true,
+			HTTPRouteClient: gatewayAPIClient.GatewayV1().HTTPRoutes(namespace),
+			GRPCRouteClient: gatewayAPIClient.GatewayV1().GRPCRoutes(namespace),
+			TCPRouteClient:  gatewayAPIClient.GatewayV1alpha2().TCPRoutes(namespace),
+			TestClientset:   fake.NewSimpleClientset().CoreV1().ConfigMaps(namespace),
+		},
+		gatewayAPIClient: gatewayAPIClient,
+		namespace:        namespace,
+		output:           output,
+		out:              out,
+	}
+}
+
+// run calls the plugin like Argo Rollouts does during the rollout. After the last step
+// the rollout is promoted, so the managed routes are removed and the canary weight is set to 0
+func (s *simulation) run(rollout *v1alpha1.Rollout) error {
+	err := s.printRoutes("Initial routes")
+	if err != nil {
+		return err
+	}
+	for i, step := range rollout.Spec.Strategy.Canary.Steps {
+		var rpcError pluginTypes.RpcError
+		var title string
+		switch {
+		case step.SetWeight != nil:
+			title = fmt.Sprintf("Step %d: setWeight %d", i+1, *step.SetWeight)
+			rpcError = s.rpcPlugin.SetWeight(rollout, *step.SetWeight, []v1alpha1.WeightDestination{})
+		case step.SetHeaderRoute != nil:
+			title = fmt.Sprintf("Step %d: setHeaderRoute %s", i+1, step.SetHeaderRoute.Name)
+			rpcError = s.rpcPlugin.SetHeaderRoute(rollout, step.SetHeaderRoute)
+		default:
+			fmt.Fprintf(s.out, "# Step %d: doesn't change routes\n", i+1)
+			continue
+		}
+		if rpcError.HasError() {
+			return fmt.Errorf("%s: %s", title, rpcError.Error())
+		}
+		err = s.printRoutes(title)
+		if err != nil {
+			return err
+		}
+	}
+	rpcError := s.rpcPlugin.RemoveManagedRoutes(rollout)
+	if rpcError.HasError() {
+		return fmt.Errorf("promotion: %s", rpcError.Error())
+	}
+	rpcError = s.rpcPlugin.SetWeight(rollout, 0, []v1alpha1.WeightDestination{})
+	if rpcError.HasError() {
+		return fmt.Errorf("promotion: %s", rpcError.Error())
+	}
+	return s.printRoutes("Promotion")
+}
+
+func (s *simulation) printRoutes(title string) error {
+	routeYAML, err := s.getRouteYAML()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "# %s\n", title)
+	if s.output == YAMLOutput {
+		fmt.Fprint(s.out, routeYAML)
+		s.previousRouteYAML = routeYAML
+		return nil
+	}
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(s.previousRouteYAML),
+		B:        difflib.SplitLines(routeYAML),
+		FromFile: "before",
+		ToFile:   "after",
+		Context:  3,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(s.out, diff)
+	s.previousRouteYAML = routeYAML
+	return nil
+}
+
+// getRouteYAML returns all routes sorted by kind and name, including the ones created by the plugin
+func (s *simulation) getRouteYAML() (string, error) {
+	ctx := context.TODO()
+	var routeList []runtime.Object
+	httpRouteList, err := s.gatewayAPIClient.GatewayV1().HTTPRoutes(s.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(httpRouteList.Items, func(i, j int) bool {
+		return httpRouteList.Items[i].Name < httpRouteList.Items[j].Name
+	})
+	for i := range httpRouteList.Items {
+		httpRoute := &httpRouteList.Items[i]
+		httpRoute.TypeMeta = metav1.TypeMeta{APIVersion: gatewayv1.GroupVersion.String(), Kind: plugin.HTTPRouteKind}
+		routeList = append(routeList, httpRoute)
+	}
+	grpcRouteList, err := s.gatewayAPIClient.GatewayV1().GRPCRoutes(s.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(grpcRouteList.Items, func(i, j int) bool {
+		return grpcRouteList.Items[i].Name < grpcRouteList.Items[j].Name
+	})
+	for i := range grpcRouteList.Items {
+		grpcRoute := &grpcRouteList.Items[i]
+		grpcRoute.TypeMeta = metav1.TypeMeta{APIVersion: gatewayv1.GroupVersion.String(), Kind: plugin.GRPCRouteKind}
+		routeList = append(routeList, grpcRoute)
+	}
+	tcpRouteList, err := s.gatewayAPIClient.GatewayV1alpha2().TCPRoutes(s.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(tcpRouteList.Items, func(i, j int) bool {
+		return tcpRouteList.Items[i].Name < tcpRouteList.Items[j].Name
+	})
+	for i := range tcpRouteList.Items {
+		tcpRoute := &tcpRouteList.Items[i]
+		tcpRoute.TypeMeta = metav1.TypeMeta{APIVersion: v1alpha2.GroupVersion.String(), Kind: plugin.TCPRouteKind}
+		routeList = append(routeList, tcpRoute)
+	}
+	var routeYAMLList []string
+	for _, route := range routeList {
+		// The status and the creation timestamp only add noise to the output
+		unstructuredRoute, err := runtime.DefaultUnstructuredConverter.ToUnstructured(route)
+		if err != nil {
+			return "", err
+		}
+		delete(unstructuredRoute, "status")
+		delete(unstructuredRoute["metadata"].(map[string]interface{}), "creationTimestamp")
+		routeYAML, err := yaml.Marshal(unstructuredRoute)
+		if err != nil {
+			return "", err
+		}
+		routeYAMLList = append(routeYAMLList, string(routeYAML))
+	}
+	return strings.Join(routeYAMLList, "---\n"), nil
+}
+
+func readRollout(path string) (*v1alpha1.Rollout, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rollout := &v1alpha1.Rollout{}
+	err = yaml.Unmarshal(content, rollout)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if rollout.Spec.Strategy.Canary == nil {
+		return nil, fmt.Errorf("%s: only rollouts with the canary strategy can be simulated", path)
+	}
+	return rollout, nil
+}
+
+// readRouteList returns the routes of the files. Routes without namespace are put into the namespace of the simulation
+func readRouteList(pathList []string, namespace string) ([]runtime.Object, error) {
+	var routeList []runtime.Object
+	for _, path := range pathList {
+		documentList, err := readYAMLDocuments(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, document := range documentList {
+			typeMeta := metav1.TypeMeta{}
+			err = yaml.Unmarshal(document, &typeMeta)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			var route metav1.Object
+			switch typeMeta.Kind {
+			case plugin.HTTPRouteKind:
+				route = &gatewayv1.HTTPRoute{}
+			case plugin.GRPCRouteKind:
+				route = &gatewayv1.GRPCRoute{}
+			case plugin.TCPRouteKind:
+				route = &v1alpha2.TCPRoute{}
+			default:
+				return nil, fmt.Errorf("%s: kind %q is not supported", path, typeMeta.Kind)
+			}
+			err = yaml.Unmarshal(document, route)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			if route.GetNamespace() == "" {
+				route.SetNamespace(namespace)
+			}
+			routeList = append(routeList, route.(runtime.Object))
+		}
+	}
+	return routeList, nil
+}
+
+func getSimulationNamespace(rollout *v1alpha1.Rollout) string {
+	if rollout.Namespace == "" {
+		rollout.Namespace = metav1.NamespaceDefault
+	}
+	gatewayAPIConfig := struct {
+		Namespace string `json:"namespace"`
+	}{}
+	if rollout.Spec.Strategy.Canary.TrafficRouting != nil {
+		_ = yaml.Unmarshal(rollout.Spec.Strategy.Canary.TrafficRouting.Plugins[plugin.PluginName], &gatewayAPIConfig)
+	}
+	if gatewayAPIConfig.Namespace != "" {
+		return gatewayAPIConfig.Namespace
+	}
+	return rollout.Namespace
+}
@@ -0,0 +1,419 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+	"gopkg.in/yaml.v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+	"sigs.k8s.io/gateway-api/apis/v1alpha2"
+	sigsYAML "sigs.k8s.io/yaml"
+
+	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/pkg/plugin"
+)
+
+// pluginConfigPath is the path of the plugin configuration in a Rollout
+var pluginConfigPath = []string{"spec", "strategy", "canary", "trafficRouting", "plugins", plugin.PluginName}
+
+// problem is a mistake in a manifest at a line of the file
+type problem struct {
+	path    string
+	line    int
+	message string
+}
+
+func (p problem) String() string {
+	return fmt.Sprintf("%s:%d: %s", p.path, p.line, p.message)
+}
+
+// routeBackendRefs refers to the backendRefs of every rule of a route
+type routeBackendRefs struct {
+	path            string
+	line            int
+	namespace       string
+	ruleBackendRefs [][]gatewayv1.BackendObjectReference
+}
+
+// Validate checks the plugin configuration of the rollouts and, when route files are given,
+// that the routes have the backendRefs the plugin needs
+func Validate(args []string, out io.Writer) error {
+	flagSet := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flagSet.SetOutput(out)
+	var rolloutPathList, routePathList stringListFlag
+	flagSet.Var(&rolloutPathList, "rollout", "The file with Rollouts. Can be repeated.")
+	flagSet.Var(&routePathList, "route", "The file with HTTPRoutes, GRPCRoutes or TCPRoutes. Can be repeated.")
+	err := flagSet.Parse(args)
+	if err != nil {
+		return err
+	}
+	// Other arguments are rollout files as well, so tools like pre-commit can append the changed files
+	rolloutPathList = append(rolloutPathList, flagSet.Args()...)
+	if len(rolloutPathList) == 0 {
+		return errors.New("the rollout flag is required")
+	}
+	var routeMap map[string]routeBackendRefs
+	if len(routePathList) != 0 {
+		routeMap, err = readRouteBackendRefs(routePathList)
+		if err != nil {
+			return err
+		}
+	}
+	var problemList, warningList []problem
+	for _, rolloutPath := range rolloutPathList {
+		rolloutProblemList, rolloutWarningList, err := validateRolloutFile(rolloutPath, routeMap)
+		if err != nil {
+			return err
+		}
+		problemList = append(problemList, rolloutProblemList...)
+		warningList = append(warningList, rolloutWarningList...)
+	}
+	// Warnings are about configurations that still work, so they don't fail the validation
+	for _, w := range warningList {
+		fmt.Fprintf(out, "%s:%d: warning: %s\n", w.path, w.line, w.message)
+	}
+	for _, p := range problemList {
+		fmt.Fprintln(out, p)
+	}
+	if len(problemList) != 0 {
+		return fmt.Errorf("found %d problems", len(problemList))
+	}
+	return nil
+}
+
+func validateRolloutFile(path string, routeMap map[string]routeBackendRefs) ([]problem, []problem, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	var problemList, warningList []problem
+	for {
+		documentNode := &yaml.Node{}
+		err = decoder.Decode(documentNode)
+		if err == io.EOF {
+			return problemList, warningList, nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if getScalar(findNode(documentNode, "kind")) != "Rollout" {
+			continue
+		}
+		document, err := yaml.Marshal(documentNode)
+		if err != nil {
+			return nil, nil, err
+		}
+		rollout := &v1alpha1.Rollout{}
+		err = sigsYAML.Unmarshal(document, rollout)
+		if err != nil {
+			problemList = append(problemList, problem{path, documentNode.Line, err.Error()})
+			continue
+		}
+		problemList = append(problemList, validateRollout(path, documentNode, rollout, routeMap)...)
+		warningList = append(warningList, getDeprecationWarnings(path, documentNode, rollout)...)
+	}
+}
+
+// getDeprecationWarnings returns the deprecated combinations of the plugin configuration at the line of the configuration
+func getDeprecationWarnings(path string, documentNode *yaml.Node, rollout *v1alpha1.Rollout) []problem {
+	gatewayAPIConfig, err := plugin.GetGatewayAPITrafficRoutingConfig(rollout)
+	if err != nil {
+		return nil
+	}
+	var warningList []problem
+	for _, warning := range plugin.GetDeprecationWarningList(gatewayAPIConfig) {
+		warningList = append(warningList, problem{path, getLine(findNode(documentNode, pluginConfigPath...)), warning})
+	}
+	return warningList
+}
+
+func validateRollout(path string, documentNode *yaml.Node, rollout *v1alpha1.Rollout, routeMap map[string]routeBackendRefs) []problem {
+	pluginNode := findNode(documentNode, pluginConfigPath...)
+	if pluginNode == nil {
+		return []problem{{path, getLine(documentNode), fmt.Sprintf("rollout %q has no %q plugin configuration", rollout.Name, plugin.PluginName)}}
+	}
+	gatewayAPIConfig, err := plugin.GetGatewayAPITrafficRoutingConfig(rollout)
+	if err != nil {
+		return getConfigProblems(path, pluginNode, err)
+	}
+	var problemList []problem
+	managedRouteNameList := []string{}
+	for _, managedRoute := range rollout.Spec.Strategy.Canary.TrafficRouting.ManagedRoutes {
+		managedRouteNameList = append(managedRouteNameList, managedRoute.Name)
+	}
+	isHeaderRouteUsed := false
+	for _, route := range gatewayAPIConfig.HTTPRoutes {
+		routeNode := findRouteNode(pluginNode, "httpRoutes", "httpRoute", route.Name)
+		isHeaderRouteUsed = isHeaderRouteUsed || route.UseHeaderRoutes
+		if route.CanaryHostname != nil && route.CanaryHostname.ManagedRoute != "" && !slices.Contains(managedRouteNameList, route.CanaryHostname.ManagedRoute) {
+			problemList = append(problemList, problem{path, getLine(routeNode), fmt.Sprintf("canaryHostname of HTTPRoute %q refers to managed route %q, which is not in trafficRouting.managedRoutes", route.Name, route.CanaryHostname.ManagedRoute)})
+		}
+		if route.Template == nil && route.TemplateRef == nil {
+			problemList = append(problemList, validateRouteBackendRefs(path, routeNode, plugin.HTTPRouteKind, route.Name, rollout, gatewayAPIConfig, routeMap)...)
+		}
+	}
+	for _, route := range gatewayAPIConfig.GRPCRoutes {
+		routeNode := findRouteNode(pluginNode, "grpcRoutes", "grpcRoute", route.Name)
+		isHeaderRouteUsed = isHeaderRouteUsed || route.UseHeaderRoutes
+		problemList = append(problemList, validateRouteBackendRefs(path, routeNode, plugin.GRPCRouteKind, route.Name, rollout, gatewayAPIConfig, routeMap)...)
+	}
+	for _, route := range gatewayAPIConfig.TCPRoutes {
+		routeNode := findRouteNode(pluginNode, "tcpRoutes", "tcpRoute", route.Name)
+		if route.UseHeaderRoutes {
+			problemList = append(problemList, problem{path, getLine(routeNode), fmt.Sprintf("TCPRoute %q has useHeaderRoutes, but TCPRoutes don't support header routes", route.Name)})
+		}
+		problemList = append(problemList, validateRouteBackendRefs(path, routeNode, plugin.TCPRouteKind, route.Name, rollout, gatewayAPIConfig, routeMap)...)
+	}
+	for managedRouteName := range gatewayAPIConfig.ManagedRoutes {
+		if !slices.Contains(managedRouteNameList, managedRouteName) {
+			problemList = append(problemList, problem{path, getLine(findNode(pluginNode, "managedRoutes", managedRouteName)), fmt.Sprintf("managed route %q is not in trafficRouting.managedRoutes", managedRouteName)})
+		}
+	}
+	for i, step := range rollout.Spec.Strategy.Canary.Steps {
+		if step.SetHeaderRoute != nil && !isHeaderRouteUsed && !isCanaryHostnameManagedBy(gatewayAPIConfig.HTTPRoutes, step.SetHeaderRoute.Name) {
+			stepNode := findNode(documentNode, "spec", "strategy", "canary", "steps", strconv.Itoa(i))
+			problemList = append(problemList, problem{path, getLine(stepNode), fmt.Sprintf("setHeaderRoute step has no effect, because no HTTPRoute or GRPCRoute has useHeaderRoutes and no canaryHostname has managedRoute %q", step.SetHeaderRoute.Name)})
+		}
+	}
+	slices.SortStableFunc(problemList, func(a, b problem) int {
+		if a.path != b.path {
+			return strings.Compare(a.path, b.path)
+		}
+		return a.line - b.line
+	})
+	return problemList
+}
+
+// getConfigProblems returns the mistakes of the plugin configuration at the lines of their fields
+func getConfigProblems(path string, pluginNode *yaml.Node, err error) []problem {
+	var configError *plugin.ConfigError
+	if !errors.As(err, &configError) {
+		return []problem{{path, getLine(pluginNode), err.Error()}}
+	}
+	var problemList []problem
+	for _, fieldError := range configError.FieldErrorList {
+		fieldNode := findClosestNode(pluginNode, splitJSONPath(fieldError.Path)...)
+		problemList = append(problemList, problem{path, getLine(fieldNode), fieldError.Message})
+	}
+	return problemList
+}
+
+// isCanaryHostnameManagedBy returns whether the managed route creates the canary hostname HTTPRoute of a route
+func isCanaryHostnameManagedBy(routeList []plugin.HTTPRoute, managedRouteName string) bool {
+	return slices.ContainsFunc(routeList, func(route plugin.HTTPRoute) bool {
+		return route.CanaryHostname.IsManagedBy(managedRouteName)
+	})
+}
+
+// validateRouteBackendRefs checks that one rule of the route has the stable and canary backendRefs with the group,
+// kind, namespace and port of the configuration. In insert mode the canary backendRef is added by the plugin,
+// so only the stable one is needed
+func validateRouteBackendRefs(path string, routeNode *yaml.Node, kind string, routeName string, rollout *v1alpha1.Rollout, gatewayAPIConfig *plugin.GatewayAPITrafficRouting, routeMap map[string]routeBackendRefs) []problem {
+	if routeMap == nil {
+		return nil
+	}
+	route, isOk := routeMap[kind+"/"+routeName]
+	if !isOk {
+		return []problem{{path, getLine(routeNode), fmt.Sprintf("%s %q is not in the route files", kind, routeName)}}
+	}
+	canary := rollout.Spec.Strategy.Canary
+	stableServiceName, canaryServiceName := canary.StableService, canary.CanaryService
+	if canary.PingPong != nil {
+		stableServiceName, canaryServiceName = canary.PingPong.PingService, canary.PingPong.PongService
+	}
+	// Routes without namespace are put into the namespace of the configuration
+	routeNamespace := route.namespace
+	if routeNamespace == "" {
+		routeNamespace = gatewayAPIConfig.Namespace
+	}
+	stableBackendRefReference := plugin.GetBackendRefReference(stableServiceName, gatewayAPIConfig.StableBackendRef)
+	canaryBackendRefReference := plugin.GetBackendRefReference(canaryServiceName, gatewayAPIConfig.CanaryBackendRef)
+	for _, backendRefList := range route.ruleBackendRefs {
+		isStableFound := slices.ContainsFunc(backendRefList, func(backendRef gatewayv1.BackendObjectReference) bool {
+			return stableBackendRefReference.IsMatched(backendRef, routeNamespace)
+		})
+		isCanaryFound := gatewayAPIConfig.InsertCanaryBackendRef || slices.ContainsFunc(backendRefList, func(backendRef gatewayv1.BackendObjectReference) bool {
+			return canaryBackendRefReference.IsMatched(backendRef, routeNamespace)
+		})
+		if isStableFound && isCanaryFound {
+			return nil
+		}
+	}
+	message := fmt.Sprintf("%s %q has no rule with backendRefs %q and %q", kind, routeName, stableServiceName, canaryServiceName)
+	if gatewayAPIConfig.InsertCanaryBackendRef {
+		message = fmt.Sprintf("%s %q has no rule with backendRef %q", kind, routeName, stableServiceName)
+	}
+	return []problem{{route.path, route.line, message}}
+}
+
+// readRouteBackendRefs returns the backendRefs of the routes by kind and name
+func readRouteBackendRefs(pathList []string) (map[string]routeBackendRefs, error) {
+	routeMap := make(map[string]routeBackendRefs)
+	for _, path := range pathList {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		for {
+			documentNode := &yaml.Node{}
+			err = decoder.Decode(documentNode)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			document, err := yaml.Marshal(documentNode)
+			if err != nil {
+				return nil, err
+			}
+			kind := getScalar(findNode(documentNode, "kind"))
+			var route metav1.Object
+			var ruleBackendRefs [][]gatewayv1.BackendObjectReference
+			switch kind {
+			case plugin.HTTPRouteKind:
+				httpRoute := &gatewayv1.HTTPRoute{}
+				err = sigsYAML.Unmarshal(document, httpRoute)
+				for _, rule := range httpRoute.Spec.Rules {
+					ruleBackendRefs = append(ruleBackendRefs, getBackendObjectReferenceList(rule.BackendRefs, func(backendRef gatewayv1.HTTPBackendRef) gatewayv1.BackendObjectReference {
+						return backendRef.BackendObjectReference
+					}))
+				}
+				route = httpRoute
+			case plugin.GRPCRouteKind:
+				grpcRoute := &gatewayv1.GRPCRoute{}
+				err = sigsYAML.Unmarshal(document, grpcRoute)
+				for _, rule := range grpcRoute.Spec.Rules {
+					ruleBackendRefs = append(ruleBackendRefs, getBackendObjectReferenceList(rule.BackendRefs, func(backendRef gatewayv1.GRPCBackendRef) gatewayv1.BackendObjectReference {
+						return backendRef.BackendObjectReference
+					}))
+				}
+				route = grpcRoute
+			case plugin.TCPRouteKind:
+				tcpRoute := &v1alpha2.TCPRoute{}
+				err = sigsYAML.Unmarshal(document, tcpRoute)
+				for _, rule := range tcpRoute.Spec.Rules {
+					ruleBackendRefs = append(ruleBackendRefs, getBackendObjectReferenceList(rule.BackendRefs, func(backendRef v1alpha2.BackendRef) gatewayv1.BackendObjectReference {
+						return backendRef.BackendObjectReference
+					}))
+				}
+				route = tcpRoute
+			default:
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, getLine(documentNode), err)
+			}
+			routeMap[kind+"/"+route.GetName()] = routeBackendRefs{
+				path:            path,
+				line:            getLine(documentNode),
+				namespace:       route.GetNamespace(),
+				ruleBackendRefs: ruleBackendRefs,
+			}
+		}
+	}
+	return routeMap, nil
+}
+
+func getBackendObjectReferenceList[T any](backendRefList []T, getObjectReference func(backendRef T) gatewayv1.BackendObjectReference) []gatewayv1.BackendObjectReference {
+	objectReferenceList := []gatewayv1.BackendObjectReference{}
+	for _, backendRef := range backendRefList {
+		objectReferenceList = append(objectReferenceList, getObjectReference(backendRef))
+	}
+	return objectReferenceList
+}
+
+// findRouteNode returns the node of the route with the name in the route list
+// or the node of the single route
+func findRouteNode(pluginNode *yaml.Node, listKey string, singleKey string, name string) *yaml.Node {
+	routeListNode := findNode(pluginNode, listKey)
+	if routeListNode != nil && routeListNode.Kind == yaml.SequenceNode {
+		for _, routeNode := range routeListNode.Content {
+			if getScalar(findNode(routeNode, "name")) == name {
+				return routeNode
+			}
+		}
+	}
+	routeNode := findNode(pluginNode, singleKey)
+	if routeNode != nil {
+		return routeNode
+	}
+	return pluginNode
+}
+
+// findNode returns the node at the path of mapping keys and sequence indexes, or nil when there is none
+func findNode(node *yaml.Node, path ...string) *yaml.Node {
+	if node != nil && node.Kind == yaml.DocumentNode && len(node.Content) != 0 {
+		node = node.Content[0]
+	}
+	for _, key := range path {
+		if node == nil {
+			return nil
+		}
+		switch node.Kind {
+		case yaml.MappingNode:
+			var valueNode *yaml.Node
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					valueNode = node.Content[i+1]
+					break
+				}
+			}
+			node = valueNode
+		case yaml.SequenceNode:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(node.Content) {
+				return nil
+			}
+			node = node.Content[index]
+		default:
+			return nil
+		}
+	}
+	return node
+}
+
+// findClosestNode returns the node at the path or, when the field is missing, the node of its closest parent
+func findClosestNode(node *yaml.Node, path ...string) *yaml.Node {
+	for i := len(path); i > 0; i-- {
+		closestNode := findNode(node, path[:i]...)
+		if closestNode != nil {
+			return closestNode
+		}
+	}
+	return node
+}
+
+// splitJSONPath returns the keys and indexes of a path like httpRoutes[0].name
+func splitJSONPath(path string) []string {
+	return strings.FieldsFunc(path, func(r rune) bool {
+		return r == '.' || r == '[' || r == ']'
+	})
+}
+
+func getScalar(node *yaml.Node) string {
+	if node == nil || node.Kind != yaml.ScalarNode {
+		return ""
+	}
+	return node.Value
+}
+
+func getLine(node *yaml.Node) int {
+	if node == nil {
+		return 0
+	}
+	if node.Kind == yaml.DocumentNode && len(node.Content) != 0 {
+		return node.Content[0].Line
+	}
+	return node.Line
+}
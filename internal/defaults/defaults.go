@@ -1,3 +1,18 @@
 package defaults
 
 const ConfigMap = "argo-gatewayapi-configmap"
+
+// ManagedByLabel marks the routes and config maps created by the plugin
+const ManagedByLabel = "app.kubernetes.io/managed-by"
+
+// ManagedByLabelValue is the value of ManagedByLabel for the objects of the plugin
+const ManagedByLabelValue = "argo-rollouts-gatewayapi-plugin"
+
+// WeightScale is the default sum of the canary and stable backendRef weights
+const WeightScale int32 = 100
+
+// MaxTrafficWeight is the default total weight Argo Rollouts uses for desired weights
+const MaxTrafficWeight int32 = 100
+
+// MaxBackendRefWeight is the maximum weight Gateway API allows for a backendRef
+const MaxBackendRefWeight int32 = 1000000
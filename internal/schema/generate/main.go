@@ -0,0 +1,35 @@
+// Command generate writes the JSON Schema and the OpenAPI fragment of the plugin configuration
+// into the schema directory. It is run from the root of the repository by "make generate-schema"
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/internal/schema"
+)
+
+const (
+	sourceDir = "pkg/plugin"
+	schemaDir = "schema"
+)
+
+func main() {
+	jsonSchema, openAPI, err := schema.Generate(sourceDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.MkdirAll(schemaDir, 0o755)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(schemaDir, schema.JSONSchemaFile), jsonSchema, 0o644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(schemaDir, schema.OpenAPIFile), openAPI, 0o644)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,355 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/pkg/plugin"
+)
+
+const (
+	// JSONSchemaFile and OpenAPIFile refer to the generated files in the schema directory of the repository
+	JSONSchemaFile = "gatewayapi-plugin-config.schema.json"
+	OpenAPIFile    = "gatewayapi-plugin-config.openapi.yaml"
+	// RootSchemaName refers to the schema of the plugin configuration under trafficRouting.plugins
+	RootSchemaName         = "GatewayAPITrafficRouting"
+	jsonSchemaDraft        = "https://json-schema.org/draft/2020-12/schema"
+	gatewayAPIReferenceURL = "https://gateway-api.sigs.k8s.io/reference/spec/#gateway.networking.k8s.io/%s.%s"
+	jsonSchemaRefPrefix    = "#/$defs/"
+	openAPIRefPrefix       = "#/components/schemas/"
+	schemaTitle            = "Gateway API plugin configuration"
+	rootDescription        = "The configuration of the Gateway API plugin in spec.strategy.canary.trafficRouting.plugins[\"" + plugin.PluginName + "\"] of a Rollout"
+)
+
+// generator builds the schemas of the types of the plugin configuration. The schemas refer to
+// each other by name, so the same definitions are used for JSON Schema and OpenAPI
+type generator struct {
+	// fieldDocMap refers to the doc comments of the plugin types by "Type.Field"
+	fieldDocMap map[string]string
+	// typeDocMap refers to the doc comments of the plugin types by type name
+	typeDocMap    map[string]string
+	definitionMap map[string]map[string]any
+	refPrefix     string
+}
+
+// Generate returns the JSON Schema and the OpenAPI fragment of the plugin configuration. The descriptions
+// are taken from the doc comments of the Go files in sourceDir, which is the directory of pkg/plugin
+func Generate(sourceDir string) ([]byte, []byte, error) {
+	fieldDocMap, typeDocMap, err := readDocs(sourceDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	jsonSchemaGenerator := newGenerator(fieldDocMap, typeDocMap, jsonSchemaRefPrefix)
+	jsonSchemaGenerator.addDefinition(reflect.TypeOf(plugin.GatewayAPITrafficRouting{}))
+	jsonSchema, err := json.MarshalIndent(map[string]any{
+		"$schema":     jsonSchemaDraft,
+		"title":       schemaTitle,
+		"description": rootDescription,
+		"$ref":        jsonSchemaRefPrefix + RootSchemaName,
+		"$defs":       jsonSchemaGenerator.definitionMap,
+	}, "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+	openAPIGenerator := newGenerator(fieldDocMap, typeDocMap, openAPIRefPrefix)
+	openAPIGenerator.addDefinition(reflect.TypeOf(plugin.GatewayAPITrafficRouting{}))
+	openAPI, err := yaml.Marshal(map[string]any{
+		"components": map[string]any{
+			"schemas": openAPIGenerator.definitionMap,
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(jsonSchema, '\n'), openAPI, nil
+}
+
+func newGenerator(fieldDocMap map[string]string, typeDocMap map[string]string, refPrefix string) *generator {
+	return &generator{
+		fieldDocMap:   fieldDocMap,
+		typeDocMap:    typeDocMap,
+		definitionMap: make(map[string]map[string]any),
+		refPrefix:     refPrefix,
+	}
+}
+
+// addDefinition adds the schema of the struct and of all structs it refers to. It returns the name of the definition
+func (g *generator) addDefinition(structType reflect.Type) string {
+	name := getDefinitionName(structType)
+	if _, isOk := g.definitionMap[name]; isOk {
+		return name
+	}
+	definition := map[string]any{
+		"type": "object",
+		// The plugin rejects unknown fields
+		"additionalProperties": false,
+	}
+	// The definition is added before its fields, so types that refer to themselves don't recurse forever
+	g.definitionMap[name] = definition
+	description := g.typeDocMap[structType.Name()]
+	if !isPluginType(structType) {
+		description = fmt.Sprintf("Gateway API %s. See "+gatewayAPIReferenceURL, structType.Name(), filepath.Base(structType.PkgPath()), structType.Name())
+	}
+	if name == RootSchemaName {
+		description = rootDescription
+	}
+	if description != "" {
+		definition["description"] = description
+	}
+	propertyMap := make(map[string]any)
+	var requiredList []string
+	var excludedList []any
+	g.addFields(structType, propertyMap, &requiredList, &excludedList)
+	definition["properties"] = propertyMap
+	if len(requiredList) != 0 {
+		definition["required"] = requiredList
+	}
+	if len(excludedList) != 0 {
+		definition["allOf"] = excludedList
+	}
+	return name
+}
+
+// addFields adds the properties of the struct fields. Embedded structs without JSON name are inlined like encoding/json does
+func (g *generator) addFields(structType reflect.Type, propertyMap map[string]any, requiredList *[]string, excludedList *[]any) {
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		jsonName, jsonOptions, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if jsonName == "-" {
+			continue
+		}
+		if field.Anonymous && jsonName == "" {
+			g.addFields(dereference(field.Type), propertyMap, requiredList, excludedList)
+			continue
+		}
+		if jsonName == "" {
+			jsonName = field.Name
+		}
+		property := g.getSchema(field.Type)
+		validateTag := field.Tag.Get("validate")
+		for _, rule := range strings.Split(validateTag, ",") {
+			ruleName, ruleParam, _ := strings.Cut(rule, "=")
+			switch ruleName {
+			case "required":
+				*requiredList = append(*requiredList, jsonName)
+				if field.Type.Kind() == reflect.String {
+					property["minLength"] = 1
+				}
+			case "min", "max":
+				property[getLimitKeyword(field.Type, ruleName)] = json.Number(ruleParam)
+			case "excluded_with":
+				excludedField, _ := structType.FieldByName(ruleParam)
+				excludedName, _, _ := strings.Cut(excludedField.Tag.Get("json"), ",")
+				*excludedList = append(*excludedList, map[string]any{
+					"not": map[string]any{
+						"required": []string{jsonName, excludedName},
+					},
+				})
+			case "excluded_unless":
+				// The field is missing or empty, or the other field has the value
+				otherName, otherValue, _ := strings.Cut(ruleParam, " ")
+				otherField, _ := structType.FieldByName(otherName)
+				otherJSONName, _, _ := strings.Cut(otherField.Tag.Get("json"), ",")
+				*excludedList = append(*excludedList, map[string]any{
+					"anyOf": []any{
+						map[string]any{
+							"not": map[string]any{
+								"required": []string{jsonName},
+								"properties": map[string]any{
+									jsonName: map[string]any{
+										"not": map[string]any{
+											"enum": []any{reflect.Zero(dereference(field.Type)).Interface()},
+										},
+									},
+								},
+							},
+						},
+						map[string]any{
+							"required": []string{otherJSONName},
+							"properties": map[string]any{
+								otherJSONName: map[string]any{
+									"enum": []any{getJSONValue(otherField.Type, otherValue)},
+								},
+							},
+						},
+					},
+				})
+			}
+		}
+		// Gateway API marks the optional fields with omitempty, the plugin uses the validate tag instead
+		if !isPluginType(structType) && !strings.Contains(jsonOptions, "omitempty") {
+			*requiredList = append(*requiredList, jsonName)
+		}
+		// The doc comments start with the Go name of the field, but users know the JSON name
+		description, isOk := g.fieldDocMap[structType.Name()+"."+field.Name]
+		if isOk && isPluginType(structType) {
+			if strings.HasPrefix(description, field.Name+" ") {
+				description = jsonName + strings.TrimPrefix(description, field.Name)
+			}
+			property = withDescription(property, description)
+		}
+		propertyMap[jsonName] = property
+	}
+}
+
+// getSchema returns the schema of a field type. Structs are added as definitions and referred to
+func (g *generator) getSchema(fieldType reflect.Type) map[string]any {
+	fieldType = dereference(fieldType)
+	switch fieldType.Kind() {
+	case reflect.Struct:
+		return map[string]any{
+			"$ref": g.refPrefix + g.addDefinition(fieldType),
+		}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{
+			"type":  "array",
+			"items": g.getSchema(fieldType.Elem()),
+		}
+	case reflect.Map:
+		return map[string]any{
+			"type":                 "object",
+			"additionalProperties": g.getSchema(fieldType.Elem()),
+		}
+	case reflect.Bool:
+		return map[string]any{
+			"type": "boolean",
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{
+			"type": "integer",
+		}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{
+			"type": "number",
+		}
+	case reflect.String:
+		return map[string]any{
+			"type": "string",
+		}
+	default:
+		return map[string]any{}
+	}
+}
+
+// withDescription adds the description to the schema. OpenAPI 3.0 ignores the siblings of $ref,
+// so a reference is wrapped into allOf
+func withDescription(property map[string]any, description string) map[string]any {
+	if _, isOk := property["$ref"]; isOk {
+		property = map[string]any{
+			"allOf": []any{property},
+		}
+	}
+	property["description"] = description
+	return property
+}
+
+// getLimitKeyword returns the schema keyword of the min and max validator tags, which depends on the field type
+func getLimitKeyword(fieldType reflect.Type, ruleName string) string {
+	switch dereference(fieldType).Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return ruleName + "Items"
+	case reflect.String:
+		return ruleName + "Length"
+	}
+	if ruleName == "min" {
+		return "minimum"
+	}
+	return "maximum"
+}
+
+// getJSONValue returns the parameter of a validator tag as JSON value of the field type
+func getJSONValue(fieldType reflect.Type, value string) any {
+	switch dereference(fieldType).Kind() {
+	case reflect.Bool:
+		return value == "true"
+	case reflect.String:
+		return value
+	default:
+		return json.Number(value)
+	}
+}
+
+// getDefinitionName returns the type name. Gateway API types are prefixed with their version,
+// because the plugin has types with the same names
+func getDefinitionName(structType reflect.Type) string {
+	if isPluginType(structType) {
+		return structType.Name()
+	}
+	return filepath.Base(structType.PkgPath()) + "." + structType.Name()
+}
+
+func isPluginType(structType reflect.Type) bool {
+	return structType.PkgPath() == reflect.TypeOf(plugin.GatewayAPITrafficRouting{}).PkgPath()
+}
+
+func dereference(fieldType reflect.Type) reflect.Type {
+	for fieldType.Kind() == reflect.Pointer {
+		fieldType = fieldType.Elem()
+	}
+	return fieldType
+}
+
+// readDocs returns the doc comments of the struct fields and types in the Go files of the directory
+func readDocs(sourceDir string) (map[string]string, map[string]string, error) {
+	fileSet := token.NewFileSet()
+	packageMap, err := parser.ParseDir(fileSet, sourceDir, func(fileInfo os.FileInfo) bool {
+		return !strings.HasSuffix(fileInfo.Name(), "_test.go")
+	}, parser.ParseComments)
+	if err != nil {
+		return nil, nil, err
+	}
+	fieldDocMap := make(map[string]string)
+	typeDocMap := make(map[string]string)
+	for _, astPackage := range packageMap {
+		for _, file := range astPackage.Files {
+			ast.Inspect(file, func(node ast.Node) bool {
+				genDecl, isOk := node.(*ast.GenDecl)
+				if !isOk || genDecl.Tok != token.TYPE {
+					return true
+				}
+				for _, spec := range genDecl.Specs {
+					typeSpec := spec.(*ast.TypeSpec)
+					typeDoc := typeSpec.Doc
+					if typeDoc == nil && len(genDecl.Specs) == 1 {
+						typeDoc = genDecl.Doc
+					}
+					if typeDoc != nil {
+						typeDocMap[typeSpec.Name.Name] = formatDoc(typeDoc)
+					}
+					structType, isOk := typeSpec.Type.(*ast.StructType)
+					if !isOk {
+						continue
+					}
+					for _, field := range structType.Fields.List {
+						if field.Doc == nil {
+							continue
+						}
+						for _, fieldName := range field.Names {
+							fieldDocMap[typeSpec.Name.Name+"."+fieldName.Name] = formatDoc(field.Doc)
+						}
+					}
+				}
+				return false
+			})
+		}
+	}
+	return fieldDocMap, typeDocMap, nil
+}
+
+// formatDoc joins the lines of a doc comment into one line
+func formatDoc(commentGroup *ast.CommentGroup) string {
+	return strings.Join(strings.Fields(commentGroup.Text()), " ")
+}
@@ -0,0 +1,63 @@
+package schema
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeneratedSchemaIsUpToDate(t *testing.T) {
+	jsonSchema, openAPI, err := Generate("../../pkg/plugin")
+	assert.NoError(t, err)
+
+	committedJSONSchema, err := os.ReadFile(filepath.Join("../../schema", JSONSchemaFile))
+	assert.NoError(t, err)
+	committedOpenAPI, err := os.ReadFile(filepath.Join("../../schema", OpenAPIFile))
+	assert.NoError(t, err)
+
+	assert.Equal(t, string(committedJSONSchema), string(jsonSchema), "the JSON Schema is outdated, run make generate-schema")
+	assert.Equal(t, string(committedOpenAPI), string(openAPI), "the OpenAPI fragment is outdated, run make generate-schema")
+}
+
+func TestGenerate(t *testing.T) {
+	jsonSchema, _, err := Generate("../../pkg/plugin")
+	assert.NoError(t, err)
+	schema := struct {
+		Ref         string                    `json:"$ref"`
+		Definitions map[string]map[string]any `json:"$defs"`
+	}{}
+	err = json.Unmarshal(jsonSchema, &schema)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "#/$defs/"+RootSchemaName, schema.Ref)
+	root := schema.Definitions[RootSchemaName]
+	assert.Equal(t, false, root["additionalProperties"])
+	properties := root["properties"].(map[string]any)
+	assert.NotContains(t, properties, "ConfigMapRWMutex")
+	assert.Equal(t, map[string]any{
+		"description": "weightScale refers to the sum of the canary and stable backendRef weights. It allows canary steps finer than 1%, e.g. 1000 gives 0.1% steps",
+		"type":        "integer",
+		"minimum":     float64(1),
+		"maximum":     float64(1000000),
+	}, properties["weightScale"])
+	httpRoute := schema.Definitions["HTTPRoute"]
+	assert.Equal(t, []any{"name"}, httpRoute["required"])
+	assert.Contains(t, httpRoute["allOf"], map[string]any{"not": map[string]any{"required": []any{"template", "templateRef"}}})
+	assert.Contains(t, httpRoute["allOf"], map[string]any{"anyOf": []any{
+		map[string]any{"not": map[string]any{
+			"required":   []any{"useDedicatedHeaderRoutes"},
+			"properties": map[string]any{"useDedicatedHeaderRoutes": map[string]any{"not": map[string]any{"enum": []any{false}}}},
+		}},
+		map[string]any{
+			"required":   []any{"useHeaderRoutes"},
+			"properties": map[string]any{"useHeaderRoutes": map[string]any{"enum": []any{true}}},
+		},
+	}})
+	assert.Len(t, httpRoute["allOf"], 2)
+	httpRouteTemplate := schema.Definitions["HTTPRouteTemplate"]
+	assert.Equal(t, float64(1), httpRouteTemplate["properties"].(map[string]any)["parentRefs"].(map[string]any)["minItems"])
+	assert.Equal(t, []any{"name"}, schema.Definitions["v1.ParentReference"]["required"])
+}
@@ -10,6 +10,8 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/internal/defaults"
 )
 
 func GetKubeConfig() (*rest.Config, error) {
@@ -45,7 +47,14 @@ func GetOrCreateConfigMap(name string, options CreateConfigMapOptions) (*v1.Conf
 	if err == nil {
 		return configMap, err
 	}
-	configMap.Name = name
+	configMap = &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				defaults.ManagedByLabel: defaults.ManagedByLabelValue,
+			},
+		},
+	}
 	configMap, err = clientset.Create(ctx, configMap, metav1.CreateOptions{})
 	if err != nil {
 		return nil, err
@@ -73,6 +82,11 @@ func UpdateConfigMapData(configMap *v1.ConfigMap, configMapData any, options Upd
 		configMap.Data = make(map[string]string)
 	}
 	configMap.Data[options.ConfigMapKey] = string(rawConfigMapData)
+	// Config maps created by earlier versions get the label, so the garbage collector finds them
+	if configMap.Labels == nil {
+		configMap.Labels = make(map[string]string)
+	}
+	configMap.Labels[defaults.ManagedByLabel] = defaults.ManagedByLabelValue
 	_, err = clientset.Update(options.Ctx, configMap, metav1.UpdateOptions{})
 	return err
 }
@@ -2,12 +2,18 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
 
+	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/internal/cmd"
 	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/internal/utils"
 	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/pkg/plugin"
 
 	rolloutsPlugin "github.com/argoproj/argo-rollouts/rollout/trafficrouting/plugin/rpc"
 	goPlugin "github.com/hashicorp/go-plugin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // handshakeConfigs are used to just do a basic handshake between
@@ -21,20 +27,65 @@ var handshakeConfig = goPlugin.HandshakeConfig{
 }
 
 func main() {
+	if len(os.Args) > 1 && cmd.IsCommand(os.Args[1]) {
+		err := cmd.Run(os.Args[1], os.Args[2:], os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Define and parse flags for your command line options:
 	kubeClientQPS := flag.Int("kubeClientQPS", 5, "The QPS to use for the Kubernetes client.")
 	kubeClientBurst := flag.Int("kubeClientBurst", 10, "The Burst to use for the Kubernetes client.")
+	garbageCollectorInterval := flag.Duration("garbageCollectorInterval", 0, "The interval of removing orphaned managed routes. The garbage collector is disabled when it is 0.")
+	garbageCollectorDryRun := flag.Bool("garbageCollectorDryRun", false, "Only log orphaned managed routes instead of removing them.")
+	metricsAddress := flag.String("metricsAddress", "", "The address to serve Prometheus metrics on, for example :8090. Metrics are disabled when it is empty.")
+	namespacePolicyFlag := flag.String("namespacePolicy", "", `The namespaces rollouts may control routes in besides their own namespace, by rollout namespace in YAML or JSON, for example {"team-a": ["gateways"]}.`)
+	namespacePolicyConfigMap := flag.String("namespacePolicyConfigMap", "", `The config map with the namespace policy in its "policy" key as namespace/name. It is read on every request.`)
+	impersonateServiceAccount := flag.String("impersonateServiceAccount", "", "The service account to impersonate in the namespace of each rollout. The identity of the controller is used when it is empty.")
 	flag.Parse()
 
+	var namespacePolicy plugin.NamespacePolicy
+	if *namespacePolicyFlag != "" {
+		var err error
+		namespacePolicy, err = plugin.ParseNamespacePolicy([]byte(*namespacePolicyFlag))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *namespacePolicyConfigMap != "" && !strings.Contains(*namespacePolicyConfigMap, "/") {
+		fmt.Fprintln(os.Stderr, "namespacePolicyConfigMap has to be set as namespace/name")
+		os.Exit(1)
+	}
+
 	// Create the plugin implementation, injecting command line options:
 	rpcPluginImp := &plugin.RpcPlugin{
 		CommandLineOpts: plugin.CommandLineOpts{
-			KubeClientQPS:   float32(*kubeClientQPS),
-			KubeClientBurst: *kubeClientBurst,
+			KubeClientQPS:             float32(*kubeClientQPS),
+			KubeClientBurst:           *kubeClientBurst,
+			GarbageCollectorInterval:  *garbageCollectorInterval,
+			GarbageCollectorDryRun:    *garbageCollectorDryRun,
+			NamespacePolicy:           namespacePolicy,
+			NamespacePolicyConfigMap:  *namespacePolicyConfigMap,
+			ImpersonateServiceAccount: *impersonateServiceAccount,
 		},
 		LogCtx: utils.SetupLog(),
 	}
 
+	if *metricsAddress != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.Handler())
+			err := http.ListenAndServe(*metricsAddress, mux)
+			if err != nil {
+				rpcPluginImp.LogCtx.Error(err.Error())
+			}
+		}()
+	}
+
 	pluginMap := map[string]goPlugin.Plugin{
 		"RpcTrafficRouterPlugin": &rolloutsPlugin.RpcTrafficRouterPlugin{Impl: rpcPluginImp},
 	}
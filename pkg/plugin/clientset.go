@@ -0,0 +1,104 @@
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+	pluginTypes "github.com/argoproj/argo-rollouts/utils/plugin/types"
+	"k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	gatewayAPIClientset "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned"
+)
+
+const (
+	serviceAccountUserNameFormat = "system:serviceaccount:%s:%s"
+	serviceAccountsGroup         = "system:serviceaccounts"
+	serviceAccountsGroupFormat   = "system:serviceaccounts:%s"
+	authenticatedGroup           = "system:authenticated"
+)
+
+// namespaceClientsets refers to the clientsets the plugin uses for the rollouts of one namespace
+type namespaceClientsets struct {
+	gatewayAPIClientset *gatewayAPIClientset.Clientset
+	clientset           *kubernetes.Clientset
+}
+
+// getImpersonationConfig returns the identity of the service account in the namespace
+// with the groups the API server assigns to service accounts
+func getImpersonationConfig(namespace string, serviceAccount string) rest.ImpersonationConfig {
+	return rest.ImpersonationConfig{
+		UserName: fmt.Sprintf(serviceAccountUserNameFormat, namespace, serviceAccount),
+		Groups: []string{
+			serviceAccountsGroup,
+			fmt.Sprintf(serviceAccountsGroupFormat, namespace),
+			authenticatedGroup,
+		},
+	}
+}
+
+// setNamespaceClientsets sets the clientsets of the rollout namespace in the plugin configuration.
+// Without impersonation the configuration keeps using the clientsets of the controller
+func (r *RpcPlugin) setNamespaceClientsets(rollout *v1alpha1.Rollout, gatewayAPIConfig *GatewayAPITrafficRouting) pluginTypes.RpcError {
+	if r.IsTest || r.CommandLineOpts.ImpersonateServiceAccount == "" {
+		return pluginTypes.RpcError{}
+	}
+	clientsets, err := r.getNamespaceClientsets(rollout.Namespace)
+	if err != nil {
+		return pluginTypes.RpcError{
+			ErrorString: err.Error(),
+		}
+	}
+	gatewayAPIConfig.clientsets = clientsets
+	return pluginTypes.RpcError{}
+}
+
+// getNamespaceClientsets returns the clientsets impersonating the service account in the namespace.
+// They are created once per namespace and shared by all rollouts of the namespace
+func (r *RpcPlugin) getNamespaceClientsets(namespace string) (*namespaceClientsets, error) {
+	if cachedClientsets, isOk := r.namespaceClientsetsMap.Load(namespace); isOk {
+		return cachedClientsets.(*namespaceClientsets), nil
+	}
+	kubeConfig := rest.CopyConfig(r.kubeConfig)
+	kubeConfig.Impersonate = getImpersonationConfig(namespace, r.CommandLineOpts.ImpersonateServiceAccount)
+	gatewayAPIClientset, err := gatewayAPIClientset.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, err
+	}
+	cachedClientsets, isLoaded := r.namespaceClientsetsMap.LoadOrStore(namespace, &namespaceClientsets{
+		gatewayAPIClientset: gatewayAPIClientset,
+		clientset:           clientset,
+	})
+	if !isLoaded {
+		r.LogCtx.Info(fmt.Sprintf("[Impersonation] created clientsets for service account %s/%s", namespace, r.CommandLineOpts.ImpersonateServiceAccount))
+	}
+	return cachedClientsets.(*namespaceClientsets), nil
+}
+
+// getGatewayAPIClientset returns the Gateway API clientset of the rollout the configuration belongs to
+func (r *RpcPlugin) getGatewayAPIClientset(gatewayAPIConfig *GatewayAPITrafficRouting) *gatewayAPIClientset.Clientset {
+	if gatewayAPIConfig.clientsets == nil {
+		return r.GatewayAPIClientset
+	}
+	return gatewayAPIConfig.clientsets.gatewayAPIClientset
+}
+
+// getClientset returns the Kubernetes clientset of the rollout the configuration belongs to
+func (r *RpcPlugin) getClientset(gatewayAPIConfig *GatewayAPITrafficRouting) *kubernetes.Clientset {
+	if gatewayAPIConfig.clientsets == nil {
+		return r.Clientset
+	}
+	return gatewayAPIConfig.clientsets.clientset
+}
+
+// getConfigMapClient returns the client of the config maps in the namespace of the configuration
+func (r *RpcPlugin) getConfigMapClient(gatewayAPIConfig *GatewayAPITrafficRouting) corev1.ConfigMapInterface {
+	if r.IsTest {
+		return r.TestClientset
+	}
+	return r.getClientset(gatewayAPIConfig).CoreV1().ConfigMaps(gatewayAPIConfig.Namespace)
+}
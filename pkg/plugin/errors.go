@@ -1,5 +1,10 @@
 package plugin
 
+import (
+	"fmt"
+	"strings"
+)
+
 const (
 	GatewayAPIUpdateError                    = "error updating Gateway API %q: %s"
 	GatewayAPIManifestError                  = "No routes configured. At least one of 'httpRoutes', 'grpcRoutes', 'tcpRoutes', 'httpRoute', 'grpcRoute' or 'tcpRoute' must be set"
@@ -10,4 +15,49 @@ const (
 	BackendRefWasNotFoundInTCPRouteError     = "backendRef was not found in tcpRoute"
 	BackendRefListWasNotFoundInTCPRouteError = "backendRef list was not found in tcpRoute"
 	ManagedRouteMapEntryDeleteError          = "can't delete key %q from managedRouteMap. The key %q is not in the managedRouteMap"
+	InvalidBackendRefWeightError             = "backendRef %q has invalid weight %d. Weight has to be between 0 and %d"
+	HTTPRouteTemplateNamespaceError          = "HTTPRoute %q can't be created from the template in namespace %q. Only the namespace of the rollout %q is supported"
+	HTTPRouteTemplateKeyWasNotFoundError     = "key %q was not found in config map %q with HTTPRoute template"
+	BlueGreenStrategyIsNotSupportedError     = "blueGreen strategy is not supported. Argo Rollouts uses traffic router plugins only with the canary strategy"
+	CanaryTrafficRoutingIsEmptyError         = "canary.trafficRouting field is empty. It has to be set to use the plugin"
+	RouteRuleWeightIsZeroError               = "sum of backendRef weights in the route rule is 0, so the rule would not receive any traffic"
+	RouteIsNotManagedError                   = "%s %s/%s already exists, but it wasn't created by the plugin. Only routes with the label %s=%s are changed or deleted"
+	RouteSourceConflictError                 = "%s %s/%s was created by the plugin for %q of rollout %q, so it can't be used for %q of rollout %q. Rename the managed route or the route, so the generated names don't collide"
+	RouteSourceDeleteConflictError           = "%s %s/%s was created by the plugin for %q, so it isn't deleted for %q"
+	RouteError                               = "%s %s/%s: %s"
+	ConfigMapError                           = "config map %s/%s: %s"
+	NamespacePolicyDeniedError               = "rollout %s/%s is not allowed to control routes in namespace %q by the namespace policy of the plugin"
+	InvalidNamespacePolicyError              = "invalid namespace policy: %w"
+	InvalidPluginConfigError                 = "invalid plugin configuration: %s"
+	GRPCMethodsAreNotRoutedError             = "none of the grpcMethods of managed route %q is routed by the rule of GRPCRoute %q"
+	GRPCMethodMatchIntersectionError         = "grpcMethods of managed route %q: %s"
+	GRPCMethodMatchRegularExpressionError    = "a regular expression method match can only be combined with the same regular expression method match of the routing rule"
+	HeaderMatchConflictError                 = "the routing rule already has a condition for header %q. Gateway API doesn't allow two conditions for the same header, so the header route can't use it"
+	CanaryHostnamesAreEmptyError             = "HTTPRoute %q has no hostnames without wildcards. They are required to create the canary hostnames"
+	MaxCanaryWeightExceededError             = "rollout %s/%s can't set canary weight %d, because weightGuardrails.maxCanaryWeight is %d"
+	MaxWeightIncreaseExceededError           = "rollout %s/%s can't increase canary weight from %d to %d, because weightGuardrails.maxWeightIncrease is %d"
+	MinIncreaseIntervalNotPassedError        = "rollout %s/%s can't increase canary weight from %d to %d for another %s, because weightGuardrails.minIncreaseInterval is %s"
+	GarbageCollectorInvalidRolloutWarning    = "rollout %s/%s has an invalid plugin configuration, so nothing is removed from config map %s/%s: %s"
+	DeprecatedUseHeaderRoutesWarning         = "top-level \"useHeaderRoutes\" is deprecated and has no effect. \"httpRoute\" and \"grpcRoute\" always use header routes, set \"useHeaderRoutes\" of the routes in \"httpRoutes\" and \"grpcRoutes\" instead"
+	DeprecatedRouteCombinationWarning        = "%q and %q are both set. %q is deprecated, add the route to %q instead"
 )
+
+// ConfigError refers to the mistakes in the fields of the plugin configuration
+type ConfigError struct {
+	FieldErrorList []ConfigFieldError
+}
+
+// ConfigFieldError refers to a mistake in a field of the plugin configuration
+type ConfigFieldError struct {
+	// Path refers to the JSON path of the field, e.g. httpRoutes[0].name. It is empty when the error has no field
+	Path    string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	messageList := []string{}
+	for _, fieldError := range e.FieldErrorList {
+		messageList = append(messageList, fieldError.Message)
+	}
+	return fmt.Sprintf(InvalidPluginConfigError, strings.Join(messageList, "; "))
+}
@@ -0,0 +1,366 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+	pluginTypes "github.com/argoproj/argo-rollouts/utils/plugin/types"
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+
+	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/internal/utils"
+)
+
+const (
+	HTTPRouteKind = "HTTPRoute"
+	GRPCRouteKind = "GRPCRoute"
+	TCPRouteKind  = "TCPRoute"
+)
+
+// OrphanedManagedRoutesRemovedTotal counts the managed route entries removed by the garbage collector
+var OrphanedManagedRoutesRemovedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "gatewayapi_plugin_orphaned_managed_routes_removed_total",
+	Help: "Number of orphaned managed routes removed from routes and plugin config maps",
+}, []string{"kind"})
+
+// OrphanedHTTPRoutesRemovedTotal counts the HTTPRoutes of removed rollouts deleted by the garbage collector
+var OrphanedHTTPRoutesRemovedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "gatewayapi_plugin_orphaned_httproutes_removed_total",
+	Help: "Number of HTTPRoutes created by the plugin for removed rollouts",
+})
+
+func init() {
+	prometheus.MustRegister(OrphanedManagedRoutesRemovedTotal, OrphanedHTTPRoutesRemovedTotal)
+}
+
+// runGarbageCollector removes orphaned managed routes every interval until the context is done
+func (r *RpcPlugin) runGarbageCollector(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := r.collectGarbage(ctx)
+			if err != nil {
+				r.LogCtx.Error(fmt.Sprintf("[GarbageCollector] %s", err.Error()))
+			}
+		}
+	}
+}
+
+// collectGarbage removes the managed routes, weight guardrail states and HTTPRoutes that no rollout refers to anymore. The config maps
+// and HTTPRoutes are read before the rollouts are listed, so an entry of a rollout created in between is never removed
+func (r *RpcPlugin) collectGarbage(ctx context.Context) error {
+	configMapClient := r.TestClientset
+	if !r.IsTest {
+		configMapClient = r.Clientset.CoreV1().ConfigMaps(metav1.NamespaceAll)
+	}
+	configMapList, err := configMapClient.List(ctx, metav1.ListOptions{
+		LabelSelector: ManagedByLabel + "=" + ManagedByLabelValue,
+	})
+	if err != nil {
+		return err
+	}
+	httpRouteClient := r.HTTPRouteClient
+	if !r.IsTest {
+		httpRouteClient = r.GatewayAPIClientset.GatewayV1().HTTPRoutes(metav1.NamespaceAll)
+	}
+	httpRouteList, err := httpRouteClient.List(ctx, metav1.ListOptions{
+		LabelSelector: ManagedByLabel + "=" + ManagedByLabelValue,
+	})
+	if err != nil {
+		return err
+	}
+	rolloutList, err := r.RolloutsClientset.ArgoprojV1alpha1().Rollouts(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	liveManagedRouteSet, invalidConfigMapSet := r.getLiveManagedRouteSet(rolloutList.Items)
+	liveRolloutSet := getLiveRolloutSet(rolloutList.Items)
+	for i := range configMapList.Items {
+		configMap := &configMapList.Items[i]
+		if invalidConfigMapSet[getConfigMapKey(configMap.Namespace, configMap.Name)] {
+			continue
+		}
+		// A config map with broken data or a route the plugin may not read doesn't stop the other config maps
+		err = r.collectConfigMapGarbage(ctx, configMap, liveManagedRouteSet, liveRolloutSet)
+		if err != nil {
+			r.LogCtx.Error(fmt.Sprintf("[GarbageCollector] config map %s/%s: %s", configMap.Namespace, configMap.Name, err.Error()))
+		}
+	}
+	for i := range httpRouteList.Items {
+		httpRoute := &httpRouteList.Items[i]
+		err = r.removeOrphanedHTTPRoute(ctx, httpRoute, liveRolloutSet)
+		if err != nil {
+			r.LogCtx.Error(fmt.Sprintf("[GarbageCollector] %s %s/%s: %s", HTTPRouteKind, httpRoute.Namespace, httpRoute.Name, err.Error()))
+		}
+	}
+	return nil
+}
+
+// removeOrphanedHTTPRoute removes the HTTPRoute created by the plugin for a rollout that doesn't exist anymore.
+// Routes in the namespace of the rollout are removed by their owner reference too, but not the ones in another namespace
+func (r *RpcPlugin) removeOrphanedHTTPRoute(ctx context.Context, httpRoute *gatewayv1.HTTPRoute, liveRolloutSet map[string]bool) error {
+	rolloutKey := httpRoute.Annotations[RolloutAnnotation]
+	if rolloutKey == "" || liveRolloutSet[rolloutKey] {
+		return nil
+	}
+	r.LogCtx.Info(fmt.Sprintf("[GarbageCollector] %s %s/%s belongs to the removed rollout %s", HTTPRouteKind, httpRoute.Namespace, httpRoute.Name, rolloutKey))
+	if r.CommandLineOpts.GarbageCollectorDryRun {
+		return nil
+	}
+	httpRouteClient := r.HTTPRouteClient
+	if !r.IsTest {
+		httpRouteClient = r.GatewayAPIClientset.GatewayV1().HTTPRoutes(httpRoute.Namespace)
+	}
+	_, rpcError := r.deleteManagedHTTPRoute(ctx, httpRouteClient, httpRoute.Name, "")
+	if rpcError.HasError() {
+		return rpcError
+	}
+	OrphanedHTTPRoutesRemovedTotal.Inc()
+	return nil
+}
+
+// collectConfigMapGarbage removes the orphaned entries of the config map. It holds the mutex of the config map,
+// so the rollouts using the config map don't change it at the same time
+func (r *RpcPlugin) collectConfigMapGarbage(ctx context.Context, configMap *v1.ConfigMap, liveManagedRouteSet map[string]bool, liveRolloutSet map[string]bool) error {
+	configMapRWMutex := r.getConfigMapRWMutex(configMap.Namespace, configMap.Name)
+	configMapRWMutex.Lock()
+	defer configMapRWMutex.Unlock()
+	for kind, configMapKey := range map[string]string{HTTPRouteKind: HTTPConfigMapKey, GRPCRouteKind: GRPCConfigMapKey} {
+		if configMap.Data[configMapKey] == "" {
+			continue
+		}
+		managedRouteMap := make(ManagedRouteMap)
+		err := utils.GetConfigMapData(configMap, configMapKey, &managedRouteMap)
+		if err != nil {
+			return err
+		}
+		for routeName, managedRouteNameList := range getOrphanedManagedRoutes(managedRouteMap, liveManagedRouteSet, configMap, kind) {
+			err = r.removeOrphanedManagedRoutes(ctx, configMap, kind, routeName, managedRouteNameList)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return r.removeOrphanedWeightGuardrailStates(ctx, configMap, liveRolloutSet)
+}
+
+// removeOrphanedManagedRoutes removes the rules of the managed routes from the route. When the route
+// doesn't exist anymore, only the config map entries are removed
+func (r *RpcPlugin) removeOrphanedManagedRoutes(ctx context.Context, configMap *v1.ConfigMap, kind string, routeName string, managedRouteNameList []v1alpha1.MangedRoutes) error {
+	r.LogCtx.Info(fmt.Sprintf("[GarbageCollector] %s %s/%s has orphaned managed routes %v in config map %q", kind, configMap.Namespace, routeName, managedRouteNameList, configMap.Name))
+	if r.CommandLineOpts.GarbageCollectorDryRun {
+		return nil
+	}
+	gatewayAPIConfig := &GatewayAPITrafficRouting{
+		Namespace: configMap.Namespace,
+		ConfigMap: configMap.Name,
+		HTTPRoute: routeName,
+		GRPCRoute: routeName,
+	}
+	isRouteFound, err := r.isRouteFound(ctx, kind, gatewayAPIConfig)
+	if err != nil {
+		return err
+	}
+	configMapKey := HTTPConfigMapKey
+	if kind == GRPCRouteKind {
+		configMapKey = GRPCConfigMapKey
+	}
+	var rpcError pluginTypes.RpcError
+	switch {
+	case !isRouteFound:
+		rpcError = r.removeManagedRouteMapEntries(ctx, configMap, configMapKey, routeName, managedRouteNameList)
+	case kind == HTTPRouteKind:
+		rpcError = r.removeHTTPManagedRoutes(managedRouteNameList, gatewayAPIConfig)
+	default:
+		rpcError = r.removeGRPCManagedRoutes(managedRouteNameList, gatewayAPIConfig)
+	}
+	if rpcError.HasError() {
+		return rpcError
+	}
+	OrphanedManagedRoutesRemovedTotal.WithLabelValues(kind).Add(float64(len(managedRouteNameList)))
+	return nil
+}
+
+func (r *RpcPlugin) isRouteFound(ctx context.Context, kind string, gatewayAPIConfig *GatewayAPITrafficRouting) (bool, error) {
+	var err error
+	if kind == HTTPRouteKind {
+		httpRouteClient := r.HTTPRouteClient
+		if !r.IsTest {
+			httpRouteClient = r.GatewayAPIClientset.GatewayV1().HTTPRoutes(gatewayAPIConfig.Namespace)
+		}
+		_, err = httpRouteClient.Get(ctx, gatewayAPIConfig.HTTPRoute, metav1.GetOptions{})
+	} else {
+		grpcRouteClient := r.GRPCRouteClient
+		if !r.IsTest {
+			grpcRouteClient = r.GatewayAPIClientset.GatewayV1().GRPCRoutes(gatewayAPIConfig.Namespace)
+		}
+		_, err = grpcRouteClient.Get(ctx, gatewayAPIConfig.GRPCRoute, metav1.GetOptions{})
+	}
+	if kubeErrors.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *RpcPlugin) removeManagedRouteMapEntries(ctx context.Context, configMap *v1.ConfigMap, configMapKey string, routeName string, managedRouteNameList []v1alpha1.MangedRoutes) pluginTypes.RpcError {
+	configMapClient := r.TestClientset
+	if !r.IsTest {
+		configMapClient = r.Clientset.CoreV1().ConfigMaps(configMap.Namespace)
+	}
+	// The config map is read again, because it can be changed by removing the routes of another kind
+	configMap, err := configMapClient.Get(ctx, configMap.Name, metav1.GetOptions{})
+	if err != nil {
+		return pluginTypes.RpcError{
+			ErrorString: err.Error(),
+		}
+	}
+	managedRouteMap := make(ManagedRouteMap)
+	err = utils.GetConfigMapData(configMap, configMapKey, &managedRouteMap)
+	if err != nil {
+		return pluginTypes.RpcError{
+			ErrorString: err.Error(),
+		}
+	}
+	for _, managedRoute := range managedRouteNameList {
+		delete(managedRouteMap[managedRoute.Name], routeName)
+		if len(managedRouteMap[managedRoute.Name]) == 0 {
+			delete(managedRouteMap, managedRoute.Name)
+		}
+	}
+	err = utils.UpdateConfigMapData(configMap, managedRouteMap, utils.UpdateConfigMapOptions{
+		Clientset:    configMapClient,
+		ConfigMapKey: configMapKey,
+		Ctx:          ctx,
+	})
+	if err != nil {
+		return pluginTypes.RpcError{
+			ErrorString: err.Error(),
+		}
+	}
+	return pluginTypes.RpcError{}
+}
+
+// removeOrphanedWeightGuardrailStates removes the weight guardrail states of the rollouts that don't exist anymore.
+// Only the states of the listed config map are removed, because a new rollout can record its state meanwhile
+func (r *RpcPlugin) removeOrphanedWeightGuardrailStates(ctx context.Context, configMap *v1.ConfigMap, liveRolloutSet map[string]bool) error {
+	if configMap.Data[WeightGuardrailsConfigMapKey] == "" {
+		return nil
+	}
+	stateMap := make(WeightGuardrailStateMap)
+	err := utils.GetConfigMapData(configMap, WeightGuardrailsConfigMapKey, &stateMap)
+	if err != nil {
+		return err
+	}
+	var orphanedRolloutKeyList []string
+	for rolloutKey := range stateMap {
+		if !liveRolloutSet[rolloutKey] {
+			orphanedRolloutKeyList = append(orphanedRolloutKeyList, rolloutKey)
+		}
+	}
+	if len(orphanedRolloutKeyList) == 0 {
+		return nil
+	}
+	r.LogCtx.Info(fmt.Sprintf("[GarbageCollector] config map %s/%s has orphaned weight guardrail states of rollouts %v", configMap.Namespace, configMap.Name, orphanedRolloutKeyList))
+	if r.CommandLineOpts.GarbageCollectorDryRun {
+		return nil
+	}
+	gatewayAPIConfig := &GatewayAPITrafficRouting{
+		Namespace: configMap.Namespace,
+		ConfigMap: configMap.Name,
+	}
+	// The config map is read again, because it can be changed by removing the managed routes
+	configMap, stateMap, rpcError := r.getWeightGuardrailStateMap(gatewayAPIConfig)
+	if rpcError.HasError() {
+		return rpcError
+	}
+	for _, rolloutKey := range orphanedRolloutKeyList {
+		delete(stateMap, rolloutKey)
+	}
+	rpcError = r.saveWeightGuardrailStateMap(configMap, stateMap, gatewayAPIConfig)
+	if rpcError.HasError() {
+		return rpcError
+	}
+	return nil
+}
+
+// getLiveManagedRouteSet returns the keys of the managed routes the rollouts refer to and the keys of the config maps
+// of rollouts with an invalid plugin configuration. The managed routes of such a rollout are unknown,
+// so nothing is removed from its config map
+func (r *RpcPlugin) getLiveManagedRouteSet(rolloutList []v1alpha1.Rollout) (map[string]bool, map[string]bool) {
+	liveManagedRouteSet := make(map[string]bool)
+	invalidConfigMapSet := make(map[string]bool)
+	for i := range rolloutList {
+		rollout := &rolloutList[i]
+		if !isPluginUsed(rollout) {
+			continue
+		}
+		gatewayAPIConfig, err := getGatewayAPITrafficRoutingConfig(rollout)
+		if err != nil {
+			// The namespace is defaulted only for a valid configuration
+			namespace := gatewayAPIConfig.Namespace
+			if namespace == "" {
+				namespace = rollout.Namespace
+			}
+			invalidConfigMapSet[getConfigMapKey(namespace, gatewayAPIConfig.ConfigMap)] = true
+			r.LogCtx.Warn(fmt.Sprintf("[GarbageCollector] "+GarbageCollectorInvalidRolloutWarning, rollout.Namespace, rollout.Name, namespace, gatewayAPIConfig.ConfigMap, err.Error()))
+			continue
+		}
+		for _, managedRoute := range rollout.Spec.Strategy.Canary.TrafficRouting.ManagedRoutes {
+			for _, route := range gatewayAPIConfig.HTTPRoutes {
+				liveManagedRouteSet[getManagedRouteKey(gatewayAPIConfig.Namespace, gatewayAPIConfig.ConfigMap, HTTPRouteKind, route.Name, managedRoute.Name)] = true
+			}
+			for _, route := range gatewayAPIConfig.GRPCRoutes {
+				liveManagedRouteSet[getManagedRouteKey(gatewayAPIConfig.Namespace, gatewayAPIConfig.ConfigMap, GRPCRouteKind, route.Name, managedRoute.Name)] = true
+			}
+		}
+	}
+	return liveManagedRouteSet, invalidConfigMapSet
+}
+
+// getLiveRolloutSet returns the keys of all rollouts, because the weight guardrail states of a rollout
+// are kept until it is deleted
+func getLiveRolloutSet(rolloutList []v1alpha1.Rollout) map[string]bool {
+	liveRolloutSet := make(map[string]bool)
+	for i := range rolloutList {
+		liveRolloutSet[getRolloutKey(&rolloutList[i])] = true
+	}
+	return liveRolloutSet
+}
+
+func isPluginUsed(rollout *v1alpha1.Rollout) bool {
+	canary := rollout.Spec.Strategy.Canary
+	return canary != nil && canary.TrafficRouting != nil && canary.TrafficRouting.Plugins[PluginName] != nil
+}
+
+// getOrphanedManagedRoutes returns the managed routes of the config map that no rollout refers to by route name
+func getOrphanedManagedRoutes(managedRouteMap ManagedRouteMap, liveManagedRouteSet map[string]bool, configMap *v1.ConfigMap, kind string) map[string][]v1alpha1.MangedRoutes {
+	orphanedManagedRouteMap := make(map[string][]v1alpha1.MangedRoutes)
+	for managedRouteName, routeMap := range managedRouteMap {
+		for routeName := range routeMap {
+			if liveManagedRouteSet[getManagedRouteKey(configMap.Namespace, configMap.Name, kind, routeName, managedRouteName)] {
+				continue
+			}
+			orphanedManagedRouteMap[routeName] = append(orphanedManagedRouteMap[routeName], v1alpha1.MangedRoutes{
+				Name: managedRouteName,
+			})
+		}
+	}
+	return orphanedManagedRouteMap
+}
+
+func getManagedRouteKey(namespace string, configMapName string, kind string, routeName string, managedRouteName string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/%s", namespace, configMapName, kind, routeName, managedRouteName)
+}
+
+func getConfigMapKey(namespace string, configMapName string) string {
+	return fmt.Sprintf("%s/%s", namespace, configMapName)
+}
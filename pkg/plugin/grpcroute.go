@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"reflect"
 	"slices"
 
 	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/internal/utils"
@@ -21,7 +22,7 @@ func (r *RpcPlugin) setGRPCRouteWeight(rollout *v1alpha1.Rollout, desiredWeight
 	ctx := context.TODO()
 	grpcRouteClient := r.GRPCRouteClient
 	if !r.IsTest {
-		gatewayClientv1 := r.GatewayAPIClientset.GatewayV1()
+		gatewayClientv1 := r.getGatewayAPIClientset(gatewayAPIConfig).GatewayV1()
 		grpcRouteClient = gatewayClientv1.GRPCRoutes(gatewayAPIConfig.Namespace)
 	}
 	grpcRoute, err := grpcRouteClient.Get(ctx, gatewayAPIConfig.GRPCRoute, metav1.GetOptions{})
@@ -30,28 +31,26 @@ func (r *RpcPlugin) setGRPCRouteWeight(rollout *v1alpha1.Rollout, desiredWeight
 			ErrorString: err.Error(),
 		}
 	}
-	canaryServiceName := rollout.Spec.Strategy.Canary.CanaryService
-	stableServiceName := rollout.Spec.Strategy.Canary.StableService
+	canaryServiceName, stableServiceName := getServiceNames(rollout)
+	canaryBackendRefReference := getBackendRefReference(canaryServiceName, gatewayAPIConfig.CanaryBackendRef)
+	stableBackendRefReference := getBackendRefReference(stableServiceName, gatewayAPIConfig.StableBackendRef)
 	routeRuleList := GRPCRouteRuleList(grpcRoute.Spec.Rules)
-	canaryBackendRefs, err := getBackendRefs(canaryServiceName, routeRuleList)
-	if err != nil {
-		return pluginTypes.RpcError{
-			ErrorString: err.Error(),
-		}
-	}
-	for _, ref := range canaryBackendRefs {
-		ref.Weight = &desiredWeight
-	}
-	stableBackendRefs, err := getBackendRefs(stableServiceName, routeRuleList)
+	err = setBackendRefWeights(routeRuleList, BackendRefWeightOptions{
+		CanaryBackendRef:       canaryBackendRefReference,
+		StableBackendRef:       stableBackendRefReference,
+		RouteNamespace:         grpcRoute.Namespace,
+		DesiredWeight:          desiredWeight,
+		MaxTrafficWeight:       gatewayAPIConfig.MaxTrafficWeight,
+		WeightScale:            gatewayAPIConfig.WeightScale,
+		InsertCanaryBackendRef: gatewayAPIConfig.InsertCanaryBackendRef,
+	})
 	if err != nil {
 		return pluginTypes.RpcError{
 			ErrorString: err.Error(),
 		}
 	}
-	restWeight := 100 - desiredWeight
-	for _, ref := range stableBackendRefs {
-		ref.Weight = &restWeight
-	}
+	setGRPCCanaryBackendRefFilters(routeRuleList, &grpcRoute.ObjectMeta, canaryBackendRefReference, stableBackendRefReference, gatewayAPIConfig.CanaryFilters.GRPC, desiredWeight > 0)
+	setGRPCRouteSessionPersistence(routeRuleList, &grpcRoute.ObjectMeta, stableBackendRefReference, gatewayAPIConfig.SessionPersistence, desiredWeight > 0)
 	updatedGRPCRoute, err := grpcRouteClient.Update(ctx, grpcRoute, metav1.UpdateOptions{})
 	if r.IsTest {
 		r.UpdatedGRPCRouteMock = updatedGRPCRoute
@@ -79,9 +78,9 @@ func (r *RpcPlugin) setGRPCHeaderRoute(rollout *v1alpha1.Rollout, headerRouting
 	grpcRouteName := gatewayAPIConfig.GRPCRoute
 	clientset := r.TestClientset
 	if !r.IsTest {
-		gatewayClientV1 := r.GatewayAPIClientset.GatewayV1()
+		gatewayClientV1 := r.getGatewayAPIClientset(gatewayAPIConfig).GatewayV1()
 		grpcRouteClient = gatewayClientV1.GRPCRoutes(gatewayAPIConfig.Namespace)
-		clientset = r.Clientset.CoreV1().ConfigMaps(gatewayAPIConfig.Namespace)
+		clientset = r.getClientset(gatewayAPIConfig).CoreV1().ConfigMaps(gatewayAPIConfig.Namespace)
 	}
 	configMap, err := utils.GetOrCreateConfigMap(gatewayAPIConfig.ConfigMap, utils.CreateConfigMapOptions{
 		Clientset: clientset,
@@ -89,7 +88,7 @@ func (r *RpcPlugin) setGRPCHeaderRoute(rollout *v1alpha1.Rollout, headerRouting
 	})
 	if err != nil {
 		return pluginTypes.RpcError{
-			ErrorString: err.Error(),
+			ErrorString: fmt.Sprintf(ConfigMapError, gatewayAPIConfig.Namespace, gatewayAPIConfig.ConfigMap, err.Error()),
 		}
 	}
 	err = utils.GetConfigMapData(configMap, GRPCConfigMapKey, &managedRouteMap)
@@ -104,61 +103,11 @@ func (r *RpcPlugin) setGRPCHeaderRoute(rollout *v1alpha1.Rollout, headerRouting
 			ErrorString: err.Error(),
 		}
 	}
-	canaryServiceName := gatewayv1.ObjectName(rollout.Spec.Strategy.Canary.CanaryService)
-	stableServiceName := rollout.Spec.Strategy.Canary.StableService
-	canaryServiceKind := gatewayv1.Kind("Service")
-	canaryServiceGroup := gatewayv1.Group("")
-	grpcHeaderRouteRuleList, rpcError := getGRPCHeaderRouteRuleList(headerRouting)
+	grpcHeaderRouteRule, rpcError := getGRPCHeaderRouteRule(rollout, headerRouting, grpcRoute, gatewayAPIConfig)
 	if rpcError.HasError() {
 		return rpcError
 	}
-	grpcRouteRuleList := GRPCRouteRuleList(grpcRoute.Spec.Rules)
-	backendRefNameList := []string{string(canaryServiceName), stableServiceName}
-	grpcRouteRule, err := getRouteRule(grpcRouteRuleList, backendRefNameList...)
-	if err != nil {
-		return pluginTypes.RpcError{
-			ErrorString: err.Error(),
-		}
-	}
-	var canaryBackendRef *GRPCBackendRef
-	for i := 0; i < len(grpcRouteRule.BackendRefs); i++ {
-		backendRef := grpcRouteRule.BackendRefs[i]
-		if canaryServiceName == backendRef.Name {
-			canaryBackendRef = (*GRPCBackendRef)(&backendRef)
-			break
-		}
-	}
-	grpcHeaderRouteRule := gatewayv1.GRPCRouteRule{
-		Matches: []gatewayv1.GRPCRouteMatch{},
-		BackendRefs: []gatewayv1.GRPCBackendRef{
-			{
-				BackendRef: gatewayv1.BackendRef{
-					BackendObjectReference: gatewayv1.BackendObjectReference{
-						Group: &canaryServiceGroup,
-						Kind:  &canaryServiceKind,
-						Name:  canaryServiceName,
-						Port:  canaryBackendRef.Port,
-					},
-				},
-			},
-		},
-	}
-	matchLength := len(grpcRouteRule.Matches)
-	if matchLength == 0 {
-		grpcHeaderRouteRule.Matches = []gatewayv1.GRPCRouteMatch{
-			{
-				Headers: grpcHeaderRouteRuleList,
-			},
-		}
-	} else {
-		for i := 0; i < matchLength; i++ {
-			grpcHeaderRouteRule.Matches = append(grpcHeaderRouteRule.Matches, gatewayv1.GRPCRouteMatch{
-				Method:  grpcRouteRule.Matches[i].Method,
-				Headers: grpcHeaderRouteRuleList,
-			})
-		}
-	}
-	grpcRouteRuleList = append(grpcRouteRuleList, grpcHeaderRouteRule)
+	grpcRouteRuleList := append(GRPCRouteRuleList(grpcRoute.Spec.Rules), *grpcHeaderRouteRule)
 	oldGRPCRuleList := grpcRoute.Spec.Rules
 	grpcRoute.Spec.Rules = grpcRouteRuleList
 	oldConfigMapData := make(ManagedRouteMap)
@@ -230,6 +179,213 @@ func (r *RpcPlugin) setGRPCHeaderRoute(rollout *v1alpha1.Rollout, headerRouting
 	return pluginTypes.RpcError{}
 }
 
+func getGRPCHeaderRouteRule(rollout *v1alpha1.Rollout, headerRouting *v1alpha1.SetHeaderRoute, grpcRoute *gatewayv1.GRPCRoute, gatewayAPIConfig *GatewayAPITrafficRouting) (*gatewayv1.GRPCRouteRule, pluginTypes.RpcError) {
+	canaryServiceName, stableServiceName := getServiceNames(rollout)
+	canaryBackendRefReference := getBackendRefReference(canaryServiceName, gatewayAPIConfig.CanaryBackendRef)
+	stableBackendRefReference := getBackendRefReference(stableServiceName, gatewayAPIConfig.StableBackendRef)
+	grpcHeaderRouteRuleList, rpcError := getGRPCHeaderRouteRuleList(headerRouting)
+	if rpcError.HasError() {
+		return nil, rpcError
+	}
+	grpcRouteRuleList := GRPCRouteRuleList(grpcRoute.Spec.Rules)
+	backendRefReferenceList := []BackendRefReference{canaryBackendRefReference, stableBackendRefReference}
+	if gatewayAPIConfig.InsertCanaryBackendRef {
+		backendRefReferenceList = []BackendRefReference{stableBackendRefReference}
+	}
+	grpcRouteRule, err := getRouteRule(grpcRouteRuleList, grpcRoute.Namespace, backendRefReferenceList...)
+	if err != nil {
+		return nil, pluginTypes.RpcError{
+			ErrorString: err.Error(),
+		}
+	}
+	var canaryObjectReference *gatewayv1.BackendObjectReference
+	for i := 0; i < len(grpcRouteRule.BackendRefs); i++ {
+		objectReference := grpcRouteRule.BackendRefs[i].BackendObjectReference
+		if canaryBackendRefReference.IsMatched(objectReference, grpcRoute.Namespace) {
+			canaryObjectReference = &objectReference
+			break
+		}
+	}
+	if canaryObjectReference == nil && gatewayAPIConfig.InsertCanaryBackendRef {
+		for i := 0; i < len(grpcRouteRule.BackendRefs); i++ {
+			objectReference := grpcRouteRule.BackendRefs[i].BackendObjectReference
+			if stableBackendRefReference.IsMatched(objectReference, grpcRoute.Namespace) {
+				canaryObjectReference = objectReference.DeepCopy()
+				canaryBackendRefReference.Apply(canaryObjectReference)
+				break
+			}
+		}
+	}
+	if canaryObjectReference == nil {
+		return nil, pluginTypes.RpcError{
+			ErrorString: BackendRefWasNotFoundInGRPCRouteError,
+		}
+	}
+	grpcHeaderRouteRule := gatewayv1.GRPCRouteRule{
+		Matches: []gatewayv1.GRPCRouteMatch{},
+		Filters: slices.Clone(gatewayAPIConfig.CanaryFilters.GRPC),
+		BackendRefs: []gatewayv1.GRPCBackendRef{
+			{
+				BackendRef: gatewayv1.BackendRef{
+					BackendObjectReference: *canaryObjectReference,
+				},
+			},
+		},
+	}
+	managedRoute := gatewayAPIConfig.ManagedRoutes[headerRouting.Name]
+	matchLength := len(grpcRouteRule.Matches)
+	switch {
+	case len(managedRoute.GRPCMethods) > 0:
+		// A rule without matches routes every method
+		originalMatchList := grpcRouteRule.Matches
+		if matchLength == 0 {
+			originalMatchList = []gatewayv1.GRPCRouteMatch{{}}
+		}
+		for i := 0; i < len(originalMatchList); i++ {
+			for j := 0; j < len(managedRoute.GRPCMethods); j++ {
+				grpcMethodMatch, isIntersected, err := intersectGRPCMethodMatch(originalMatchList[i].Method, managedRoute.GRPCMethods[j])
+				if err != nil {
+					return nil, pluginTypes.RpcError{
+						ErrorString: fmt.Sprintf(GRPCMethodMatchIntersectionError, headerRouting.Name, err.Error()),
+					}
+				}
+				if !isIntersected {
+					continue
+				}
+				grpcHeaderRouteRule.Matches = append(grpcHeaderRouteRule.Matches, gatewayv1.GRPCRouteMatch{
+					Method:  grpcMethodMatch,
+					Headers: grpcHeaderRouteRuleList,
+				})
+			}
+		}
+		// A header rule without matches would send every call with the headers to the canary
+		if len(grpcHeaderRouteRule.Matches) == 0 {
+			return nil, pluginTypes.RpcError{
+				ErrorString: fmt.Sprintf(GRPCMethodsAreNotRoutedError, headerRouting.Name, grpcRoute.Name),
+			}
+		}
+	case matchLength == 0:
+		grpcHeaderRouteRule.Matches = []gatewayv1.GRPCRouteMatch{
+			{
+				Headers: grpcHeaderRouteRuleList,
+			},
+		}
+	default:
+		for i := 0; i < matchLength; i++ {
+			grpcHeaderRouteRule.Matches = append(grpcHeaderRouteRule.Matches, gatewayv1.GRPCRouteMatch{
+				Method:  grpcRouteRule.Matches[i].Method,
+				Headers: grpcHeaderRouteRuleList,
+			})
+		}
+	}
+	return &grpcHeaderRouteRule, pluginTypes.RpcError{}
+}
+
+// intersectGRPCMethodMatch returns the method match of the managed route restricted to the method match of
+// the routing rule, so the header rule never routes a method the routing rule doesn't. It returns false
+// when no method matches both. Regular expressions can't be intersected, so they have to be the same
+func intersectGRPCMethodMatch(originalGRPCMethodMatch *gatewayv1.GRPCMethodMatch, grpcMethodMatch gatewayv1.GRPCMethodMatch) (*gatewayv1.GRPCMethodMatch, bool, error) {
+	if originalGRPCMethodMatch == nil {
+		return grpcMethodMatch.DeepCopy(), true, nil
+	}
+	isOriginalRegularExpression := isGRPCMethodMatchRegularExpression(*originalGRPCMethodMatch)
+	isRegularExpression := isGRPCMethodMatchRegularExpression(grpcMethodMatch)
+	if isOriginalRegularExpression || isRegularExpression {
+		if reflect.DeepEqual(*originalGRPCMethodMatch, grpcMethodMatch) {
+			return grpcMethodMatch.DeepCopy(), true, nil
+		}
+		return nil, false, errors.New(GRPCMethodMatchRegularExpressionError)
+	}
+	service, isServiceIntersected := intersectGRPCMethodMatchField(originalGRPCMethodMatch.Service, grpcMethodMatch.Service)
+	method, isMethodIntersected := intersectGRPCMethodMatchField(originalGRPCMethodMatch.Method, grpcMethodMatch.Method)
+	if !isServiceIntersected || !isMethodIntersected {
+		return nil, false, nil
+	}
+	return &gatewayv1.GRPCMethodMatch{
+		Type:    grpcMethodMatch.Type,
+		Service: service,
+		Method:  method,
+	}, true, nil
+}
+
+// intersectGRPCMethodMatchField returns the exact service or method matching both fields. A missing field matches everything
+func intersectGRPCMethodMatchField(originalValue *string, value *string) (*string, bool) {
+	switch {
+	case originalValue == nil:
+		return value, true
+	case value == nil, *originalValue == *value:
+		return originalValue, true
+	default:
+		return nil, false
+	}
+}
+
+// isGRPCMethodMatchRegularExpression checks the type of the method match, which is Exact by default
+func isGRPCMethodMatchRegularExpression(grpcMethodMatch gatewayv1.GRPCMethodMatch) bool {
+	return grpcMethodMatch.Type != nil && *grpcMethodMatch.Type == gatewayv1.GRPCMethodMatchRegularExpression
+}
+
+// GetGRPCHeaderRouteRule returns the rule that sends requests matching the header routing to the canary
+// in the same way as the plugin adds it to the GRPCRoute during the rollout
+func GetGRPCHeaderRouteRule(rollout *v1alpha1.Rollout, headerRouting *v1alpha1.SetHeaderRoute, grpcRoute *gatewayv1.GRPCRoute, gatewayAPIConfig *GatewayAPITrafficRouting) (*gatewayv1.GRPCRouteRule, error) {
+	grpcHeaderRouteRule, rpcError := getGRPCHeaderRouteRule(rollout, headerRouting, grpcRoute, gatewayAPIConfig)
+	if rpcError.HasError() {
+		return nil, rpcError
+	}
+	return grpcHeaderRouteRule, nil
+}
+
+// setGRPCCanaryBackendRefFilters adds the canary filters to the canary backendRefs of the weighted rules while
+// the canary gets traffic and removes them when it doesn't. Header rules of the plugin have no stable backendRef
+// and get the canary filters on the rule itself, so they are skipped. The added filters are recorded in an annotation
+func setGRPCCanaryBackendRefFilters(routeRuleList GRPCRouteRuleList, objectMeta *metav1.ObjectMeta, canaryBackendRefReference BackendRefReference, stableBackendRefReference BackendRefReference, canaryFilterList []gatewayv1.GRPCRouteFilter, isEnabled bool) {
+	filterMap, isRecorded := getCanaryFilterMap(*objectMeta)
+	if len(canaryFilterList) == 0 && !isRecorded {
+		return
+	}
+	// Filters of canary backendRefs that aren't there anymore are dropped from the record
+	syncedFilterMap := make(map[string][]int)
+	for i := 0; i < len(routeRuleList); i++ {
+		backendRefList := routeRuleList[i].BackendRefs
+		isWeightedRule := slices.ContainsFunc(backendRefList, func(backendRef gatewayv1.GRPCBackendRef) bool {
+			return stableBackendRefReference.IsMatched(backendRef.BackendObjectReference, objectMeta.Namespace)
+		})
+		if !isWeightedRule {
+			continue
+		}
+		for j := 0; j < len(backendRefList); j++ {
+			if canaryBackendRefReference.IsMatched(backendRefList[j].BackendObjectReference, objectMeta.Namespace) {
+				key := getCanaryFilterKey(i, j)
+				backendRefList[j].Filters, syncedFilterMap[key] = syncFilters(backendRefList[j].Filters, canaryFilterList, filterMap[key], isRecorded, isEnabled)
+			}
+		}
+	}
+	setCanaryFilterMap(objectMeta, syncedFilterMap, len(canaryFilterList) > 0)
+}
+
+// setGRPCRouteSessionPersistence sets the session persistence of the rules with the stable backendRef
+func setGRPCRouteSessionPersistence(routeRuleList GRPCRouteRuleList, objectMeta *metav1.ObjectMeta, stableBackendRefReference BackendRefReference, sessionPersistence *gatewayv1.SessionPersistence, isEnabled bool) {
+	ruleSet := getSessionPersistenceRuleSet(*objectMeta)
+	for i := 0; i < len(routeRuleList); i++ {
+		isWeightedRule := slices.ContainsFunc(routeRuleList[i].BackendRefs, func(backendRef gatewayv1.GRPCBackendRef) bool {
+			return stableBackendRefReference.IsMatched(backendRef.BackendObjectReference, objectMeta.Namespace)
+		})
+		if isWeightedRule {
+			routeRuleList[i].SessionPersistence, ruleSet[i] = syncSessionPersistence(routeRuleList[i].SessionPersistence, sessionPersistence, ruleSet[i], isEnabled)
+		}
+		if !ruleSet[i] {
+			delete(ruleSet, i)
+		}
+	}
+	// Indexes of rules that don't exist anymore are dropped
+	for index := range ruleSet {
+		if index >= len(routeRuleList) {
+			delete(ruleSet, index)
+		}
+	}
+	setSessionPersistenceRuleSet(objectMeta, ruleSet)
+}
+
 func getGRPCHeaderRouteRuleList(headerRouting *v1alpha1.SetHeaderRoute) ([]gatewayv1.GRPCHeaderMatch, pluginTypes.RpcError) {
 	grpcHeaderRouteRuleList := []gatewayv1.GRPCHeaderMatch{}
 	for _, headerRule := range headerRouting.Match {
@@ -266,9 +422,9 @@ func (r *RpcPlugin) removeGRPCManagedRoutes(managedRouteNameList []v1alpha1.Mang
 	grpcRouteName := gatewayAPIConfig.GRPCRoute
 	managedRouteMap := make(ManagedRouteMap)
 	if !r.IsTest {
-		gatewayClientv1 := r.GatewayAPIClientset.GatewayV1()
+		gatewayClientv1 := r.getGatewayAPIClientset(gatewayAPIConfig).GatewayV1()
 		grpcRouteClient = gatewayClientv1.GRPCRoutes(gatewayAPIConfig.Namespace)
-		clientset = r.Clientset.CoreV1().ConfigMaps(gatewayAPIConfig.Namespace)
+		clientset = r.getClientset(gatewayAPIConfig).CoreV1().ConfigMaps(gatewayAPIConfig.Namespace)
 	}
 	configMap, err := utils.GetOrCreateConfigMap(gatewayAPIConfig.ConfigMap, utils.CreateConfigMapOptions{
 		Clientset: clientset,
@@ -276,7 +432,7 @@ func (r *RpcPlugin) removeGRPCManagedRoutes(managedRouteNameList []v1alpha1.Mang
 	})
 	if err != nil {
 		return pluginTypes.RpcError{
-			ErrorString: err.Error(),
+			ErrorString: fmt.Sprintf(ConfigMapError, gatewayAPIConfig.Namespace, gatewayAPIConfig.ConfigMap, err.Error()),
 		}
 	}
 	err = utils.GetConfigMapData(configMap, GRPCConfigMapKey, &managedRouteMap)
@@ -416,6 +572,22 @@ func (r *GRPCRouteRule) Iterator() (GatewayAPIRouteRuleIterator[*GRPCBackendRef]
 	return next, len(backendRefList) > index
 }
 
+// AddBackendRef appends a copy of the backendRef with zero weight that refers to another backend.
+// Port, group, kind and filters are taken from the copied backendRef unless the reference sets them
+func (r *GRPCRouteRule) AddBackendRef(backendRef *GRPCBackendRef, backendRefReference BackendRefReference) {
+	var weight int32
+	newBackendRef := (*gatewayv1.GRPCBackendRef)(backendRef).DeepCopy()
+	backendRefReference.Apply(&newBackendRef.BackendObjectReference)
+	newBackendRef.Weight = &weight
+	r.BackendRefs = append(r.BackendRefs, *newBackendRef)
+}
+
+func (r *GRPCRouteRule) RemoveBackendRefs(backendRefReference BackendRefReference, routeNamespace string) {
+	r.BackendRefs = slices.DeleteFunc(r.BackendRefs, func(backendRef gatewayv1.GRPCBackendRef) bool {
+		return backendRefReference.IsMatched(backendRef.BackendObjectReference, routeNamespace)
+	})
+}
+
 func (r GRPCRouteRuleList) Iterator() (GatewayAPIRouteRuleListIterator[*GRPCBackendRef, *GRPCRouteRule], bool) {
 	routeRuleList := r
 	index := 0
@@ -438,6 +610,25 @@ func (r *GRPCBackendRef) GetName() string {
 	return string(r.Name)
 }
 
+func (r *GRPCBackendRef) GetObjectReference() gatewayv1.BackendObjectReference {
+	return r.BackendObjectReference
+}
+
+func (r *GRPCBackendRef) GetWeight() int32 {
+	if r.Weight == nil {
+		return 1
+	}
+	return *r.Weight
+}
+
+func (r *GRPCBackendRef) SetWeight(weight int32) {
+	r.Weight = &weight
+}
+
 func (r GRPCRoute) GetName() string {
 	return r.Name
 }
+
+func (r GRPCRoute) GetKind() string {
+	return GRPCRouteKind
+}
@@ -0,0 +1,173 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/internal/utils"
+	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+	pluginTypes "github.com/argoproj/argo-rollouts/utils/plugin/types"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// WeightGuardrailsConfigMapKey refers to the key of the guardrail states in the plugin config map
+	WeightGuardrailsConfigMapKey = "weightGuardrails"
+)
+
+// checkWeightGuardrails returns an error if the desired weight violates the guardrails of the configuration.
+// Decreases are always allowed, so a rollout can be aborted, and the final promotion isn't limited.
+// The caller holds the mutex of the config map
+func (r *RpcPlugin) checkWeightGuardrails(rollout *v1alpha1.Rollout, desiredWeight int32, gatewayAPIConfig *GatewayAPITrafficRouting) pluginTypes.RpcError {
+	guardrails := gatewayAPIConfig.WeightGuardrails
+	if guardrails == nil || isFinalPromotion(rollout, desiredWeight, gatewayAPIConfig) {
+		return pluginTypes.RpcError{}
+	}
+	_, stateMap, rpcError := r.getWeightGuardrailStateMap(gatewayAPIConfig)
+	if rpcError.HasError() {
+		return rpcError
+	}
+	state, isFound := stateMap[getRolloutKey(rollout)]
+	previousWeight := getPreviousCanaryWeight(rollout, state, isFound)
+	if desiredWeight <= previousWeight {
+		return pluginTypes.RpcError{}
+	}
+	var errorString string
+	switch {
+	case guardrails.MaxCanaryWeight != 0 && desiredWeight > guardrails.MaxCanaryWeight:
+		errorString = fmt.Sprintf(MaxCanaryWeightExceededError, rollout.Namespace, rollout.Name, desiredWeight, guardrails.MaxCanaryWeight)
+	case guardrails.MaxWeightIncrease != 0 && desiredWeight-previousWeight > guardrails.MaxWeightIncrease:
+		errorString = fmt.Sprintf(MaxWeightIncreaseExceededError, rollout.Namespace, rollout.Name, previousWeight, desiredWeight, guardrails.MaxWeightIncrease)
+	case guardrails.MinIncreaseInterval != "" && !state.IncreaseTime.IsZero():
+		// The interval was validated with the configuration
+		minIncreaseInterval, _ := time.ParseDuration(guardrails.MinIncreaseInterval)
+		remainingTime := minIncreaseInterval - time.Since(state.IncreaseTime.Time)
+		if remainingTime > 0 {
+			errorString = fmt.Sprintf(MinIncreaseIntervalNotPassedError, rollout.Namespace, rollout.Name, previousWeight, desiredWeight, remainingTime.Round(time.Second), guardrails.MinIncreaseInterval)
+		}
+	}
+	if errorString != "" {
+		r.LogCtx.Warn(fmt.Sprintf("[WeightGuardrails] %s", errorString))
+	}
+	return pluginTypes.RpcError{
+		ErrorString: errorString,
+	}
+}
+
+// updateWeightGuardrailState records the weight the plugin sets for the rollout and the time of the increase.
+// The state is removed when the canary weight returns to 0, so the next rollout starts without limits of the interval.
+// It returns the previous state, which is nil without one. The caller holds the mutex of the config map
+func (r *RpcPlugin) updateWeightGuardrailState(rollout *v1alpha1.Rollout, desiredWeight int32, gatewayAPIConfig *GatewayAPITrafficRouting) (*WeightGuardrailState, pluginTypes.RpcError) {
+	if gatewayAPIConfig.WeightGuardrails == nil {
+		return nil, pluginTypes.RpcError{}
+	}
+	configMap, stateMap, rpcError := r.getWeightGuardrailStateMap(gatewayAPIConfig)
+	if rpcError.HasError() {
+		return nil, rpcError
+	}
+	rolloutKey := getRolloutKey(rollout)
+	state, isFound := stateMap[rolloutKey]
+	var previousState *WeightGuardrailState
+	if isFound {
+		previousState = &state
+	}
+	switch {
+	case desiredWeight == 0 && !isFound:
+		return previousState, pluginTypes.RpcError{}
+	case desiredWeight == 0:
+		delete(stateMap, rolloutKey)
+	case isFound && desiredWeight == state.Weight:
+		return previousState, pluginTypes.RpcError{}
+	default:
+		newState := state
+		if desiredWeight > getPreviousCanaryWeight(rollout, state, isFound) {
+			newState.IncreaseTime = metav1.Now()
+		}
+		newState.Weight = desiredWeight
+		stateMap[rolloutKey] = newState
+	}
+	return previousState, r.saveWeightGuardrailStateMap(configMap, stateMap, gatewayAPIConfig)
+}
+
+// restoreWeightGuardrailState sets the state recorded before the routes failed to change,
+// so the next check uses the weight the routes still have
+func (r *RpcPlugin) restoreWeightGuardrailState(rollout *v1alpha1.Rollout, previousState *WeightGuardrailState, gatewayAPIConfig *GatewayAPITrafficRouting) pluginTypes.RpcError {
+	if gatewayAPIConfig.WeightGuardrails == nil {
+		return pluginTypes.RpcError{}
+	}
+	configMap, stateMap, rpcError := r.getWeightGuardrailStateMap(gatewayAPIConfig)
+	if rpcError.HasError() {
+		return rpcError
+	}
+	rolloutKey := getRolloutKey(rollout)
+	if previousState == nil {
+		delete(stateMap, rolloutKey)
+	} else {
+		stateMap[rolloutKey] = *previousState
+	}
+	return r.saveWeightGuardrailStateMap(configMap, stateMap, gatewayAPIConfig)
+}
+
+func (r *RpcPlugin) saveWeightGuardrailStateMap(configMap *v1.ConfigMap, stateMap WeightGuardrailStateMap, gatewayAPIConfig *GatewayAPITrafficRouting) pluginTypes.RpcError {
+	err := utils.UpdateConfigMapData(configMap, stateMap, utils.UpdateConfigMapOptions{
+		Clientset:    r.getConfigMapClient(gatewayAPIConfig),
+		ConfigMapKey: WeightGuardrailsConfigMapKey,
+		Ctx:          context.TODO(),
+	})
+	if err != nil {
+		return pluginTypes.RpcError{
+			ErrorString: fmt.Sprintf(ConfigMapError, gatewayAPIConfig.Namespace, gatewayAPIConfig.ConfigMap, err.Error()),
+		}
+	}
+	return pluginTypes.RpcError{}
+}
+
+func (r *RpcPlugin) getWeightGuardrailStateMap(gatewayAPIConfig *GatewayAPITrafficRouting) (*v1.ConfigMap, WeightGuardrailStateMap, pluginTypes.RpcError) {
+	configMap, err := utils.GetOrCreateConfigMap(gatewayAPIConfig.ConfigMap, utils.CreateConfigMapOptions{
+		Clientset: r.getConfigMapClient(gatewayAPIConfig),
+		Ctx:       context.TODO(),
+	})
+	if err != nil {
+		return nil, nil, pluginTypes.RpcError{
+			ErrorString: fmt.Sprintf(ConfigMapError, gatewayAPIConfig.Namespace, gatewayAPIConfig.ConfigMap, err.Error()),
+		}
+	}
+	stateMap := make(WeightGuardrailStateMap)
+	err = utils.GetConfigMapData(configMap, WeightGuardrailsConfigMapKey, &stateMap)
+	if err != nil {
+		return nil, nil, pluginTypes.RpcError{
+			ErrorString: fmt.Sprintf(ConfigMapError, gatewayAPIConfig.Namespace, gatewayAPIConfig.ConfigMap, err.Error()),
+		}
+	}
+	return configMap, stateMap, pluginTypes.RpcError{}
+}
+
+// getPreviousCanaryWeight returns the last weight the plugin set. Without state, e.g. after the guardrails
+// were added during a rollout, the canary weight in the status of the rollout is used
+func getPreviousCanaryWeight(rollout *v1alpha1.Rollout, state WeightGuardrailState, isFound bool) int32 {
+	if isFound {
+		return state.Weight
+	}
+	if rollout.Status.Canary.Weights != nil {
+		return rollout.Status.Canary.Weights.Canary.Weight
+	}
+	return 0
+}
+
+// isFinalPromotion returns whether the rollout sets the full weight after its last step or by a full promotion
+func isFinalPromotion(rollout *v1alpha1.Rollout, desiredWeight int32, gatewayAPIConfig *GatewayAPITrafficRouting) bool {
+	if desiredWeight < gatewayAPIConfig.MaxTrafficWeight {
+		return false
+	}
+	if rollout.Status.PromoteFull {
+		return true
+	}
+	currentStepIndex := rollout.Status.CurrentStepIndex
+	return currentStepIndex != nil && int(*currentStepIndex) >= len(rollout.Spec.Strategy.Canary.Steps)
+}
+
+func getRolloutKey(rollout *v1alpha1.Rollout) string {
+	return fmt.Sprintf("%s/%s", rollout.Namespace, rollout.Name)
+}
@@ -4,24 +4,33 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"maps"
+	"regexp"
 	"slices"
+	"strings"
 
 	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/internal/utils"
 	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
 	pluginTypes "github.com/argoproj/argo-rollouts/utils/plugin/types"
+	"github.com/go-playground/validator/v10"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+	gatewayApiClientv1 "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned/typed/apis/v1"
+	"sigs.k8s.io/yaml"
 )
 
 const (
 	HTTPConfigMapKey = "httpManagedRoutes"
+	CookieHeaderName = "Cookie"
 )
 
 func (r *RpcPlugin) setHTTPRouteWeight(rollout *v1alpha1.Rollout, desiredWeight int32, gatewayAPIConfig *GatewayAPITrafficRouting) pluginTypes.RpcError {
 	ctx := context.TODO()
 	httpRouteClient := r.HTTPRouteClient
 	if !r.IsTest {
-		gatewayClientV1 := r.GatewayAPIClientset.GatewayV1()
+		gatewayClientV1 := r.getGatewayAPIClientset(gatewayAPIConfig).GatewayV1()
 		httpRouteClient = gatewayClientV1.HTTPRoutes(gatewayAPIConfig.Namespace)
 	}
 	httpRoute, err := httpRouteClient.Get(ctx, gatewayAPIConfig.HTTPRoute, metav1.GetOptions{})
@@ -30,40 +39,155 @@ func (r *RpcPlugin) setHTTPRouteWeight(rollout *v1alpha1.Rollout, desiredWeight
 			ErrorString: err.Error(),
 		}
 	}
-	canaryServiceName := rollout.Spec.Strategy.Canary.CanaryService
-	stableServiceName := rollout.Spec.Strategy.Canary.StableService
+	canaryServiceName, stableServiceName := getServiceNames(rollout)
+	canaryBackendRefReference := getBackendRefReference(canaryServiceName, gatewayAPIConfig.CanaryBackendRef)
+	stableBackendRefReference := getBackendRefReference(stableServiceName, gatewayAPIConfig.StableBackendRef)
 	routeRuleList := HTTPRouteRuleList(httpRoute.Spec.Rules)
-	canaryBackendRefs, err := getBackendRefs(canaryServiceName, routeRuleList)
+	err = setBackendRefWeights(routeRuleList, BackendRefWeightOptions{
+		CanaryBackendRef:       canaryBackendRefReference,
+		StableBackendRef:       stableBackendRefReference,
+		RouteNamespace:         httpRoute.Namespace,
+		DesiredWeight:          desiredWeight,
+		MaxTrafficWeight:       gatewayAPIConfig.MaxTrafficWeight,
+		WeightScale:            gatewayAPIConfig.WeightScale,
+		InsertCanaryBackendRef: gatewayAPIConfig.InsertCanaryBackendRef,
+	})
 	if err != nil {
 		return pluginTypes.RpcError{
 			ErrorString: err.Error(),
 		}
 	}
-	for _, ref := range canaryBackendRefs {
-		ref.Weight = &desiredWeight
+	setHTTPCanaryBackendRefFilters(routeRuleList, &httpRoute.ObjectMeta, canaryBackendRefReference, stableBackendRefReference, gatewayAPIConfig.CanaryFilters.HTTP, desiredWeight > 0)
+	setHTTPRouteSessionPersistence(routeRuleList, &httpRoute.ObjectMeta, stableBackendRefReference, gatewayAPIConfig.SessionPersistence, desiredWeight > 0)
+	updatedHTTPRoute, err := httpRouteClient.Update(ctx, httpRoute, metav1.UpdateOptions{})
+	if r.IsTest {
+		r.UpdatedHTTPRouteMock = updatedHTTPRoute
 	}
-	stableBackendRefs, err := getBackendRefs(stableServiceName, routeRuleList)
 	if err != nil {
 		return pluginTypes.RpcError{
 			ErrorString: err.Error(),
 		}
 	}
-	restWeight := 100 - desiredWeight
-	for _, ref := range stableBackendRefs {
-		ref.Weight = &restWeight
+	return pluginTypes.RpcError{}
+}
+
+// ensureHTTPRoute creates the HTTPRoute from its template when the route has a template
+// and doesn't exist yet. The created HTTPRoute is owned by the rollout
+func (r *RpcPlugin) ensureHTTPRoute(rollout *v1alpha1.Rollout, route HTTPRoute, gatewayAPIConfig *GatewayAPITrafficRouting) pluginTypes.RpcError {
+	if route.Template == nil && route.TemplateRef == nil {
+		return pluginTypes.RpcError{}
 	}
-	updatedHTTPRoute, err := httpRouteClient.Update(ctx, httpRoute, metav1.UpdateOptions{})
+	ctx := context.TODO()
+	httpRouteClient := r.HTTPRouteClient
+	clientset := r.TestClientset
+	if !r.IsTest {
+		gatewayClientv1 := r.getGatewayAPIClientset(gatewayAPIConfig).GatewayV1()
+		httpRouteClient = gatewayClientv1.HTTPRoutes(gatewayAPIConfig.Namespace)
+		clientset = r.getClientset(gatewayAPIConfig).CoreV1().ConfigMaps(gatewayAPIConfig.Namespace)
+	}
+	_, err := httpRouteClient.Get(ctx, route.Name, metav1.GetOptions{})
+	if err == nil {
+		return pluginTypes.RpcError{}
+	}
+	if !kubeErrors.IsNotFound(err) {
+		return pluginTypes.RpcError{
+			ErrorString: err.Error(),
+		}
+	}
+	if gatewayAPIConfig.Namespace != rollout.Namespace {
+		return pluginTypes.RpcError{
+			ErrorString: fmt.Sprintf(HTTPRouteTemplateNamespaceError, route.Name, gatewayAPIConfig.Namespace, rollout.Namespace),
+		}
+	}
+	httpRouteTemplate := route.Template
+	if httpRouteTemplate == nil {
+		httpRouteTemplate, err = getHTTPRouteTemplate(route.TemplateRef, clientset)
+		if err != nil {
+			return pluginTypes.RpcError{
+				ErrorString: err.Error(),
+			}
+		}
+	}
+	canaryServiceName, stableServiceName := getServiceNames(rollout)
+	stableBackendRef := newHTTPRouteTemplateBackendRef(httpRouteTemplate.Port, gatewayAPIConfig.WeightScale)
+	getBackendRefReference(stableServiceName, gatewayAPIConfig.StableBackendRef).Apply(&stableBackendRef.BackendObjectReference)
+	canaryBackendRef := newHTTPRouteTemplateBackendRef(httpRouteTemplate.Port, 0)
+	getBackendRefReference(canaryServiceName, gatewayAPIConfig.CanaryBackendRef).Apply(&canaryBackendRef.BackendObjectReference)
+	httpRoute := &gatewayv1.HTTPRoute{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      route.Name,
+			Namespace: gatewayAPIConfig.Namespace,
+			Labels: map[string]string{
+				ManagedByLabel: ManagedByLabelValue,
+			},
+			Annotations: map[string]string{
+				SourceAnnotation: getTemplateHTTPRouteSource(route.Name),
+			},
+			OwnerReferences: []metav1.OwnerReference{getRolloutOwnerReference(rollout)},
+		},
+		Spec: gatewayv1.HTTPRouteSpec{
+			CommonRouteSpec: gatewayv1.CommonRouteSpec{
+				ParentRefs: httpRouteTemplate.ParentRefs,
+			},
+			Hostnames: httpRouteTemplate.Hostnames,
+			Rules: []gatewayv1.HTTPRouteRule{
+				{
+					Matches:     httpRouteTemplate.Matches,
+					BackendRefs: []gatewayv1.HTTPBackendRef{stableBackendRef, canaryBackendRef},
+				},
+			},
+		},
+	}
+	createdHTTPRoute, err := httpRouteClient.Create(ctx, httpRoute, metav1.CreateOptions{})
 	if r.IsTest {
-		r.UpdatedHTTPRouteMock = updatedHTTPRoute
+		r.UpdatedHTTPRouteMock = createdHTTPRoute
 	}
 	if err != nil {
 		return pluginTypes.RpcError{
 			ErrorString: err.Error(),
 		}
 	}
+	r.LogCtx.Info(fmt.Sprintf("HTTPRoute %q was created from the template", route.Name))
 	return pluginTypes.RpcError{}
 }
 
+func newHTTPRouteTemplateBackendRef(port gatewayv1.PortNumber, weight int32) gatewayv1.HTTPBackendRef {
+	serviceKind := gatewayv1.Kind(ServiceKind)
+	serviceGroup := gatewayv1.Group("")
+	return gatewayv1.HTTPBackendRef{
+		BackendRef: gatewayv1.BackendRef{
+			BackendObjectReference: gatewayv1.BackendObjectReference{
+				Group: &serviceGroup,
+				Kind:  &serviceKind,
+				Port:  &port,
+			},
+			Weight: &weight,
+		},
+	}
+}
+
+func getHTTPRouteTemplate(templateRef *HTTPRouteTemplateRef, clientset v1.ConfigMapInterface) (*HTTPRouteTemplate, error) {
+	configMap, err := clientset.Get(context.TODO(), templateRef.ConfigMap, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	rawHTTPRouteTemplate, isOk := configMap.Data[templateRef.Key]
+	if !isOk {
+		return nil, fmt.Errorf(HTTPRouteTemplateKeyWasNotFoundError, templateRef.Key, templateRef.ConfigMap)
+	}
+	httpRouteTemplate := &HTTPRouteTemplate{}
+	err = yaml.UnmarshalStrict([]byte(rawHTTPRouteTemplate), httpRouteTemplate)
+	if err != nil {
+		return nil, err
+	}
+	validate := validator.New(validator.WithRequiredStructEnabled())
+	err = validate.Struct(httpRouteTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return httpRouteTemplate, nil
+}
+
 func (r *RpcPlugin) setHTTPHeaderRoute(rollout *v1alpha1.Rollout, headerRouting *v1alpha1.SetHeaderRoute, gatewayAPIConfig *GatewayAPITrafficRouting) pluginTypes.RpcError {
 	if headerRouting.Match == nil {
 		managedRouteList := []v1alpha1.MangedRoutes{
@@ -79,9 +203,9 @@ func (r *RpcPlugin) setHTTPHeaderRoute(rollout *v1alpha1.Rollout, headerRouting
 	httpRouteName := gatewayAPIConfig.HTTPRoute
 	clientset := r.TestClientset
 	if !r.IsTest {
-		gatewayClientv1 := r.GatewayAPIClientset.GatewayV1()
+		gatewayClientv1 := r.getGatewayAPIClientset(gatewayAPIConfig).GatewayV1()
 		httpRouteClient = gatewayClientv1.HTTPRoutes(gatewayAPIConfig.Namespace)
-		clientset = r.Clientset.CoreV1().ConfigMaps(gatewayAPIConfig.Namespace)
+		clientset = r.getClientset(gatewayAPIConfig).CoreV1().ConfigMaps(gatewayAPIConfig.Namespace)
 	}
 	configMap, err := utils.GetOrCreateConfigMap(gatewayAPIConfig.ConfigMap, utils.CreateConfigMapOptions{
 		Clientset: clientset,
@@ -89,7 +213,7 @@ func (r *RpcPlugin) setHTTPHeaderRoute(rollout *v1alpha1.Rollout, headerRouting
 	})
 	if err != nil {
 		return pluginTypes.RpcError{
-			ErrorString: err.Error(),
+			ErrorString: fmt.Sprintf(ConfigMapError, gatewayAPIConfig.Namespace, gatewayAPIConfig.ConfigMap, err.Error()),
 		}
 	}
 	err = utils.GetConfigMapData(configMap, HTTPConfigMapKey, &managedRouteMap)
@@ -104,53 +228,12 @@ func (r *RpcPlugin) setHTTPHeaderRoute(rollout *v1alpha1.Rollout, headerRouting
 			ErrorString: err.Error(),
 		}
 	}
-	canaryServiceName := gatewayv1.ObjectName(rollout.Spec.Strategy.Canary.CanaryService)
-	stableServiceName := rollout.Spec.Strategy.Canary.StableService
-	canaryServiceKind := gatewayv1.Kind("Service")
-	canaryServiceGroup := gatewayv1.Group("")
-	httpHeaderRouteRuleList, rpcError := getHTTPHeaderRouteRuleList(headerRouting)
+	httpHeaderRouteRule, rpcError := getHTTPHeaderRouteRule(rollout, headerRouting, httpRoute, gatewayAPIConfig)
 	if rpcError.HasError() {
 		return rpcError
 	}
 	httpRouteRuleList := HTTPRouteRuleList(httpRoute.Spec.Rules)
-	backendRefNameList := []string{string(canaryServiceName), stableServiceName}
-	httpRouteRule, err := getRouteRule(httpRouteRuleList, backendRefNameList...)
-	if err != nil {
-		return pluginTypes.RpcError{
-			ErrorString: err.Error(),
-		}
-	}
-	var canaryBackendRef *HTTPBackendRef
-	for i := 0; i < len(httpRouteRule.BackendRefs); i++ {
-		backendRef := httpRouteRule.BackendRefs[i]
-		if canaryServiceName == backendRef.Name {
-			canaryBackendRef = (*HTTPBackendRef)(&backendRef)
-			break
-		}
-	}
-	httpHeaderRouteRule := gatewayv1.HTTPRouteRule{
-		Matches: []gatewayv1.HTTPRouteMatch{},
-		BackendRefs: []gatewayv1.HTTPBackendRef{
-			{
-				BackendRef: gatewayv1.BackendRef{
-					BackendObjectReference: gatewayv1.BackendObjectReference{
-						Group: &canaryServiceGroup,
-						Kind:  &canaryServiceKind,
-						Name:  canaryServiceName,
-						Port:  canaryBackendRef.Port,
-					},
-				},
-			},
-		},
-	}
-	for i := 0; i < len(httpRouteRule.Matches); i++ {
-		httpHeaderRouteRule.Matches = append(httpHeaderRouteRule.Matches, gatewayv1.HTTPRouteMatch{
-			Path:        httpRouteRule.Matches[i].Path,
-			Headers:     httpHeaderRouteRuleList,
-			QueryParams: httpRouteRule.Matches[i].QueryParams,
-		})
-	}
-	httpRouteRuleList = append(httpRouteRuleList, httpHeaderRouteRule)
+	httpRouteRuleList = append(httpRouteRuleList, *httpHeaderRouteRule)
 	oldHTTPRuleList := httpRoute.Spec.Rules
 	httpRoute.Spec.Rules = httpRouteRuleList
 	oldConfigMapData := make(ManagedRouteMap)
@@ -222,6 +305,501 @@ func (r *RpcPlugin) setHTTPHeaderRoute(rollout *v1alpha1.Rollout, headerRouting
 	return pluginTypes.RpcError{}
 }
 
+// setDedicatedHTTPHeaderRoute puts the header route into a separate HTTPRoute with the same parentRefs
+// and hostnames as the HTTPRoute from the config. Gateway API match precedence sends requests
+// with the headers to the separate HTTPRoute, because its matches are more specific
+func (r *RpcPlugin) setDedicatedHTTPHeaderRoute(rollout *v1alpha1.Rollout, headerRouting *v1alpha1.SetHeaderRoute, gatewayAPIConfig *GatewayAPITrafficRouting) pluginTypes.RpcError {
+	if headerRouting.Match == nil {
+		managedRouteList := []v1alpha1.MangedRoutes{
+			{
+				Name: headerRouting.Name,
+			},
+		}
+		return r.removeDedicatedHTTPHeaderRoutes(managedRouteList, gatewayAPIConfig)
+	}
+	ctx := context.TODO()
+	httpRouteClient := r.HTTPRouteClient
+	if !r.IsTest {
+		gatewayClientv1 := r.getGatewayAPIClientset(gatewayAPIConfig).GatewayV1()
+		httpRouteClient = gatewayClientv1.HTTPRoutes(gatewayAPIConfig.Namespace)
+	}
+	httpRoute, err := httpRouteClient.Get(ctx, gatewayAPIConfig.HTTPRoute, metav1.GetOptions{})
+	if err != nil {
+		return pluginTypes.RpcError{
+			ErrorString: err.Error(),
+		}
+	}
+	httpHeaderRouteRule, rpcError := getHTTPHeaderRouteRule(rollout, headerRouting, httpRoute, gatewayAPIConfig)
+	if rpcError.HasError() {
+		return rpcError
+	}
+	dedicatedHTTPRoute := &gatewayv1.HTTPRoute{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getDedicatedHTTPHeaderRouteName(httpRoute.Name, headerRouting.Name),
+			Namespace: httpRoute.Namespace,
+			Labels: map[string]string{
+				ManagedByLabel: ManagedByLabelValue,
+			},
+			Annotations: map[string]string{
+				RolloutAnnotation: getRolloutKey(rollout),
+				SourceAnnotation:  getDedicatedHTTPHeaderRouteSource(httpRoute.Name, headerRouting.Name),
+			},
+		},
+		Spec: gatewayv1.HTTPRouteSpec{
+			CommonRouteSpec: gatewayv1.CommonRouteSpec{
+				ParentRefs: httpRoute.Spec.ParentRefs,
+			},
+			Hostnames: httpRoute.Spec.Hostnames,
+			Rules:     []gatewayv1.HTTPRouteRule{*httpHeaderRouteRule},
+		},
+	}
+	// Owner references can't point to another namespace, in this case
+	// the route is removed by RemoveManagedRoutes or the garbage collector
+	if httpRoute.Namespace == rollout.Namespace {
+		dedicatedHTTPRoute.OwnerReferences = []metav1.OwnerReference{getRolloutOwnerReference(rollout)}
+	}
+	return r.applyHTTPRoute(ctx, httpRouteClient, dedicatedHTTPRoute)
+}
+
+// applyHTTPRoute creates the HTTPRoute or updates the spec of the existing one.
+// An existing HTTPRoute that wasn't created by the plugin is left as it is
+func (r *RpcPlugin) applyHTTPRoute(ctx context.Context, httpRouteClient gatewayApiClientv1.HTTPRouteInterface, httpRoute *gatewayv1.HTTPRoute) pluginTypes.RpcError {
+	existingHTTPRoute, err := httpRouteClient.Get(ctx, httpRoute.Name, metav1.GetOptions{})
+	if err != nil && !kubeErrors.IsNotFound(err) {
+		return pluginTypes.RpcError{
+			ErrorString: err.Error(),
+		}
+	}
+	if err == nil && !isManagedByPlugin(existingHTTPRoute.ObjectMeta) {
+		return pluginTypes.RpcError{
+			ErrorString: fmt.Sprintf(RouteIsNotManagedError, HTTPRouteKind, existingHTTPRoute.Namespace, existingHTTPRoute.Name, ManagedByLabel, ManagedByLabelValue),
+		}
+	}
+	// Routes created by earlier versions of the plugin have no annotations and are taken over
+	if err == nil && (!isCreatedFor(existingHTTPRoute.ObjectMeta, SourceAnnotation, httpRoute.Annotations[SourceAnnotation]) ||
+		!isCreatedFor(existingHTTPRoute.ObjectMeta, RolloutAnnotation, httpRoute.Annotations[RolloutAnnotation])) {
+		return pluginTypes.RpcError{
+			ErrorString: fmt.Sprintf(RouteSourceConflictError, HTTPRouteKind, existingHTTPRoute.Namespace, existingHTTPRoute.Name,
+				existingHTTPRoute.Annotations[SourceAnnotation], existingHTTPRoute.Annotations[RolloutAnnotation],
+				httpRoute.Annotations[SourceAnnotation], httpRoute.Annotations[RolloutAnnotation]),
+		}
+	}
+	var appliedHTTPRoute *gatewayv1.HTTPRoute
+	if err == nil {
+		if existingHTTPRoute.Annotations == nil {
+			existingHTTPRoute.Annotations = make(map[string]string)
+		}
+		maps.Copy(existingHTTPRoute.Annotations, httpRoute.Annotations)
+		existingHTTPRoute.Spec = httpRoute.Spec
+		appliedHTTPRoute, err = httpRouteClient.Update(ctx, existingHTTPRoute, metav1.UpdateOptions{})
+	} else {
+		appliedHTTPRoute, err = httpRouteClient.Create(ctx, httpRoute, metav1.CreateOptions{})
+	}
+	if r.IsTest {
+		r.UpdatedHTTPRouteMock = appliedHTTPRoute
+	}
+	if err != nil {
+		return pluginTypes.RpcError{
+			ErrorString: err.Error(),
+		}
+	}
+	return pluginTypes.RpcError{}
+}
+
+func (r *RpcPlugin) removeDedicatedHTTPHeaderRoutes(managedRouteNameList []v1alpha1.MangedRoutes, gatewayAPIConfig *GatewayAPITrafficRouting) pluginTypes.RpcError {
+	ctx := context.TODO()
+	httpRouteClient := r.HTTPRouteClient
+	if !r.IsTest {
+		gatewayClientv1 := r.getGatewayAPIClientset(gatewayAPIConfig).GatewayV1()
+		httpRouteClient = gatewayClientv1.HTTPRoutes(gatewayAPIConfig.Namespace)
+	}
+	for _, managedRoute := range managedRouteNameList {
+		dedicatedHTTPRouteName := getDedicatedHTTPHeaderRouteName(gatewayAPIConfig.HTTPRoute, managedRoute.Name)
+		isFound, rpcError := r.deleteManagedHTTPRoute(ctx, httpRouteClient, dedicatedHTTPRouteName, getDedicatedHTTPHeaderRouteSource(gatewayAPIConfig.HTTPRoute, managedRoute.Name))
+		if rpcError.HasError() {
+			return rpcError
+		}
+		if !isFound {
+			r.LogCtx.Logger.Info(fmt.Sprintf("HTTPRoute %q of managed route %q doesn't exist", dedicatedHTTPRouteName, managedRoute.Name))
+		}
+	}
+	return pluginTypes.RpcError{}
+}
+
+// deleteManagedHTTPRoute deletes the HTTPRoute if it was created by the plugin for the source. An empty source
+// deletes any HTTPRoute of the plugin. It returns whether the HTTPRoute exists
+func (r *RpcPlugin) deleteManagedHTTPRoute(ctx context.Context, httpRouteClient gatewayApiClientv1.HTTPRouteInterface, name string, source string) (bool, pluginTypes.RpcError) {
+	httpRoute, err := httpRouteClient.Get(ctx, name, metav1.GetOptions{})
+	if kubeErrors.IsNotFound(err) {
+		return false, pluginTypes.RpcError{}
+	}
+	if err != nil {
+		return false, pluginTypes.RpcError{
+			ErrorString: err.Error(),
+		}
+	}
+	if !isManagedByPlugin(httpRoute.ObjectMeta) {
+		return true, pluginTypes.RpcError{
+			ErrorString: fmt.Sprintf(RouteIsNotManagedError, HTTPRouteKind, httpRoute.Namespace, httpRoute.Name, ManagedByLabel, ManagedByLabelValue),
+		}
+	}
+	if source != "" && !isCreatedFor(httpRoute.ObjectMeta, SourceAnnotation, source) {
+		return true, pluginTypes.RpcError{
+			ErrorString: fmt.Sprintf(RouteSourceDeleteConflictError, HTTPRouteKind, httpRoute.Namespace, httpRoute.Name, httpRoute.Annotations[SourceAnnotation], source),
+		}
+	}
+	err = httpRouteClient.Delete(ctx, name, metav1.DeleteOptions{})
+	if kubeErrors.IsNotFound(err) {
+		return false, pluginTypes.RpcError{}
+	}
+	if err != nil {
+		return true, pluginTypes.RpcError{
+			ErrorString: err.Error(),
+		}
+	}
+	return true, pluginTypes.RpcError{}
+}
+
+// isManagedByPlugin returns whether the route was created by the plugin, so the plugin may change or delete it
+func isManagedByPlugin(objectMeta metav1.ObjectMeta) bool {
+	return objectMeta.Labels[ManagedByLabel] == ManagedByLabelValue
+}
+
+// isCreatedFor returns whether the annotation of the route has the value. A route without the annotation
+// was created by an earlier version of the plugin, so it is considered to be created for any value
+func isCreatedFor(objectMeta metav1.ObjectMeta, annotation string, value string) bool {
+	existingValue := objectMeta.Annotations[annotation]
+	return existingValue == "" || existingValue == value
+}
+
+func getDedicatedHTTPHeaderRouteName(httpRouteName string, managedRouteName string) string {
+	return httpRouteName + "-" + managedRouteName
+}
+
+// setCanaryHostnameHTTPRoute creates or updates the HTTPRoute that sends all requests
+// for the canary hostnames to the canary
+func (r *RpcPlugin) setCanaryHostnameHTTPRoute(rollout *v1alpha1.Rollout, canaryHostname *CanaryHostname, gatewayAPIConfig *GatewayAPITrafficRouting) pluginTypes.RpcError {
+	ctx := context.TODO()
+	httpRouteClient := r.HTTPRouteClient
+	if !r.IsTest {
+		gatewayClientv1 := r.getGatewayAPIClientset(gatewayAPIConfig).GatewayV1()
+		httpRouteClient = gatewayClientv1.HTTPRoutes(gatewayAPIConfig.Namespace)
+	}
+	httpRoute, err := httpRouteClient.Get(ctx, gatewayAPIConfig.HTTPRoute, metav1.GetOptions{})
+	if err != nil {
+		return pluginTypes.RpcError{
+			ErrorString: err.Error(),
+		}
+	}
+	canaryHostnameList := getCanaryHostnameList(httpRoute.Spec.Hostnames, canaryHostname.Prefix)
+	// An HTTPRoute without hostnames matches all of them, so it would
+	// send every request of the gateway to the canary
+	if len(canaryHostnameList) == 0 {
+		return pluginTypes.RpcError{
+			ErrorString: fmt.Sprintf(CanaryHostnamesAreEmptyError, httpRoute.Name),
+		}
+	}
+	_, canaryObjectReference, rpcError := getHTTPCanaryRouteRule(rollout, httpRoute, gatewayAPIConfig)
+	if rpcError.HasError() {
+		return rpcError
+	}
+	canaryHostnameHTTPRoute := &gatewayv1.HTTPRoute{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getCanaryHostnameHTTPRouteName(httpRoute.Name),
+			Namespace: httpRoute.Namespace,
+			Labels: map[string]string{
+				ManagedByLabel: ManagedByLabelValue,
+			},
+			Annotations: map[string]string{
+				RolloutAnnotation: getRolloutKey(rollout),
+				SourceAnnotation:  getCanaryHostnameHTTPRouteSource(httpRoute.Name),
+			},
+		},
+		Spec: gatewayv1.HTTPRouteSpec{
+			CommonRouteSpec: gatewayv1.CommonRouteSpec{
+				ParentRefs: httpRoute.Spec.ParentRefs,
+			},
+			Hostnames: canaryHostnameList,
+			Rules: []gatewayv1.HTTPRouteRule{
+				{
+					Filters:  slices.Clone(gatewayAPIConfig.CanaryFilters.HTTP),
+					Timeouts: gatewayAPIConfig.CanaryTimeouts.DeepCopy(),
+					BackendRefs: []gatewayv1.HTTPBackendRef{
+						{
+							BackendRef: gatewayv1.BackendRef{
+								BackendObjectReference: *canaryObjectReference,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	// Owner references can't point to another namespace, in this case
+	// the route is removed by RemoveManagedRoutes or the garbage collector
+	if httpRoute.Namespace == rollout.Namespace {
+		canaryHostnameHTTPRoute.OwnerReferences = []metav1.OwnerReference{getRolloutOwnerReference(rollout)}
+	}
+	return r.applyHTTPRoute(ctx, httpRouteClient, canaryHostnameHTTPRoute)
+}
+
+func (r *RpcPlugin) removeCanaryHostnameHTTPRoute(gatewayAPIConfig *GatewayAPITrafficRouting) pluginTypes.RpcError {
+	ctx := context.TODO()
+	httpRouteClient := r.HTTPRouteClient
+	if !r.IsTest {
+		gatewayClientv1 := r.getGatewayAPIClientset(gatewayAPIConfig).GatewayV1()
+		httpRouteClient = gatewayClientv1.HTTPRoutes(gatewayAPIConfig.Namespace)
+	}
+	canaryHostnameHTTPRouteName := getCanaryHostnameHTTPRouteName(gatewayAPIConfig.HTTPRoute)
+	isFound, rpcError := r.deleteManagedHTTPRoute(ctx, httpRouteClient, canaryHostnameHTTPRouteName, getCanaryHostnameHTTPRouteSource(gatewayAPIConfig.HTTPRoute))
+	if !isFound && !rpcError.HasError() {
+		r.LogCtx.Logger.Info(fmt.Sprintf("HTTPRoute %q with canary hostnames doesn't exist", canaryHostnameHTTPRouteName))
+	}
+	return rpcError
+}
+
+// getCanaryHostnameList returns the prefixed hostnames. Wildcard hostnames are skipped,
+// because a prefix in front of the wildcard isn't a valid hostname
+func getCanaryHostnameList(hostnameList []gatewayv1.Hostname, prefix string) []gatewayv1.Hostname {
+	var canaryHostnameList []gatewayv1.Hostname
+	for _, hostname := range hostnameList {
+		if strings.HasPrefix(string(hostname), "*") {
+			continue
+		}
+		canaryHostnameList = append(canaryHostnameList, gatewayv1.Hostname(prefix+string(hostname)))
+	}
+	return canaryHostnameList
+}
+
+func getCanaryHostnameHTTPRouteName(httpRouteName string) string {
+	return httpRouteName + "-canary-hostname"
+}
+
+// getTemplateHTTPRouteSource, getDedicatedHTTPHeaderRouteSource and getCanaryHostnameHTTPRouteSource return
+// the values of the source annotation. The generated route names can collide, the sources can't
+func getTemplateHTTPRouteSource(httpRouteName string) string {
+	return "template/" + httpRouteName
+}
+
+func getDedicatedHTTPHeaderRouteSource(httpRouteName string, managedRouteName string) string {
+	return fmt.Sprintf("header-route/%s/%s", httpRouteName, managedRouteName)
+}
+
+func getCanaryHostnameHTTPRouteSource(httpRouteName string) string {
+	return "canary-hostname/" + httpRouteName
+}
+
+// getHTTPCanaryRouteRule returns the rule with the stable and canary backendRefs together with
+// the object reference of the canary. In insert mode the canary reference is derived from the stable one
+func getHTTPCanaryRouteRule(rollout *v1alpha1.Rollout, httpRoute *gatewayv1.HTTPRoute, gatewayAPIConfig *GatewayAPITrafficRouting) (*gatewayv1.HTTPRouteRule, *gatewayv1.BackendObjectReference, pluginTypes.RpcError) {
+	canaryServiceName, stableServiceName := getServiceNames(rollout)
+	canaryBackendRefReference := getBackendRefReference(canaryServiceName, gatewayAPIConfig.CanaryBackendRef)
+	stableBackendRefReference := getBackendRefReference(stableServiceName, gatewayAPIConfig.StableBackendRef)
+	httpRouteRuleList := HTTPRouteRuleList(httpRoute.Spec.Rules)
+	backendRefReferenceList := []BackendRefReference{canaryBackendRefReference, stableBackendRefReference}
+	if gatewayAPIConfig.InsertCanaryBackendRef {
+		backendRefReferenceList = []BackendRefReference{stableBackendRefReference}
+	}
+	httpRouteRule, err := getRouteRule(httpRouteRuleList, httpRoute.Namespace, backendRefReferenceList...)
+	if err != nil {
+		return nil, nil, pluginTypes.RpcError{
+			ErrorString: err.Error(),
+		}
+	}
+	var canaryObjectReference *gatewayv1.BackendObjectReference
+	for i := 0; i < len(httpRouteRule.BackendRefs); i++ {
+		objectReference := httpRouteRule.BackendRefs[i].BackendObjectReference
+		if canaryBackendRefReference.IsMatched(objectReference, httpRoute.Namespace) {
+			canaryObjectReference = &objectReference
+			break
+		}
+	}
+	if canaryObjectReference == nil && gatewayAPIConfig.InsertCanaryBackendRef {
+		for i := 0; i < len(httpRouteRule.BackendRefs); i++ {
+			objectReference := httpRouteRule.BackendRefs[i].BackendObjectReference
+			if stableBackendRefReference.IsMatched(objectReference, httpRoute.Namespace) {
+				canaryObjectReference = objectReference.DeepCopy()
+				canaryBackendRefReference.Apply(canaryObjectReference)
+				break
+			}
+		}
+	}
+	if canaryObjectReference == nil {
+		return nil, nil, pluginTypes.RpcError{
+			ErrorString: BackendRefWasNotFoundInHTTPRouteError,
+		}
+	}
+	return (*gatewayv1.HTTPRouteRule)(httpRouteRule), canaryObjectReference, pluginTypes.RpcError{}
+}
+
+// getHTTPHeaderRouteRule returns the rule that sends requests matching the header routing to the canary.
+// The rule is based on the rule of the HTTPRoute with the stable and canary backendRefs
+func getHTTPHeaderRouteRule(rollout *v1alpha1.Rollout, headerRouting *v1alpha1.SetHeaderRoute, httpRoute *gatewayv1.HTTPRoute, gatewayAPIConfig *GatewayAPITrafficRouting) (*gatewayv1.HTTPRouteRule, pluginTypes.RpcError) {
+	httpHeaderRouteRuleList, rpcError := getHTTPHeaderRouteRuleList(headerRouting)
+	if rpcError.HasError() {
+		return nil, rpcError
+	}
+	httpRouteRule, canaryObjectReference, rpcError := getHTTPCanaryRouteRule(rollout, httpRoute, gatewayAPIConfig)
+	if rpcError.HasError() {
+		return nil, rpcError
+	}
+	httpHeaderRouteRule := gatewayv1.HTTPRouteRule{
+		Matches:  []gatewayv1.HTTPRouteMatch{},
+		Filters:  slices.Clone(gatewayAPIConfig.CanaryFilters.HTTP),
+		Timeouts: gatewayAPIConfig.CanaryTimeouts.DeepCopy(),
+		BackendRefs: []gatewayv1.HTTPBackendRef{
+			{
+				BackendRef: gatewayv1.BackendRef{
+					BackendObjectReference: *canaryObjectReference,
+				},
+			},
+		},
+	}
+	// A rule without matches matches every request, so the header rule gets
+	// a single match with only the header conditions instead of no matches at all
+	httpRouteMatchList := httpRouteRule.Matches
+	if len(httpRouteMatchList) == 0 {
+		httpRouteMatchList = []gatewayv1.HTTPRouteMatch{{}}
+	}
+	managedRoute := gatewayAPIConfig.ManagedRoutes[headerRouting.Name]
+	for i := 0; i < len(httpRouteMatchList); i++ {
+		httpHeaderMatchList, err := mergeHTTPHeaderMatchList(httpRouteMatchList[i].Headers, httpHeaderRouteRuleList)
+		if err != nil {
+			return nil, pluginTypes.RpcError{
+				ErrorString: err.Error(),
+			}
+		}
+		httpHeaderRouteRule.Matches = append(httpHeaderRouteRule.Matches, gatewayv1.HTTPRouteMatch{
+			Path:        httpRouteMatchList[i].Path,
+			Headers:     httpHeaderMatchList,
+			QueryParams: httpRouteMatchList[i].QueryParams,
+			Method:      httpRouteMatchList[i].Method,
+		})
+		managedRouteMatchList, err := getHTTPManagedRouteMatchList(httpRouteMatchList[i], managedRoute)
+		if err != nil {
+			return nil, pluginTypes.RpcError{
+				ErrorString: err.Error(),
+			}
+		}
+		httpHeaderRouteRule.Matches = append(httpHeaderRouteRule.Matches, managedRouteMatchList...)
+	}
+	return &httpHeaderRouteRule, pluginTypes.RpcError{}
+}
+
+// GetHTTPHeaderRouteRule returns the rule that sends requests matching the header routing to the canary
+// in the same way as the plugin adds it to the HTTPRoute during the rollout
+func GetHTTPHeaderRouteRule(rollout *v1alpha1.Rollout, headerRouting *v1alpha1.SetHeaderRoute, httpRoute *gatewayv1.HTTPRoute, gatewayAPIConfig *GatewayAPITrafficRouting) (*gatewayv1.HTTPRouteRule, error) {
+	httpHeaderRouteRule, rpcError := getHTTPHeaderRouteRule(rollout, headerRouting, httpRoute, gatewayAPIConfig)
+	if rpcError.HasError() {
+		return nil, rpcError
+	}
+	return httpHeaderRouteRule, nil
+}
+
+// getHTTPManagedRouteMatchList returns the query parameter and cookie matches of the managed route.
+// Every cookie gets its own match, because a match can't have two conditions for the Cookie header
+func getHTTPManagedRouteMatchList(httpRouteMatch gatewayv1.HTTPRouteMatch, managedRoute ManagedRoute) ([]gatewayv1.HTTPRouteMatch, error) {
+	var httpRouteMatchList []gatewayv1.HTTPRouteMatch
+	if len(managedRoute.QueryParams) > 0 {
+		httpRouteMatchList = append(httpRouteMatchList, gatewayv1.HTTPRouteMatch{
+			Path:        httpRouteMatch.Path,
+			Headers:     httpRouteMatch.Headers,
+			QueryParams: append(slices.Clone(httpRouteMatch.QueryParams), managedRoute.QueryParams...),
+			Method:      httpRouteMatch.Method,
+		})
+	}
+	for _, cookie := range managedRoute.Cookies {
+		httpHeaderMatchList, err := mergeHTTPHeaderMatchList(httpRouteMatch.Headers, []gatewayv1.HTTPHeaderMatch{getCookieHeaderMatch(cookie)})
+		if err != nil {
+			return nil, err
+		}
+		httpRouteMatchList = append(httpRouteMatchList, gatewayv1.HTTPRouteMatch{
+			Path:        httpRouteMatch.Path,
+			Headers:     httpHeaderMatchList,
+			QueryParams: httpRouteMatch.QueryParams,
+			Method:      httpRouteMatch.Method,
+		})
+	}
+	return httpRouteMatchList, nil
+}
+
+// mergeHTTPHeaderMatchList returns the header matches of the original match together with the new ones.
+// Gateway API doesn't allow two matches of the same header. Replacing the original condition would send
+// requests to the canary that the routing rule doesn't match, so a header in both lists is an error
+func mergeHTTPHeaderMatchList(httpHeaderMatchList []gatewayv1.HTTPHeaderMatch, newHTTPHeaderMatchList []gatewayv1.HTTPHeaderMatch) ([]gatewayv1.HTTPHeaderMatch, error) {
+	for _, httpHeaderMatch := range httpHeaderMatchList {
+		isConflicting := slices.ContainsFunc(newHTTPHeaderMatchList, func(newHTTPHeaderMatch gatewayv1.HTTPHeaderMatch) bool {
+			return strings.EqualFold(string(newHTTPHeaderMatch.Name), string(httpHeaderMatch.Name))
+		})
+		if isConflicting {
+			return nil, fmt.Errorf(HeaderMatchConflictError, httpHeaderMatch.Name)
+		}
+	}
+	return append(slices.Clone(httpHeaderMatchList), newHTTPHeaderMatchList...), nil
+}
+
+// getCookieHeaderMatch returns the regular expression match of the Cookie header. The expression
+// matches the whole header value, because some implementations require a full match
+func getCookieHeaderMatch(cookie CookieMatch) gatewayv1.HTTPHeaderMatch {
+	headerMatchType := gatewayv1.HeaderMatchRegularExpression
+	return gatewayv1.HTTPHeaderMatch{
+		Type:  &headerMatchType,
+		Name:  CookieHeaderName,
+		Value: fmt.Sprintf("^(.*;\\s*)?%s=%s(;.*)?$", regexp.QuoteMeta(cookie.Name), regexp.QuoteMeta(cookie.Value)),
+	}
+}
+
+// setHTTPCanaryBackendRefFilters adds the canary filters to the canary backendRefs of the weighted rules while
+// the canary gets traffic and removes them when it doesn't. Header rules of the plugin have no stable backendRef
+// and get the canary filters on the rule itself, so they are skipped. The added filters are recorded in an annotation
+func setHTTPCanaryBackendRefFilters(routeRuleList HTTPRouteRuleList, objectMeta *metav1.ObjectMeta, canaryBackendRefReference BackendRefReference, stableBackendRefReference BackendRefReference, canaryFilterList []gatewayv1.HTTPRouteFilter, isEnabled bool) {
+	filterMap, isRecorded := getCanaryFilterMap(*objectMeta)
+	if len(canaryFilterList) == 0 && !isRecorded {
+		return
+	}
+	// Filters of canary backendRefs that aren't there anymore are dropped from the record
+	syncedFilterMap := make(map[string][]int)
+	for i := 0; i < len(routeRuleList); i++ {
+		backendRefList := routeRuleList[i].BackendRefs
+		isWeightedRule := slices.ContainsFunc(backendRefList, func(backendRef gatewayv1.HTTPBackendRef) bool {
+			return stableBackendRefReference.IsMatched(backendRef.BackendObjectReference, objectMeta.Namespace)
+		})
+		if !isWeightedRule {
+			continue
+		}
+		for j := 0; j < len(backendRefList); j++ {
+			if canaryBackendRefReference.IsMatched(backendRefList[j].BackendObjectReference, objectMeta.Namespace) {
+				key := getCanaryFilterKey(i, j)
+				backendRefList[j].Filters, syncedFilterMap[key] = syncFilters(backendRefList[j].Filters, canaryFilterList, filterMap[key], isRecorded, isEnabled)
+			}
+		}
+	}
+	setCanaryFilterMap(objectMeta, syncedFilterMap, len(canaryFilterList) > 0)
+}
+
+// setHTTPRouteSessionPersistence sets the session persistence of the rules with the stable backendRef
+func setHTTPRouteSessionPersistence(routeRuleList HTTPRouteRuleList, objectMeta *metav1.ObjectMeta, stableBackendRefReference BackendRefReference, sessionPersistence *gatewayv1.SessionPersistence, isEnabled bool) {
+	ruleSet := getSessionPersistenceRuleSet(*objectMeta)
+	for i := 0; i < len(routeRuleList); i++ {
+		isWeightedRule := slices.ContainsFunc(routeRuleList[i].BackendRefs, func(backendRef gatewayv1.HTTPBackendRef) bool {
+			return stableBackendRefReference.IsMatched(backendRef.BackendObjectReference, objectMeta.Namespace)
+		})
+		if isWeightedRule {
+			routeRuleList[i].SessionPersistence, ruleSet[i] = syncSessionPersistence(routeRuleList[i].SessionPersistence, sessionPersistence, ruleSet[i], isEnabled)
+		}
+		if !ruleSet[i] {
+			delete(ruleSet, i)
+		}
+	}
+	// Indexes of rules that don't exist anymore are dropped
+	for index := range ruleSet {
+		if index >= len(routeRuleList) {
+			delete(ruleSet, index)
+		}
+	}
+	setSessionPersistenceRuleSet(objectMeta, ruleSet)
+}
+
 func getHTTPHeaderRouteRuleList(headerRouting *v1alpha1.SetHeaderRoute) ([]gatewayv1.HTTPHeaderMatch, pluginTypes.RpcError) {
 	httpHeaderRouteRuleList := []gatewayv1.HTTPHeaderMatch{}
 	for _, headerRule := range headerRouting.Match {
@@ -258,9 +836,9 @@ func (r *RpcPlugin) removeHTTPManagedRoutes(managedRouteNameList []v1alpha1.Mang
 	httpRouteName := gatewayAPIConfig.HTTPRoute
 	managedRouteMap := make(ManagedRouteMap)
 	if !r.IsTest {
-		gatewayClientv1 := r.GatewayAPIClientset.GatewayV1()
+		gatewayClientv1 := r.getGatewayAPIClientset(gatewayAPIConfig).GatewayV1()
 		httpRouteClient = gatewayClientv1.HTTPRoutes(gatewayAPIConfig.Namespace)
-		clientset = r.Clientset.CoreV1().ConfigMaps(gatewayAPIConfig.Namespace)
+		clientset = r.getClientset(gatewayAPIConfig).CoreV1().ConfigMaps(gatewayAPIConfig.Namespace)
 	}
 	configMap, err := utils.GetOrCreateConfigMap(gatewayAPIConfig.ConfigMap, utils.CreateConfigMapOptions{
 		Clientset: clientset,
@@ -268,7 +846,7 @@ func (r *RpcPlugin) removeHTTPManagedRoutes(managedRouteNameList []v1alpha1.Mang
 	})
 	if err != nil {
 		return pluginTypes.RpcError{
-			ErrorString: err.Error(),
+			ErrorString: fmt.Sprintf(ConfigMapError, gatewayAPIConfig.Namespace, gatewayAPIConfig.ConfigMap, err.Error()),
 		}
 	}
 	err = utils.GetConfigMapData(configMap, HTTPConfigMapKey, &managedRouteMap)
@@ -408,6 +986,22 @@ func (r *HTTPRouteRule) Iterator() (GatewayAPIRouteRuleIterator[*HTTPBackendRef]
 	return next, len(backendRefList) > index
 }
 
+// AddBackendRef appends a copy of the backendRef with zero weight that refers to another backend.
+// Port, group, kind and filters are taken from the copied backendRef unless the reference sets them
+func (r *HTTPRouteRule) AddBackendRef(backendRef *HTTPBackendRef, backendRefReference BackendRefReference) {
+	var weight int32
+	newBackendRef := (*gatewayv1.HTTPBackendRef)(backendRef).DeepCopy()
+	backendRefReference.Apply(&newBackendRef.BackendObjectReference)
+	newBackendRef.Weight = &weight
+	r.BackendRefs = append(r.BackendRefs, *newBackendRef)
+}
+
+func (r *HTTPRouteRule) RemoveBackendRefs(backendRefReference BackendRefReference, routeNamespace string) {
+	r.BackendRefs = slices.DeleteFunc(r.BackendRefs, func(backendRef gatewayv1.HTTPBackendRef) bool {
+		return backendRefReference.IsMatched(backendRef.BackendObjectReference, routeNamespace)
+	})
+}
+
 func (r HTTPRouteRuleList) Iterator() (GatewayAPIRouteRuleListIterator[*HTTPBackendRef, *HTTPRouteRule], bool) {
 	routeRuleList := r
 	index := 0
@@ -430,6 +1024,26 @@ func (r *HTTPBackendRef) GetName() string {
 	return string(r.Name)
 }
 
+func (r *HTTPBackendRef) GetObjectReference() gatewayv1.BackendObjectReference {
+	return r.BackendObjectReference
+}
+
+func (r *HTTPBackendRef) GetWeight() int32 {
+	// Gateway API treats a backendRef without weight as a backendRef with weight 1
+	if r.Weight == nil {
+		return 1
+	}
+	return *r.Weight
+}
+
+func (r *HTTPBackendRef) SetWeight(weight int32) {
+	r.Weight = &weight
+}
+
 func (r HTTPRoute) GetName() string {
 	return r.Name
 }
+
+func (r HTTPRoute) GetKind() string {
+	return HTTPRouteKind
+}
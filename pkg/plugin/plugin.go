@@ -1,22 +1,46 @@
 package plugin
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+	rolloutsClientset "github.com/argoproj/argo-rollouts/pkg/client/clientset/versioned"
 	pluginTypes "github.com/argoproj/argo-rollouts/utils/plugin/types"
 	"github.com/go-playground/validator/v10"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
 	gatewayApiClientset "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned"
+	kubeJSON "sigs.k8s.io/json"
 
 	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/internal/defaults"
 	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/internal/utils"
 )
 
 const (
-	Type       = "GatewayAPI"
-	PluginName = "argoproj-labs/gatewayAPI"
+	Type        = "GatewayAPI"
+	PluginName  = "argoproj-labs/gatewayAPI"
+	RolloutKind = "Rollout"
+	ServiceKind = "Service"
+	// ManagedByLabel marks the routes and config maps created by the plugin
+	ManagedByLabel      = defaults.ManagedByLabel
+	ManagedByLabelValue = defaults.ManagedByLabelValue
+	// SessionPersistenceRulesAnnotation refers to the indexes of the rules the plugin has set the session persistence on
+	SessionPersistenceRulesAnnotation = "gatewayapi.rollouts.argoproj.io/session-persistence-rules"
+	// RolloutAnnotation refers to the rollout that has created the route, so the garbage collector can remove the route with it
+	RolloutAnnotation = "gatewayapi.rollouts.argoproj.io/rollout"
+	// SourceAnnotation refers to what the plugin has created the route for, so routes with the same generated name don't replace each other
+	SourceAnnotation = "gatewayapi.rollouts.argoproj.io/source"
+	// CanaryFiltersAnnotation refers to the filters the plugin has added to the canary backendRefs as rule/backendRef/filter indexes
+	CanaryFiltersAnnotation = "gatewayapi.rollouts.argoproj.io/canary-filters"
 )
 
 func (r *RpcPlugin) InitPlugin() pluginTypes.RpcError {
@@ -54,8 +78,28 @@ func (r *RpcPlugin) InitPlugin() pluginTypes.RpcError {
 			ErrorString: err.Error(),
 		}
 	}
+	rolloutsClientset, err := rolloutsClientset.NewForConfig(kubeConfig)
+	if err != nil {
+		return pluginTypes.RpcError{
+			ErrorString: err.Error(),
+		}
+	}
 	r.GatewayAPIClientset = gatewayAPIClientset
 	r.Clientset = clientset
+	r.RolloutsClientset = rolloutsClientset
+	r.kubeConfig = kubeConfig
+	if r.isNamespacePolicyEnabled() {
+		log.Infof("NamespacePolicy set to: %v, NamespacePolicyConfigMap set to: %q", r.CommandLineOpts.NamespacePolicy, r.CommandLineOpts.NamespacePolicyConfigMap)
+	}
+	if r.CommandLineOpts.ImpersonateServiceAccount != "" {
+		log.Infof("ImpersonateServiceAccount set to: %s", r.CommandLineOpts.ImpersonateServiceAccount)
+	}
+	if r.CommandLineOpts.GarbageCollectorInterval > 0 {
+		log.Infof("GarbageCollectorInterval set to: %s", r.CommandLineOpts.GarbageCollectorInterval)
+		r.garbageCollectorOnce.Do(func() {
+			go r.runGarbageCollector(context.Background(), r.CommandLineOpts.GarbageCollectorInterval)
+		})
+	}
 	return pluginTypes.RpcError{}
 }
 
@@ -70,29 +114,75 @@ func (r *RpcPlugin) SetWeight(rollout *v1alpha1.Rollout, desiredWeight int32, ad
 			ErrorString: err.Error(),
 		}
 	}
+	r.logDeprecationWarnings(rollout, gatewayAPIConfig)
+	rpcError := r.checkNamespacePolicy(rollout, gatewayAPIConfig)
+	if rpcError.HasError() {
+		return rpcError
+	}
+	rpcError = r.setNamespaceClientsets(rollout, gatewayAPIConfig)
+	if rpcError.HasError() {
+		return rpcError
+	}
+	gatewayAPIConfig.ConfigMapRWMutex = r.getConfigMapRWMutex(gatewayAPIConfig.Namespace, gatewayAPIConfig.ConfigMap)
 	if !isConfigHasRoutes(gatewayAPIConfig) {
 		return pluginTypes.RpcError{
 			ErrorString: GatewayAPIManifestError,
 		}
 	}
-	r.LogCtx.Info(fmt.Sprintf("[SetWeight] plugin %q controls HTTPRoutes: %v", PluginName, getGatewayAPIRouteNameList(gatewayAPIConfig.HTTPRoutes)))
-	rpcError := forEachGatewayAPIRoute(gatewayAPIConfig.HTTPRoutes, func(route HTTPRoute) pluginTypes.RpcError {
+	if gatewayAPIConfig.WeightGuardrails != nil {
+		// The state is checked and recorded under the lock of the config map, so parallel calls
+		// and the garbage collector don't work with a stale state
+		gatewayAPIConfig.ConfigMapRWMutex.Lock()
+		defer gatewayAPIConfig.ConfigMapRWMutex.Unlock()
+	}
+	rpcError = r.checkWeightGuardrails(rollout, desiredWeight, gatewayAPIConfig)
+	if rpcError.HasError() {
+		return rpcError
+	}
+	// The state is recorded before the routes change, so a failed write doesn't leave changed routes behind
+	previousState, rpcError := r.updateWeightGuardrailState(rollout, desiredWeight, gatewayAPIConfig)
+	if rpcError.HasError() {
+		return rpcError
+	}
+	rpcError = r.setRouteWeights(rollout, desiredWeight, gatewayAPIConfig)
+	if rpcError.HasError() {
+		restoreRpcError := r.restoreWeightGuardrailState(rollout, previousState, gatewayAPIConfig)
+		if restoreRpcError.HasError() {
+			r.LogCtx.Error(fmt.Sprintf("[SetWeight] %s", restoreRpcError.ErrorString))
+		}
+		return rpcError
+	}
+	return pluginTypes.RpcError{}
+}
+
+// setRouteWeights sets the desired weight in all routes of the configuration
+func (r *RpcPlugin) setRouteWeights(rollout *v1alpha1.Rollout, desiredWeight int32, gatewayAPIConfig *GatewayAPITrafficRouting) pluginTypes.RpcError {
+	r.LogCtx.Info(fmt.Sprintf("[SetWeight] plugin %q controls HTTPRoutes %v in namespace %q", PluginName, getGatewayAPIRouteNameList(gatewayAPIConfig.HTTPRoutes), gatewayAPIConfig.Namespace))
+	rpcError := forEachGatewayAPIRoute(gatewayAPIConfig.HTTPRoutes, gatewayAPIConfig.Namespace, func(route HTTPRoute) pluginTypes.RpcError {
 		gatewayAPIConfig.HTTPRoute = route.Name
-		return r.setHTTPRouteWeight(rollout, desiredWeight, gatewayAPIConfig)
+		rpcError := r.ensureHTTPRoute(rollout, route, gatewayAPIConfig)
+		if rpcError.HasError() {
+			return rpcError
+		}
+		rpcError = r.setHTTPRouteWeight(rollout, desiredWeight, gatewayAPIConfig)
+		if rpcError.HasError() || route.CanaryHostname == nil || route.CanaryHostname.ManagedRoute != "" {
+			return rpcError
+		}
+		return r.setCanaryHostnameHTTPRoute(rollout, route.CanaryHostname, gatewayAPIConfig)
 	})
 	if rpcError.HasError() {
 		return rpcError
 	}
-	r.LogCtx.Info(fmt.Sprintf("[SetWeight] plugin %q controls GRPCRoutes: %v", PluginName, getGatewayAPIRouteNameList(gatewayAPIConfig.GRPCRoutes)))
-	rpcError = forEachGatewayAPIRoute(gatewayAPIConfig.GRPCRoutes, func(route GRPCRoute) pluginTypes.RpcError {
+	r.LogCtx.Info(fmt.Sprintf("[SetWeight] plugin %q controls GRPCRoutes %v in namespace %q", PluginName, getGatewayAPIRouteNameList(gatewayAPIConfig.GRPCRoutes), gatewayAPIConfig.Namespace))
+	rpcError = forEachGatewayAPIRoute(gatewayAPIConfig.GRPCRoutes, gatewayAPIConfig.Namespace, func(route GRPCRoute) pluginTypes.RpcError {
 		gatewayAPIConfig.GRPCRoute = route.Name
 		return r.setGRPCRouteWeight(rollout, desiredWeight, gatewayAPIConfig)
 	})
 	if rpcError.HasError() {
 		return rpcError
 	}
-	r.LogCtx.Info(fmt.Sprintf("[SetWeight] plugin %q controls TCPRoutes: %v", PluginName, getGatewayAPIRouteNameList(gatewayAPIConfig.TCPRoutes)))
-	rpcError = forEachGatewayAPIRoute(gatewayAPIConfig.TCPRoutes, func(route TCPRoute) pluginTypes.RpcError {
+	r.LogCtx.Info(fmt.Sprintf("[SetWeight] plugin %q controls TCPRoutes %v in namespace %q", PluginName, getGatewayAPIRouteNameList(gatewayAPIConfig.TCPRoutes), gatewayAPIConfig.Namespace))
+	rpcError = forEachGatewayAPIRoute(gatewayAPIConfig.TCPRoutes, gatewayAPIConfig.Namespace, func(route TCPRoute) pluginTypes.RpcError {
 		gatewayAPIConfig.TCPRoute = route.Name
 		return r.setTCPRouteWeight(rollout, desiredWeight, gatewayAPIConfig)
 	})
@@ -106,14 +196,42 @@ func (r *RpcPlugin) SetHeaderRoute(rollout *v1alpha1.Rollout, headerRouting *v1a
 			ErrorString: err.Error(),
 		}
 	}
+	r.logDeprecationWarnings(rollout, gatewayAPIConfig)
+	rpcError := r.checkNamespacePolicy(rollout, gatewayAPIConfig)
+	if rpcError.HasError() {
+		return rpcError
+	}
+	rpcError = r.setNamespaceClientsets(rollout, gatewayAPIConfig)
+	if rpcError.HasError() {
+		return rpcError
+	}
+	gatewayAPIConfig.ConfigMapRWMutex = r.getConfigMapRWMutex(gatewayAPIConfig.Namespace, gatewayAPIConfig.ConfigMap)
 	if gatewayAPIConfig.HTTPRoutes != nil {
 		gatewayAPIConfig.ConfigMapRWMutex.Lock()
-		r.LogCtx.Info(fmt.Sprintf("[SetHeaderRoute] plugin %q controls HTTPRoutes: %v", PluginName, getGatewayAPIRouteNameList(gatewayAPIConfig.HTTPRoutes)))
-		rpcError := forEachGatewayAPIRoute(gatewayAPIConfig.HTTPRoutes, func(route HTTPRoute) pluginTypes.RpcError {
-			if !route.UseHeaderRoutes {
+		r.LogCtx.Info(fmt.Sprintf("[SetHeaderRoute] plugin %q controls HTTPRoutes %v in namespace %q with config map %s/%s", PluginName, getGatewayAPIRouteNameList(gatewayAPIConfig.HTTPRoutes), gatewayAPIConfig.Namespace, gatewayAPIConfig.Namespace, gatewayAPIConfig.ConfigMap))
+		rpcError := forEachGatewayAPIRoute(gatewayAPIConfig.HTTPRoutes, gatewayAPIConfig.Namespace, func(route HTTPRoute) pluginTypes.RpcError {
+			isCanaryHostnameManaged := route.CanaryHostname.IsManagedBy(headerRouting.Name)
+			if !route.UseHeaderRoutes && !isCanaryHostnameManaged {
 				return pluginTypes.RpcError{}
 			}
 			gatewayAPIConfig.HTTPRoute = route.Name
+			rpcError := r.ensureHTTPRoute(rollout, route, gatewayAPIConfig)
+			if rpcError.HasError() {
+				return rpcError
+			}
+			if isCanaryHostnameManaged {
+				if headerRouting.Match == nil {
+					rpcError = r.removeCanaryHostnameHTTPRoute(gatewayAPIConfig)
+				} else {
+					rpcError = r.setCanaryHostnameHTTPRoute(rollout, route.CanaryHostname, gatewayAPIConfig)
+				}
+				if rpcError.HasError() || !route.UseHeaderRoutes {
+					return rpcError
+				}
+			}
+			if route.UseDedicatedHeaderRoutes {
+				return r.setDedicatedHTTPHeaderRoute(rollout, headerRouting, gatewayAPIConfig)
+			}
 			return r.setHTTPHeaderRoute(rollout, headerRouting, gatewayAPIConfig)
 		})
 		if rpcError.HasError() {
@@ -124,8 +242,8 @@ func (r *RpcPlugin) SetHeaderRoute(rollout *v1alpha1.Rollout, headerRouting *v1a
 	}
 	if gatewayAPIConfig.GRPCRoutes != nil {
 		gatewayAPIConfig.ConfigMapRWMutex.Lock()
-		r.LogCtx.Info(fmt.Sprintf("[SetHeaderRoute] plugin %q controls GRPCRoutes: %v", PluginName, getGatewayAPIRouteNameList(gatewayAPIConfig.GRPCRoutes)))
-		rpcError := forEachGatewayAPIRoute(gatewayAPIConfig.GRPCRoutes, func(route GRPCRoute) pluginTypes.RpcError {
+		r.LogCtx.Info(fmt.Sprintf("[SetHeaderRoute] plugin %q controls GRPCRoutes %v in namespace %q with config map %s/%s", PluginName, getGatewayAPIRouteNameList(gatewayAPIConfig.GRPCRoutes), gatewayAPIConfig.Namespace, gatewayAPIConfig.Namespace, gatewayAPIConfig.ConfigMap))
+		rpcError := forEachGatewayAPIRoute(gatewayAPIConfig.GRPCRoutes, gatewayAPIConfig.Namespace, func(route GRPCRoute) pluginTypes.RpcError {
 			if !route.UseHeaderRoutes {
 				return pluginTypes.RpcError{}
 			}
@@ -156,14 +274,33 @@ func (r *RpcPlugin) RemoveManagedRoutes(rollout *v1alpha1.Rollout) pluginTypes.R
 			ErrorString: err.Error(),
 		}
 	}
+	r.logDeprecationWarnings(rollout, gatewayAPIConfig)
+	rpcError := r.checkNamespacePolicy(rollout, gatewayAPIConfig)
+	if rpcError.HasError() {
+		return rpcError
+	}
+	rpcError = r.setNamespaceClientsets(rollout, gatewayAPIConfig)
+	if rpcError.HasError() {
+		return rpcError
+	}
+	gatewayAPIConfig.ConfigMapRWMutex = r.getConfigMapRWMutex(gatewayAPIConfig.Namespace, gatewayAPIConfig.ConfigMap)
 	if gatewayAPIConfig.HTTPRoutes != nil {
 		gatewayAPIConfig.ConfigMapRWMutex.Lock()
-		r.LogCtx.Info(fmt.Sprintf("[RemoveManagedRoutes] plugin %q controls HTTPRoutes: %v", PluginName, getGatewayAPIRouteNameList(gatewayAPIConfig.HTTPRoutes)))
-		rpcError := forEachGatewayAPIRoute(gatewayAPIConfig.HTTPRoutes, func(route HTTPRoute) pluginTypes.RpcError {
+		r.LogCtx.Info(fmt.Sprintf("[RemoveManagedRoutes] plugin %q controls HTTPRoutes %v in namespace %q with config map %s/%s", PluginName, getGatewayAPIRouteNameList(gatewayAPIConfig.HTTPRoutes), gatewayAPIConfig.Namespace, gatewayAPIConfig.Namespace, gatewayAPIConfig.ConfigMap))
+		rpcError := forEachGatewayAPIRoute(gatewayAPIConfig.HTTPRoutes, gatewayAPIConfig.Namespace, func(route HTTPRoute) pluginTypes.RpcError {
+			gatewayAPIConfig.HTTPRoute = route.Name
+			if route.CanaryHostname != nil && route.CanaryHostname.ManagedRoute != "" {
+				rpcError := r.removeCanaryHostnameHTTPRoute(gatewayAPIConfig)
+				if rpcError.HasError() {
+					return rpcError
+				}
+			}
 			if !route.UseHeaderRoutes {
 				return pluginTypes.RpcError{}
 			}
-			gatewayAPIConfig.HTTPRoute = route.Name
+			if route.UseDedicatedHeaderRoutes {
+				return r.removeDedicatedHTTPHeaderRoutes(rollout.Spec.Strategy.Canary.TrafficRouting.ManagedRoutes, gatewayAPIConfig)
+			}
 			return r.removeHTTPManagedRoutes(rollout.Spec.Strategy.Canary.TrafficRouting.ManagedRoutes, gatewayAPIConfig)
 		})
 		if rpcError.HasError() {
@@ -174,8 +311,8 @@ func (r *RpcPlugin) RemoveManagedRoutes(rollout *v1alpha1.Rollout) pluginTypes.R
 	}
 	if gatewayAPIConfig.GRPCRoutes != nil {
 		gatewayAPIConfig.ConfigMapRWMutex.Lock()
-		r.LogCtx.Info(fmt.Sprintf("[RemoveManagedRoutes] plugin %q controls GRPCRoutes: %v", PluginName, getGatewayAPIRouteNameList(gatewayAPIConfig.GRPCRoutes)))
-		rpcError := forEachGatewayAPIRoute(gatewayAPIConfig.GRPCRoutes, func(route GRPCRoute) pluginTypes.RpcError {
+		r.LogCtx.Info(fmt.Sprintf("[RemoveManagedRoutes] plugin %q controls GRPCRoutes %v in namespace %q with config map %s/%s", PluginName, getGatewayAPIRouteNameList(gatewayAPIConfig.GRPCRoutes), gatewayAPIConfig.Namespace, gatewayAPIConfig.Namespace, gatewayAPIConfig.ConfigMap))
+		rpcError := forEachGatewayAPIRoute(gatewayAPIConfig.GRPCRoutes, gatewayAPIConfig.Namespace, func(route GRPCRoute) pluginTypes.RpcError {
 			if !route.UseHeaderRoutes {
 				return pluginTypes.RpcError{}
 			}
@@ -195,23 +332,187 @@ func (r *RpcPlugin) Type() string {
 	return Type
 }
 
+// GetGatewayAPITrafficRoutingConfig returns the validated plugin configuration of the rollout
+// in the same way as the plugin reads it during the rollout
+func GetGatewayAPITrafficRoutingConfig(rollout *v1alpha1.Rollout) (*GatewayAPITrafficRouting, error) {
+	return getGatewayAPITrafficRoutingConfig(rollout)
+}
+
 func getGatewayAPITrafficRoutingConfig(rollout *v1alpha1.Rollout) (*GatewayAPITrafficRouting, error) {
 	validate := validator.New(validator.WithRequiredStructEnabled())
+	validate.RegisterTagNameFunc(getJSONFieldName)
 	gatewayAPIConfig := &GatewayAPITrafficRouting{
 		ConfigMap: defaults.ConfigMap,
 	}
-	err := json.Unmarshal(rollout.Spec.Strategy.Canary.TrafficRouting.Plugins[PluginName], &gatewayAPIConfig)
+	err := validate.RegisterValidation("duration", isDuration)
 	if err != nil {
 		return gatewayAPIConfig, err
 	}
+	if rollout.Spec.Strategy.Canary == nil || rollout.Spec.Strategy.Canary.TrafficRouting == nil {
+		if rollout.Spec.Strategy.BlueGreen != nil {
+			return gatewayAPIConfig, errors.New(BlueGreenStrategyIsNotSupportedError)
+		}
+		return gatewayAPIConfig, errors.New(CanaryTrafficRoutingIsEmptyError)
+	}
+	// Misspelled keys would be ignored by json.Unmarshal, so unknown and duplicate fields are rejected
+	strictErrorList, err := kubeJSON.UnmarshalStrict(rollout.Spec.Strategy.Canary.TrafficRouting.Plugins[PluginName], gatewayAPIConfig)
+	if err != nil {
+		return gatewayAPIConfig, getFieldError(err)
+	}
+	if len(strictErrorList) != 0 {
+		configError := &ConfigError{}
+		for _, strictError := range strictErrorList {
+			configError.FieldErrorList = append(configError.FieldErrorList, getConfigFieldError(strictError))
+		}
+		return gatewayAPIConfig, configError
+	}
+	// Without namespace the route and config map clients would be created for all namespaces
+	if gatewayAPIConfig.Namespace == "" {
+		gatewayAPIConfig.Namespace = rollout.Namespace
+	}
 	insertGatewayAPIRouteLists(gatewayAPIConfig)
+	if gatewayAPIConfig.WeightScale == 0 {
+		gatewayAPIConfig.WeightScale = defaults.WeightScale
+	}
+	if gatewayAPIConfig.MaxTrafficWeight == 0 {
+		gatewayAPIConfig.MaxTrafficWeight = defaults.MaxTrafficWeight
+	}
 	err = validate.Struct(gatewayAPIConfig)
 	if err != nil {
-		return gatewayAPIConfig, err
+		return gatewayAPIConfig, getValidationError(err)
 	}
 	return gatewayAPIConfig, err
 }
 
+// isDuration validates fields with durations like "5m"
+func isDuration(fieldLevel validator.FieldLevel) bool {
+	_, err := time.ParseDuration(fieldLevel.Field().String())
+	return err == nil
+}
+
+// getJSONFieldName returns the JSON name of the field, so validation errors refer to the keys of the configuration
+func getJSONFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// getValidationError turns the validator errors into messages with the JSON path of the field,
+// e.g. "httpRoutes[0].name is required"
+func getValidationError(err error) error {
+	var validationErrorList validator.ValidationErrors
+	if !errors.As(err, &validationErrorList) {
+		return err
+	}
+	configError := &ConfigError{}
+	for _, fieldError := range validationErrorList {
+		// The namespace starts with the name of the configuration struct
+		_, path, _ := strings.Cut(fieldError.Namespace(), ".")
+		var message string
+		switch fieldError.Tag() {
+		case "required":
+			message = "is required"
+		case "min":
+			message = fmt.Sprintf("must be at least %s", fieldError.Param())
+		case "max":
+			message = fmt.Sprintf("must be at most %s", fieldError.Param())
+		case "duration":
+			message = "must be a duration like 30s or 5m"
+		case "excluded_with":
+			message = fmt.Sprintf("can't be set together with %s", getJSONPathOfSibling(path, fieldError.Param()))
+		case "excluded_unless":
+			fieldName, value, _ := strings.Cut(fieldError.Param(), " ")
+			message = fmt.Sprintf("can only be set when %s is %s", getJSONPathOfSibling(path, fieldName), value)
+		default:
+			message = fmt.Sprintf("doesn't satisfy %q", fieldError.ActualTag())
+		}
+		configError.FieldErrorList = append(configError.FieldErrorList, ConfigFieldError{
+			Path:    path,
+			Message: fmt.Sprintf("%s %s", path, message),
+		})
+	}
+	return configError
+}
+
+// getFieldError returns decoding errors with the path of the field, like a value of the wrong type, as configuration error
+func getFieldError(err error) error {
+	var fieldError kubeJSON.FieldError
+	if !errors.As(err, &fieldError) {
+		return err
+	}
+	return &ConfigError{
+		FieldErrorList: []ConfigFieldError{getConfigFieldError(fieldError)},
+	}
+}
+
+func getConfigFieldError(err error) ConfigFieldError {
+	configFieldError := ConfigFieldError{
+		Message: err.Error(),
+	}
+	var fieldError kubeJSON.FieldError
+	if errors.As(err, &fieldError) {
+		configFieldError.Path = fieldError.FieldPath()
+	}
+	return configFieldError
+}
+
+// getJSONPathOfSibling returns the path of a field next to the field of the path. The validator
+// refers to it by its Go name, which is turned into the JSON name by lowering the first letter
+func getJSONPathOfSibling(path string, fieldName string) string {
+	jsonName := strings.ToLower(fieldName[:1]) + fieldName[1:]
+	if i := strings.LastIndex(path, "."); i != -1 {
+		return path[:i+1] + jsonName
+	}
+	return jsonName
+}
+
+// getDeprecationWarningList returns the warnings about fields and combinations that still work, but shouldn't be used.
+// It expects the route lists the single routes have already been inserted into
+func getDeprecationWarningList(gatewayAPIConfig *GatewayAPITrafficRouting) []string {
+	var warningList []string
+	if gatewayAPIConfig.HTTPRoute != "" && len(gatewayAPIConfig.HTTPRoutes) > 1 {
+		warningList = append(warningList, fmt.Sprintf(DeprecatedRouteCombinationWarning, "httpRoute", "httpRoutes", "httpRoute", "httpRoutes"))
+	}
+	if gatewayAPIConfig.GRPCRoute != "" && len(gatewayAPIConfig.GRPCRoutes) > 1 {
+		warningList = append(warningList, fmt.Sprintf(DeprecatedRouteCombinationWarning, "grpcRoute", "grpcRoutes", "grpcRoute", "grpcRoutes"))
+	}
+	if gatewayAPIConfig.TCPRoute != "" && len(gatewayAPIConfig.TCPRoutes) > 1 {
+		warningList = append(warningList, fmt.Sprintf(DeprecatedRouteCombinationWarning, "tcpRoute", "tcpRoutes", "tcpRoute", "tcpRoutes"))
+	}
+	if gatewayAPIConfig.UseHeaderRoutes {
+		warningList = append(warningList, DeprecatedUseHeaderRoutesWarning)
+	}
+	return warningList
+}
+
+// GetDeprecationWarningList returns the deprecation warnings of the configuration read by GetGatewayAPITrafficRoutingConfig
+func GetDeprecationWarningList(gatewayAPIConfig *GatewayAPITrafficRouting) []string {
+	return getDeprecationWarningList(gatewayAPIConfig)
+}
+
+// getConfigMapRWMutex returns the mutex of the plugin config map. It is created once per config map,
+// so the rollouts sharing the config map and the garbage collector don't overwrite each other's changes
+func (r *RpcPlugin) getConfigMapRWMutex(namespace string, configMapName string) *sync.RWMutex {
+	configMapRWMutex, _ := r.configMapRWMutexMap.LoadOrStore(getConfigMapKey(namespace, configMapName), &sync.RWMutex{})
+	return configMapRWMutex.(*sync.RWMutex)
+}
+
+// logDeprecationWarnings logs every deprecation warning of a rollout once, because the plugin
+// reads the configuration on every reconciliation
+func (r *RpcPlugin) logDeprecationWarnings(rollout *v1alpha1.Rollout, gatewayAPIConfig *GatewayAPITrafficRouting) {
+	for _, warning := range getDeprecationWarningList(gatewayAPIConfig) {
+		_, isLogged := r.deprecationWarningSet.LoadOrStore(fmt.Sprintf("%s/%s/%s", rollout.Namespace, rollout.Name, warning), true)
+		if !isLogged {
+			r.LogCtx.Warn(fmt.Sprintf("[Rollout %s/%s] %s", rollout.Namespace, rollout.Name, warning))
+		}
+	}
+}
+
 func insertGatewayAPIRouteLists(gatewayAPIConfig *GatewayAPITrafficRouting) {
 	if gatewayAPIConfig.HTTPRoute != "" {
 		gatewayAPIConfig.HTTPRoutes = append(gatewayAPIConfig.HTTPRoutes, HTTPRoute{
@@ -226,69 +527,421 @@ func insertGatewayAPIRouteLists(gatewayAPIConfig *GatewayAPITrafficRouting) {
 		})
 	}
 	if gatewayAPIConfig.TCPRoute != "" {
+		// TCPRoutes don't support header routes
 		gatewayAPIConfig.TCPRoutes = append(gatewayAPIConfig.TCPRoutes, TCPRoute{
-			Name:            gatewayAPIConfig.TCPRoute,
-			UseHeaderRoutes: true,
+			Name: gatewayAPIConfig.TCPRoute,
 		})
 	}
 }
 
-func getRouteRule[T1 GatewayAPIBackendRef, T2 GatewayAPIRouteRule[T1], T3 GatewayAPIRouteRuleList[T1, T2]](routeRuleList T3, backendRefNameList ...string) (T2, error) {
+func getRouteRule[T1 GatewayAPIBackendRef, T2 GatewayAPIRouteRule[T1], T3 GatewayAPIRouteRuleList[T1, T2]](routeRuleList T3, routeNamespace string, backendRefReferenceList ...BackendRefReference) (T2, error) {
 	var backendRef T1
 	var routeRule T2
-	isFound := false
 	for next, hasNext := routeRuleList.Iterator(); hasNext; {
 		routeRule, hasNext = next()
-		_, hasNext := routeRule.Iterator()
-		if !hasNext {
-			continue
-		}
-		for _, backendRefName := range backendRefNameList {
+		isFound := false
+		for _, backendRefReference := range backendRefReferenceList {
 			isFound = false
 			for next, hasNext := routeRule.Iterator(); hasNext; {
 				backendRef, hasNext = next()
-				if backendRefName == backendRef.GetName() {
+				if backendRefReference.IsMatched(backendRef.GetObjectReference(), routeNamespace) {
 					isFound = true
-					continue
+					break
 				}
 			}
 			if !isFound {
 				break
 			}
 		}
-		return routeRule, nil
+		if isFound {
+			return routeRule, nil
+		}
 	}
 	return nil, routeRuleList.Error()
 }
 
-func getBackendRefs[T1 GatewayAPIBackendRef, T2 GatewayAPIRouteRule[T1], T3 GatewayAPIRouteRuleList[T1, T2]](backendRefName string, routeRuleList T3) ([]T1, error) {
+// setBackendRefWeights sets weights of the canary and stable backendRefs rule by rule.
+// When a rule also contains backendRefs of other services, for example when several
+// rollouts share the same rule, only the weight of the canary and stable pair is
+// redistributed, so the sum of the pair stays the same
+func setBackendRefWeights[T1 GatewayAPIBackendRef, T2 GatewayAPIRouteRule[T1], T3 GatewayAPIRouteRuleList[T1, T2]](routeRuleList T3, options BackendRefWeightOptions) error {
 	var backendRef T1
 	var routeRule T2
-	var matchedRefs []T1
+	isCanaryBackendRefFound := false
+	isStableBackendRefFound := false
 	for next, hasNext := routeRuleList.Iterator(); hasNext; {
 		routeRule, hasNext = next()
+		if options.InsertCanaryBackendRef {
+			syncCanaryBackendRef(routeRule, options)
+		}
+		var canaryBackendRefs, stableBackendRefs []T1
+		hasForeignBackendRefs := false
 		for next, hasNext := routeRule.Iterator(); hasNext; {
 			backendRef, hasNext = next()
-			if backendRefName == backendRef.GetName() {
-				matchedRefs = append(matchedRefs, backendRef)
+			switch objectReference := backendRef.GetObjectReference(); {
+			case options.CanaryBackendRef.IsMatched(objectReference, options.RouteNamespace):
+				canaryBackendRefs = append(canaryBackendRefs, backendRef)
+			case options.StableBackendRef.IsMatched(objectReference, options.RouteNamespace):
+				stableBackendRefs = append(stableBackendRefs, backendRef)
+			default:
+				hasForeignBackendRefs = true
+			}
+		}
+		if len(canaryBackendRefs) == 0 && len(stableBackendRefs) == 0 {
+			continue
+		}
+		isCanaryBackendRefFound = isCanaryBackendRefFound || len(canaryBackendRefs) > 0
+		isStableBackendRefFound = isStableBackendRefFound || len(stableBackendRefs) > 0
+		totalWeight := options.WeightScale
+		if hasForeignBackendRefs && len(stableBackendRefs) > 0 {
+			pairWeight := stableBackendRefs[0].GetWeight()
+			if len(canaryBackendRefs) > 0 {
+				pairWeight += canaryBackendRefs[0].GetWeight()
+			}
+			if pairWeight > 0 {
+				totalWeight = pairWeight
 			}
 		}
+		canaryWeight := scaleWeight(options.DesiredWeight, options.MaxTrafficWeight, totalWeight)
+		restWeight := totalWeight - canaryWeight
+		for _, ref := range canaryBackendRefs {
+			ref.SetWeight(canaryWeight)
+		}
+		for _, ref := range stableBackendRefs {
+			ref.SetWeight(restWeight)
+		}
+		// Header rules of the plugin only have the canary backendRef, so their weight is 0 without canary traffic
+		if len(stableBackendRefs) == 0 && !hasForeignBackendRefs {
+			continue
+		}
+		err := validateRouteRuleWeights(routeRule)
+		if err != nil {
+			return err
+		}
 	}
-	if len(matchedRefs) > 0 {
-		return matchedRefs, nil
+	if !isStableBackendRefFound || (!isCanaryBackendRefFound && !options.InsertCanaryBackendRef) {
+		return routeRuleList.Error()
+	}
+	return nil
+}
+
+// syncCanaryBackendRef adds the canary backendRef to the rule with the stable backendRef
+// while the canary receives traffic and removes it again when the canary weight is 0
+func syncCanaryBackendRef[T1 GatewayAPIBackendRef, T2 GatewayAPIRouteRule[T1]](routeRule T2, options BackendRefWeightOptions) {
+	var backendRef, stableBackendRef T1
+	isCanaryBackendRefFound := false
+	for next, hasNext := routeRule.Iterator(); hasNext; {
+		backendRef, hasNext = next()
+		switch objectReference := backendRef.GetObjectReference(); {
+		case options.CanaryBackendRef.IsMatched(objectReference, options.RouteNamespace):
+			isCanaryBackendRefFound = true
+		case options.StableBackendRef.IsMatched(objectReference, options.RouteNamespace):
+			if stableBackendRef == nil {
+				stableBackendRef = backendRef
+			}
+		}
+	}
+	if stableBackendRef == nil {
+		return
+	}
+	if options.DesiredWeight > 0 && !isCanaryBackendRefFound {
+		routeRule.AddBackendRef(stableBackendRef, options.CanaryBackendRef)
+	}
+	if options.DesiredWeight == 0 && isCanaryBackendRefFound {
+		routeRule.RemoveBackendRefs(options.CanaryBackendRef, options.RouteNamespace)
+	}
+}
+
+// syncFilters adds the canary filters to the filter list when they are enabled and removes them otherwise. It returns
+// the indexes of the added filters. The filters added before are removed by their recorded indexes, so they are removed
+// after the canary filters changed and filters of the route itself are kept. Without a record, like for routes changed
+// by earlier versions of the plugin, the filters equal to the canary filters are removed
+func syncFilters[T any](filterList []T, canaryFilterList []T, addedIndexList []int, isRecorded bool, isEnabled bool) ([]T, []int) {
+	syncedFilterList := []T{}
+	for i, filter := range filterList {
+		isCanaryFilter := slices.Contains(addedIndexList, i)
+		if !isRecorded {
+			isCanaryFilter = slices.ContainsFunc(canaryFilterList, func(canaryFilter T) bool {
+				return reflect.DeepEqual(filter, canaryFilter)
+			})
+		}
+		if !isCanaryFilter {
+			syncedFilterList = append(syncedFilterList, filter)
+		}
+	}
+	var syncedIndexList []int
+	if isEnabled {
+		for _, canaryFilter := range canaryFilterList {
+			syncedIndexList = append(syncedIndexList, len(syncedFilterList))
+			syncedFilterList = append(syncedFilterList, canaryFilter)
+		}
+	}
+	if len(syncedFilterList) == 0 {
+		return nil, syncedIndexList
+	}
+	return syncedFilterList, syncedIndexList
+}
+
+// getCanaryFilterMap returns the indexes of the filters the plugin has added by the rule and backendRef indexes
+// of the canary backendRef. It returns false for a route without the annotation
+func getCanaryFilterMap(objectMeta metav1.ObjectMeta) (map[string][]int, bool) {
+	filterMap := make(map[string][]int)
+	rawFilterList, isRecorded := objectMeta.Annotations[CanaryFiltersAnnotation]
+	if rawFilterList == "" {
+		return filterMap, isRecorded
+	}
+	for _, rawFilter := range strings.Split(rawFilterList, ",") {
+		i := strings.LastIndex(rawFilter, "/")
+		if i == -1 {
+			continue
+		}
+		index, err := strconv.Atoi(rawFilter[i+1:])
+		if err == nil {
+			filterMap[rawFilter[:i]] = append(filterMap[rawFilter[:i]], index)
+		}
+	}
+	return filterMap, true
+}
+
+// setCanaryFilterMap records the filters the plugin has added as rule/backendRef/filter indexes in an annotation
+// of the route, so it is updated together with the filters. While canary filters are configured, the annotation
+// is kept even without filters, because a route without it is treated as changed by an earlier version of the plugin
+func setCanaryFilterMap(objectMeta *metav1.ObjectMeta, filterMap map[string][]int, isKept bool) {
+	var rawFilterList []string
+	for backendRefKey, indexList := range filterMap {
+		for _, index := range indexList {
+			rawFilterList = append(rawFilterList, fmt.Sprintf("%s/%d", backendRefKey, index))
+		}
+	}
+	if len(rawFilterList) == 0 && !isKept {
+		delete(objectMeta.Annotations, CanaryFiltersAnnotation)
+		return
+	}
+	slices.Sort(rawFilterList)
+	if objectMeta.Annotations == nil {
+		objectMeta.Annotations = make(map[string]string)
+	}
+	objectMeta.Annotations[CanaryFiltersAnnotation] = strings.Join(rawFilterList, ",")
+}
+
+func getCanaryFilterKey(ruleIndex int, backendRefIndex int) string {
+	return fmt.Sprintf("%d/%d", ruleIndex, backendRefIndex)
+}
+
+// syncSessionPersistence returns the session persistence of a weighted rule and whether the plugin has set it.
+// The configured session persistence is set while the canary gets traffic, unless the rule has its own.
+// It is removed only from rules the plugin has set it on, as long as it wasn't changed since then
+func syncSessionPersistence(sessionPersistence *gatewayv1.SessionPersistence, canarySessionPersistence *gatewayv1.SessionPersistence, isSetByPlugin bool, isEnabled bool) (*gatewayv1.SessionPersistence, bool) {
+	switch {
+	case isEnabled && canarySessionPersistence != nil && (sessionPersistence == nil || isSetByPlugin):
+		return canarySessionPersistence.DeepCopy(), true
+	case !isSetByPlugin:
+		return sessionPersistence, false
+	case canarySessionPersistence == nil || isSessionPersistenceEqual(sessionPersistence, canarySessionPersistence):
+		return nil, false
+	}
+	return sessionPersistence, false
+}
+
+// isSessionPersistenceEqual compares the session persistences after applying the defaults of Gateway API,
+// because the API server sets them on the route, but they are usually left out in the plugin configuration
+func isSessionPersistenceEqual(sessionPersistence *gatewayv1.SessionPersistence, otherSessionPersistence *gatewayv1.SessionPersistence) bool {
+	return reflect.DeepEqual(withSessionPersistenceDefaults(sessionPersistence), withSessionPersistenceDefaults(otherSessionPersistence))
+}
+
+func withSessionPersistenceDefaults(sessionPersistence *gatewayv1.SessionPersistence) *gatewayv1.SessionPersistence {
+	if sessionPersistence == nil {
+		return nil
+	}
+	sessionPersistence = sessionPersistence.DeepCopy()
+	if sessionPersistence.Type == nil {
+		sessionPersistenceType := gatewayv1.CookieBasedSessionPersistence
+		sessionPersistence.Type = &sessionPersistenceType
+	}
+	if sessionPersistence.CookieConfig != nil && sessionPersistence.CookieConfig.LifetimeType == nil {
+		lifetimeType := gatewayv1.SessionCookieLifetimeType
+		sessionPersistence.CookieConfig.LifetimeType = &lifetimeType
+	}
+	return sessionPersistence
+}
+
+// getSessionPersistenceRuleSet returns the indexes of the rules the plugin has set the session persistence on
+func getSessionPersistenceRuleSet(objectMeta metav1.ObjectMeta) map[int]bool {
+	ruleSet := make(map[int]bool)
+	for _, rawIndex := range strings.Split(objectMeta.Annotations[SessionPersistenceRulesAnnotation], ",") {
+		index, err := strconv.Atoi(rawIndex)
+		if err == nil {
+			ruleSet[index] = true
+		}
+	}
+	return ruleSet
+}
+
+// setSessionPersistenceRuleSet records the indexes of the rules the plugin has set the session persistence on
+// in an annotation of the route, so it is updated together with the rules
+func setSessionPersistenceRuleSet(objectMeta *metav1.ObjectMeta, ruleSet map[int]bool) {
+	if len(ruleSet) == 0 {
+		delete(objectMeta.Annotations, SessionPersistenceRulesAnnotation)
+		return
+	}
+	var indexList []int
+	for index := range ruleSet {
+		indexList = append(indexList, index)
+	}
+	slices.Sort(indexList)
+	var rawIndexList []string
+	for _, index := range indexList {
+		rawIndexList = append(rawIndexList, strconv.Itoa(index))
+	}
+	if objectMeta.Annotations == nil {
+		objectMeta.Annotations = make(map[string]string)
+	}
+	objectMeta.Annotations[SessionPersistenceRulesAnnotation] = strings.Join(rawIndexList, ",")
+}
+
+// scaleWeight maps the weight out of maxWeight onto totalWeight.
+// The result is rounded half up, so the same input always gives the same weight
+func scaleWeight(weight int32, maxWeight int32, totalWeight int32) int32 {
+	if weight <= 0 {
+		return 0
+	}
+	if weight >= maxWeight {
+		return totalWeight
+	}
+	scaledWeight := (2*int64(weight)*int64(totalWeight) + int64(maxWeight)) / (2 * int64(maxWeight))
+	return int32(scaledWeight)
+}
+
+func validateRouteRuleWeights[T1 GatewayAPIBackendRef, T2 GatewayAPIRouteRule[T1]](routeRule T2) error {
+	var backendRef T1
+	var ruleWeight int64
+	for next, hasNext := routeRule.Iterator(); hasNext; {
+		backendRef, hasNext = next()
+		weight := backendRef.GetWeight()
+		if weight < 0 || weight > defaults.MaxBackendRefWeight {
+			return fmt.Errorf(InvalidBackendRefWeightError, backendRef.GetName(), weight, defaults.MaxBackendRefWeight)
+		}
+		ruleWeight += int64(weight)
+	}
+	if ruleWeight == 0 {
+		return errors.New(RouteRuleWeightIsZeroError)
+	}
+	return nil
+}
+
+// getServiceNames returns names of the services that currently act as canary and stable.
+// In ping-pong mode the stable service is taken from the rollout status, the ping service
+// is stable until the rollout status says otherwise
+func getServiceNames(rollout *v1alpha1.Rollout) (string, string) {
+	canaryStrategy := rollout.Spec.Strategy.Canary
+	if canaryStrategy.PingPong == nil {
+		return canaryStrategy.CanaryService, canaryStrategy.StableService
+	}
+	if rollout.Status.Canary.StablePingPong == v1alpha1.PPPong {
+		return canaryStrategy.PingPong.PingService, canaryStrategy.PingPong.PongService
+	}
+	return canaryStrategy.PingPong.PongService, canaryStrategy.PingPong.PingService
+}
+
+// GetServiceNames returns names of the services that currently act as canary and stable
+// in the same way as the plugin reads them during the rollout
+func GetServiceNames(rollout *v1alpha1.Rollout) (string, string) {
+	return getServiceNames(rollout)
+}
+
+// getBackendRefReference returns the reference to backendRefs of the service with the given name.
+// backendRefReference holds group, kind, namespace and port configured for the service, if any
+func getBackendRefReference(name string, backendRefReference *BackendRefReference) BackendRefReference {
+	var reference BackendRefReference
+	if backendRefReference != nil {
+		reference = *backendRefReference
+	}
+	reference.Name = name
+	return reference
+}
+
+// GetBackendRefReference returns the reference to backendRefs of the service in the same way
+// as the plugin matches them during the rollout
+func GetBackendRefReference(name string, backendRefReference *BackendRefReference) BackendRefReference {
+	return getBackendRefReference(name, backendRefReference)
+}
+
+// IsMatched checks the backendRef refers to the same object. The defaults of Gateway API are used
+// for the fields that aren't set: core group, Service kind and the namespace of the route.
+// Port is compared only when it is set in the reference
+func (r BackendRefReference) IsMatched(objectReference gatewayv1.BackendObjectReference, routeNamespace string) bool {
+	if r.Name != string(objectReference.Name) {
+		return false
+	}
+	group := ""
+	if objectReference.Group != nil {
+		group = string(*objectReference.Group)
+	}
+	kind := ServiceKind
+	if objectReference.Kind != nil {
+		kind = string(*objectReference.Kind)
+	}
+	namespace := routeNamespace
+	if objectReference.Namespace != nil {
+		namespace = string(*objectReference.Namespace)
+	}
+	referenceKind := r.Kind
+	if referenceKind == "" {
+		referenceKind = ServiceKind
+	}
+	referenceNamespace := r.Namespace
+	if referenceNamespace == "" {
+		referenceNamespace = routeNamespace
+	}
+	if r.Group != group || referenceKind != kind || referenceNamespace != namespace {
+		return false
+	}
+	return r.Port == nil || (objectReference.Port != nil && *r.Port == *objectReference.Port)
+}
+
+// Apply sets name and the configured group, kind, namespace and port of the reference
+// to the object reference
+func (r BackendRefReference) Apply(objectReference *gatewayv1.BackendObjectReference) {
+	objectReference.Name = gatewayv1.ObjectName(r.Name)
+	if r.Group != "" {
+		group := gatewayv1.Group(r.Group)
+		objectReference.Group = &group
+	}
+	if r.Kind != "" {
+		kind := gatewayv1.Kind(r.Kind)
+		objectReference.Kind = &kind
+	}
+	if r.Namespace != "" {
+		namespace := gatewayv1.Namespace(r.Namespace)
+		objectReference.Namespace = &namespace
+	}
+	if r.Port != nil {
+		port := *r.Port
+		objectReference.Port = &port
+	}
+}
+
+func getRolloutOwnerReference(rollout *v1alpha1.Rollout) metav1.OwnerReference {
+	return metav1.OwnerReference{
+		APIVersion: v1alpha1.SchemeGroupVersion.String(),
+		Kind:       RolloutKind,
+		Name:       rollout.Name,
+		UID:        rollout.UID,
 	}
-	return nil, routeRuleList.Error()
 }
 
 func isConfigHasRoutes(config *GatewayAPITrafficRouting) bool {
 	return len(config.HTTPRoutes) > 0 || len(config.TCPRoutes) > 0 || len(config.GRPCRoutes) > 0
 }
 
-func forEachGatewayAPIRoute[T1 GatewayAPIRoute](routeList []T1, fn func(route T1) pluginTypes.RpcError) pluginTypes.RpcError {
+// forEachGatewayAPIRoute calls fn for every route. The error of a route is prefixed with its kind, namespace and name
+func forEachGatewayAPIRoute[T1 GatewayAPIRoute](routeList []T1, namespace string, fn func(route T1) pluginTypes.RpcError) pluginTypes.RpcError {
 	var err pluginTypes.RpcError
 	for _, route := range routeList {
 		if err = fn(route); err.HasError() {
-			return err
+			return pluginTypes.RpcError{
+				ErrorString: fmt.Sprintf(RouteError, route.GetKind(), namespace, route.GetName(), err.ErrorString),
+			}
 		}
 	}
 	return pluginTypes.RpcError{}
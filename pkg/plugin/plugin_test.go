@@ -3,20 +3,32 @@ package plugin
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/internal/defaults"
 	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/internal/utils"
 	"github.com/argoproj-labs/rollouts-plugin-trafficrouter-gatewayapi/pkg/mocks"
 	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+	rolloutsFake "github.com/argoproj/argo-rollouts/pkg/client/clientset/versioned/fake"
 	rolloutsPlugin "github.com/argoproj/argo-rollouts/rollout/trafficrouting/plugin/rpc"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	kubeErrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	kubeTesting "k8s.io/client-go/testing"
 	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
 
 	log "github.com/sirupsen/logrus"
 	gwFake "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned/fake"
+	gatewayApiClientv1 "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned/typed/apis/v1"
 
 	goPlugin "github.com/hashicorp/go-plugin"
 )
@@ -250,6 +262,1690 @@ func TestRunSuccessfully(t *testing.T) {
 	<-closeCh
 }
 
+func TestSetDedicatedHTTPHeaderRoute(t *testing.T) {
+	headerValue := "test"
+	httpRouteClient := gwFake.NewSimpleClientset(&mocks.HTTPRouteObj).GatewayV1().HTTPRoutes(mocks.RolloutNamespace)
+	rpcPluginImp := &RpcPlugin{
+		LogCtx:          utils.SetupLog(),
+		IsTest:          true,
+		HTTPRouteClient: httpRouteClient,
+	}
+	headerRouting := v1alpha1.SetHeaderRoute{
+		Name: mocks.ManagedRouteName,
+		Match: []v1alpha1.HeaderRoutingMatch{
+			{
+				HeaderName: "X-Test",
+				HeaderValue: &v1alpha1.StringMatch{
+					Exact: headerValue,
+				},
+			},
+		},
+	}
+	rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+		Namespace: mocks.RolloutNamespace,
+		HTTPRoutes: []HTTPRoute{
+			{
+				Name:                     mocks.HTTPRouteName,
+				UseHeaderRoutes:          true,
+				UseDedicatedHeaderRoutes: true,
+			},
+		},
+	})
+	dedicatedHTTPRouteName := getDedicatedHTTPHeaderRouteName(mocks.HTTPRouteName, mocks.ManagedRouteName)
+
+	rpcError := rpcPluginImp.SetHeaderRoute(rollout, &headerRouting)
+
+	assert.Empty(t, rpcError.Error())
+	dedicatedHTTPRoute, err := httpRouteClient.Get(context.TODO(), dedicatedHTTPRouteName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, ManagedByLabelValue, dedicatedHTTPRoute.Labels[ManagedByLabel])
+	assert.Equal(t, RolloutKind, dedicatedHTTPRoute.OwnerReferences[0].Kind)
+	assert.Equal(t, getRolloutKey(rollout), dedicatedHTTPRoute.Annotations[RolloutAnnotation])
+	assert.Equal(t, headerValue, dedicatedHTTPRoute.Spec.Rules[0].Matches[0].Headers[0].Value)
+	assert.Equal(t, gatewayv1.ObjectName(mocks.CanaryServiceName), dedicatedHTTPRoute.Spec.Rules[0].BackendRefs[0].Name)
+	httpRoute, err := httpRouteClient.Get(context.TODO(), mocks.HTTPRouteName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(httpRoute.Spec.Rules))
+
+	rpcError = rpcPluginImp.RemoveManagedRoutes(rollout)
+
+	assert.Empty(t, rpcError.Error())
+	_, err = httpRouteClient.Get(context.TODO(), dedicatedHTTPRouteName, metav1.GetOptions{})
+	assert.True(t, kubeErrors.IsNotFound(err))
+}
+
+func TestDedicatedHTTPHeaderRouteIsNotManaged(t *testing.T) {
+	dedicatedHTTPRouteName := getDedicatedHTTPHeaderRouteName(mocks.HTTPRouteName, mocks.ManagedRouteName)
+	unmanagedHTTPRoute := mocks.HTTPRouteObj.DeepCopy()
+	unmanagedHTTPRoute.Name = dedicatedHTTPRouteName
+	httpRouteClient := gwFake.NewSimpleClientset(&mocks.HTTPRouteObj, unmanagedHTTPRoute).GatewayV1().HTTPRoutes(mocks.RolloutNamespace)
+	rpcPluginImp := &RpcPlugin{
+		LogCtx:          utils.SetupLog(),
+		IsTest:          true,
+		HTTPRouteClient: httpRouteClient,
+	}
+	headerRouting := v1alpha1.SetHeaderRoute{
+		Name: mocks.ManagedRouteName,
+		Match: []v1alpha1.HeaderRoutingMatch{
+			{
+				HeaderName: "X-Test",
+				HeaderValue: &v1alpha1.StringMatch{
+					Exact: "test",
+				},
+			},
+		},
+	}
+	rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+		Namespace: mocks.RolloutNamespace,
+		HTTPRoutes: []HTTPRoute{
+			{
+				Name:                     mocks.HTTPRouteName,
+				UseHeaderRoutes:          true,
+				UseDedicatedHeaderRoutes: true,
+			},
+		},
+	})
+
+	rpcError := rpcPluginImp.SetHeaderRoute(rollout, &headerRouting)
+
+	assert.ErrorContains(t, rpcError, fmt.Sprintf("HTTPRoute %s/%s already exists, but it wasn't created by the plugin", mocks.RolloutNamespace, dedicatedHTTPRouteName))
+
+	rpcError = rpcPluginImp.RemoveManagedRoutes(rollout)
+
+	assert.ErrorContains(t, rpcError, "wasn't created by the plugin")
+	httpRoute, err := httpRouteClient.Get(context.TODO(), dedicatedHTTPRouteName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, unmanagedHTTPRoute.Spec, httpRoute.Spec)
+}
+
+func TestDedicatedHTTPHeaderRouteCollidesWithCanaryHostname(t *testing.T) {
+	canaryHostnameHTTPRoute := mocks.HTTPRouteObj.DeepCopy()
+	canaryHostnameHTTPRoute.Name = getCanaryHostnameHTTPRouteName(mocks.HTTPRouteName)
+	canaryHostnameHTTPRoute.Labels = map[string]string{
+		ManagedByLabel: ManagedByLabelValue,
+	}
+	canaryHostnameHTTPRoute.Annotations = map[string]string{
+		SourceAnnotation: getCanaryHostnameHTTPRouteSource(mocks.HTTPRouteName),
+	}
+	httpRouteClient := gwFake.NewSimpleClientset(&mocks.HTTPRouteObj, canaryHostnameHTTPRoute).GatewayV1().HTTPRoutes(mocks.RolloutNamespace)
+	rpcPluginImp := &RpcPlugin{
+		LogCtx:          utils.SetupLog(),
+		IsTest:          true,
+		HTTPRouteClient: httpRouteClient,
+	}
+	// The dedicated HTTPRoute of this managed route gets the name of the canary hostname HTTPRoute
+	headerRouting := v1alpha1.SetHeaderRoute{
+		Name: "canary-hostname",
+		Match: []v1alpha1.HeaderRoutingMatch{
+			{
+				HeaderName: "X-Test",
+				HeaderValue: &v1alpha1.StringMatch{
+					Exact: "test",
+				},
+			},
+		},
+	}
+	rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+		Namespace: mocks.RolloutNamespace,
+		HTTPRoutes: []HTTPRoute{
+			{
+				Name:                     mocks.HTTPRouteName,
+				UseHeaderRoutes:          true,
+				UseDedicatedHeaderRoutes: true,
+			},
+		},
+	})
+
+	rpcError := rpcPluginImp.SetHeaderRoute(rollout, &headerRouting)
+
+	assert.ErrorContains(t, rpcError, fmt.Sprintf("HTTPRoute %s/%s was created by the plugin for %q", mocks.RolloutNamespace, canaryHostnameHTTPRoute.Name, getCanaryHostnameHTTPRouteSource(mocks.HTTPRouteName)))
+
+	headerRouting.Match = nil
+	rpcError = rpcPluginImp.SetHeaderRoute(rollout, &headerRouting)
+
+	assert.ErrorContains(t, rpcError, "isn't deleted")
+	httpRoute, err := httpRouteClient.Get(context.TODO(), canaryHostnameHTTPRoute.Name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, canaryHostnameHTTPRoute.Spec, httpRoute.Spec)
+}
+
+func TestSetCanaryHostnameHTTPRoute(t *testing.T) {
+	httpRoute := mocks.HTTPRouteObj.DeepCopy()
+	httpRoute.Spec.Hostnames = []gatewayv1.Hostname{"example.com", "*.example.com"}
+	httpRouteClient := gwFake.NewSimpleClientset(httpRoute).GatewayV1().HTTPRoutes(mocks.RolloutNamespace)
+	rpcPluginImp := &RpcPlugin{
+		LogCtx:          utils.SetupLog(),
+		IsTest:          true,
+		HTTPRouteClient: httpRouteClient,
+		TestClientset:   fake.NewSimpleClientset(&mocks.ConfigMapObj).CoreV1().ConfigMaps(mocks.RolloutNamespace),
+	}
+	canaryHostnameHTTPRouteName := getCanaryHostnameHTTPRouteName(mocks.HTTPRouteName)
+	t.Run("ManagedRoute", func(t *testing.T) {
+		headerRouting := v1alpha1.SetHeaderRoute{
+			Name: mocks.ManagedRouteName,
+			Match: []v1alpha1.HeaderRoutingMatch{
+				{
+					HeaderName: "X-Test",
+					HeaderValue: &v1alpha1.StringMatch{
+						Exact: "test",
+					},
+				},
+			},
+		}
+		rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+			Namespace: mocks.RolloutNamespace,
+			HTTPRoutes: []HTTPRoute{
+				{
+					Name: mocks.HTTPRouteName,
+					CanaryHostname: &CanaryHostname{
+						Prefix:       "canary.",
+						ManagedRoute: mocks.ManagedRouteName,
+					},
+				},
+			},
+		})
+
+		rpcError := rpcPluginImp.SetHeaderRoute(rollout, &headerRouting)
+
+		assert.Empty(t, rpcError.Error())
+		canaryHostnameHTTPRoute, err := httpRouteClient.Get(context.TODO(), canaryHostnameHTTPRouteName, metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []gatewayv1.Hostname{"canary.example.com"}, canaryHostnameHTTPRoute.Spec.Hostnames)
+		assert.Equal(t, gatewayv1.ObjectName(mocks.CanaryServiceName), canaryHostnameHTTPRoute.Spec.Rules[0].BackendRefs[0].Name)
+		assert.Empty(t, canaryHostnameHTTPRoute.Spec.Rules[0].Matches)
+
+		rpcError = rpcPluginImp.RemoveManagedRoutes(rollout)
+
+		assert.Empty(t, rpcError.Error())
+		_, err = httpRouteClient.Get(context.TODO(), canaryHostnameHTTPRouteName, metav1.GetOptions{})
+		assert.True(t, kubeErrors.IsNotFound(err))
+	})
+	t.Run("RolloutLifetime", func(t *testing.T) {
+		rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+			Namespace: mocks.RolloutNamespace,
+			HTTPRoutes: []HTTPRoute{
+				{
+					Name: mocks.HTTPRouteName,
+					CanaryHostname: &CanaryHostname{
+						Prefix: "canary.",
+					},
+				},
+			},
+		})
+
+		rpcError := rpcPluginImp.SetWeight(rollout, 0, []v1alpha1.WeightDestination{})
+
+		assert.Empty(t, rpcError.Error())
+		canaryHostnameHTTPRoute, err := httpRouteClient.Get(context.TODO(), canaryHostnameHTTPRouteName, metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, RolloutKind, canaryHostnameHTTPRoute.OwnerReferences[0].Kind)
+
+		rpcError = rpcPluginImp.RemoveManagedRoutes(rollout)
+
+		assert.Empty(t, rpcError.Error())
+		_, err = httpRouteClient.Get(context.TODO(), canaryHostnameHTTPRouteName, metav1.GetOptions{})
+		assert.NoError(t, err)
+	})
+	t.Run("NotManagedByPlugin", func(t *testing.T) {
+		unmanagedHTTPRoute := mocks.HTTPRouteObj.DeepCopy()
+		unmanagedHTTPRoute.Name = canaryHostnameHTTPRouteName
+		httpRouteClient := gwFake.NewSimpleClientset(httpRoute, unmanagedHTTPRoute).GatewayV1().HTTPRoutes(mocks.RolloutNamespace)
+		rpcPluginImp := &RpcPlugin{
+			LogCtx:          utils.SetupLog(),
+			IsTest:          true,
+			HTTPRouteClient: httpRouteClient,
+		}
+		rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+			Namespace: mocks.RolloutNamespace,
+			HTTPRoutes: []HTTPRoute{
+				{
+					Name: mocks.HTTPRouteName,
+					CanaryHostname: &CanaryHostname{
+						Prefix: "canary.",
+					},
+				},
+			},
+		})
+
+		rpcError := rpcPluginImp.SetWeight(rollout, 0, []v1alpha1.WeightDestination{})
+
+		assert.ErrorContains(t, rpcError, "wasn't created by the plugin")
+
+		rollout.Spec.Strategy.Canary.TrafficRouting.Plugins[PluginName] = json.RawMessage(fmt.Sprintf(`{"httpRoutes": [{"name": %q, "canaryHostname": {"prefix": "canary.", "managedRoute": %q}}]}`, mocks.HTTPRouteName, mocks.ManagedRouteName))
+		rpcError = rpcPluginImp.RemoveManagedRoutes(rollout)
+
+		assert.ErrorContains(t, rpcError, "wasn't created by the plugin")
+		canaryHostnameHTTPRoute, err := httpRouteClient.Get(context.TODO(), canaryHostnameHTTPRouteName, metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, unmanagedHTTPRoute.Spec, canaryHostnameHTTPRoute.Spec)
+	})
+}
+
+func TestGetHTTPHeaderRouteRuleWithManagedRouteMatches(t *testing.T) {
+	queryParamName := gatewayv1.HTTPHeaderName("canary")
+	queryParamValue := "true"
+	headerRouting := v1alpha1.SetHeaderRoute{
+		Name: mocks.ManagedRouteName,
+		Match: []v1alpha1.HeaderRoutingMatch{
+			{
+				HeaderName: "X-Test",
+				HeaderValue: &v1alpha1.StringMatch{
+					Exact: "test",
+				},
+			},
+		},
+	}
+	rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+		Namespace: mocks.RolloutNamespace,
+		HTTPRoute: mocks.HTTPRouteName,
+		ManagedRoutes: map[string]ManagedRoute{
+			mocks.ManagedRouteName: {
+				QueryParams: []gatewayv1.HTTPQueryParamMatch{
+					{
+						Name:  queryParamName,
+						Value: queryParamValue,
+					},
+				},
+				Cookies: []CookieMatch{
+					{
+						Name:  "canary",
+						Value: "1",
+					},
+				},
+			},
+		},
+	})
+	gatewayAPIConfig, err := getGatewayAPITrafficRoutingConfig(rollout)
+	assert.NoError(t, err)
+
+	httpHeaderRouteRule, rpcError := getHTTPHeaderRouteRule(rollout, &headerRouting, &mocks.HTTPRouteObj, gatewayAPIConfig)
+
+	assert.Empty(t, rpcError.Error())
+	assert.Equal(t, 3, len(httpHeaderRouteRule.Matches))
+	assert.Equal(t, queryParamName, httpHeaderRouteRule.Matches[1].QueryParams[0].Name)
+	assert.Equal(t, queryParamValue, httpHeaderRouteRule.Matches[1].QueryParams[0].Value)
+	cookieHeaderMatch := httpHeaderRouteRule.Matches[2].Headers[0]
+	assert.Equal(t, gatewayv1.HTTPHeaderName(CookieHeaderName), cookieHeaderMatch.Name)
+	assert.Regexp(t, cookieHeaderMatch.Value, "session=abc; canary=1")
+	assert.NotRegexp(t, cookieHeaderMatch.Value, "session=abc; canary=10")
+}
+
+func TestGetHTTPHeaderRouteRuleWithOriginalMatches(t *testing.T) {
+	headerRouting := v1alpha1.SetHeaderRoute{
+		Name: mocks.ManagedRouteName,
+		Match: []v1alpha1.HeaderRoutingMatch{
+			{
+				HeaderName: "X-Test",
+				HeaderValue: &v1alpha1.StringMatch{
+					Exact: "test",
+				},
+			},
+		},
+	}
+	rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+		Namespace: mocks.RolloutNamespace,
+		HTTPRoute: mocks.HTTPRouteName,
+	})
+	gatewayAPIConfig, err := getGatewayAPITrafficRoutingConfig(rollout)
+	assert.NoError(t, err)
+	t.Run("MethodAndHeaders", func(t *testing.T) {
+		method := gatewayv1.HTTPMethodPost
+		httpRoute := mocks.HTTPRouteObj.DeepCopy()
+		httpRoute.Spec.Rules[0].Matches = []gatewayv1.HTTPRouteMatch{
+			{
+				Method: &method,
+				Headers: []gatewayv1.HTTPHeaderMatch{
+					{
+						Name:  "X-Tenant",
+						Value: "demo",
+					},
+				},
+			},
+		}
+
+		httpHeaderRouteRule, rpcError := getHTTPHeaderRouteRule(rollout, &headerRouting, httpRoute, gatewayAPIConfig)
+
+		assert.Empty(t, rpcError.Error())
+		assert.Equal(t, 1, len(httpHeaderRouteRule.Matches))
+		assert.Equal(t, &method, httpHeaderRouteRule.Matches[0].Method)
+		headers := httpHeaderRouteRule.Matches[0].Headers
+		assert.Equal(t, 2, len(headers))
+		assert.Equal(t, gatewayv1.HTTPHeaderName("X-Tenant"), headers[0].Name)
+		assert.Equal(t, gatewayv1.HTTPHeaderName("X-Test"), headers[1].Name)
+		assert.Equal(t, "test", headers[1].Value)
+		assert.Equal(t, 1, len(httpRoute.Spec.Rules[0].Matches[0].Headers))
+	})
+	t.Run("ConflictingHeader", func(t *testing.T) {
+		httpRoute := mocks.HTTPRouteObj.DeepCopy()
+		httpRoute.Spec.Rules[0].Matches = []gatewayv1.HTTPRouteMatch{
+			{
+				Headers: []gatewayv1.HTTPHeaderMatch{
+					{
+						Name:  "x-test",
+						Value: "original",
+					},
+				},
+			},
+		}
+
+		httpHeaderRouteRule, rpcError := getHTTPHeaderRouteRule(rollout, &headerRouting, httpRoute, gatewayAPIConfig)
+
+		assert.Equal(t, fmt.Sprintf(HeaderMatchConflictError, "x-test"), rpcError.Error())
+		assert.Nil(t, httpHeaderRouteRule)
+	})
+	t.Run("NoMatches", func(t *testing.T) {
+		httpRoute := mocks.HTTPRouteObj.DeepCopy()
+		httpRoute.Spec.Rules[0].Matches = nil
+
+		httpHeaderRouteRule, rpcError := getHTTPHeaderRouteRule(rollout, &headerRouting, httpRoute, gatewayAPIConfig)
+
+		assert.Empty(t, rpcError.Error())
+		assert.Equal(t, 1, len(httpHeaderRouteRule.Matches))
+		assert.Equal(t, 1, len(httpHeaderRouteRule.Matches[0].Headers))
+		assert.Nil(t, httpHeaderRouteRule.Matches[0].Path)
+	})
+}
+
+func TestGetHTTPHeaderRouteRuleWithCanaryTimeouts(t *testing.T) {
+	requestTimeout := gatewayv1.Duration("30s")
+	headerRouting := v1alpha1.SetHeaderRoute{
+		Name: mocks.ManagedRouteName,
+		Match: []v1alpha1.HeaderRoutingMatch{
+			{
+				HeaderName: "X-Test",
+				HeaderValue: &v1alpha1.StringMatch{
+					Exact: "test",
+				},
+			},
+		},
+	}
+	rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+		Namespace: mocks.RolloutNamespace,
+		HTTPRoute: mocks.HTTPRouteName,
+		CanaryTimeouts: &gatewayv1.HTTPRouteTimeouts{
+			Request: &requestTimeout,
+		},
+	})
+	gatewayAPIConfig, err := getGatewayAPITrafficRoutingConfig(rollout)
+	assert.NoError(t, err)
+
+	httpHeaderRouteRule, rpcError := getHTTPHeaderRouteRule(rollout, &headerRouting, &mocks.HTTPRouteObj, gatewayAPIConfig)
+
+	assert.Empty(t, rpcError.Error())
+	assert.Equal(t, requestTimeout, *httpHeaderRouteRule.Timeouts.Request)
+	assert.Nil(t, httpHeaderRouteRule.Timeouts.BackendRequest)
+	assert.Nil(t, mocks.HTTPRouteObj.Spec.Rules[0].Timeouts)
+}
+
+func TestGetGRPCHeaderRouteRuleWithManagedRouteMethods(t *testing.T) {
+	service := "payments.v1.Refund"
+	headerRouting := v1alpha1.SetHeaderRoute{
+		Name: mocks.ManagedRouteName,
+		Match: []v1alpha1.HeaderRoutingMatch{
+			{
+				HeaderName: "X-Test",
+				HeaderValue: &v1alpha1.StringMatch{
+					Exact: "test",
+				},
+			},
+		},
+	}
+	rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+		Namespace: mocks.RolloutNamespace,
+		GRPCRoute: mocks.GRPCRouteName,
+		ManagedRoutes: map[string]ManagedRoute{
+			mocks.ManagedRouteName: {
+				GRPCMethods: []gatewayv1.GRPCMethodMatch{
+					{
+						Service: &service,
+					},
+				},
+			},
+		},
+	})
+	gatewayAPIConfig, err := getGatewayAPITrafficRoutingConfig(rollout)
+	assert.NoError(t, err)
+
+	grpcHeaderRouteRule, rpcError := getGRPCHeaderRouteRule(rollout, &headerRouting, &mocks.GRPCRouteObj, gatewayAPIConfig)
+
+	assert.Empty(t, rpcError.Error())
+	assert.Equal(t, 1, len(grpcHeaderRouteRule.Matches))
+	assert.Equal(t, service, *grpcHeaderRouteRule.Matches[0].Method.Service)
+	assert.Nil(t, grpcHeaderRouteRule.Matches[0].Method.Method)
+	assert.Equal(t, gatewayv1.GRPCHeaderName("X-Test"), grpcHeaderRouteRule.Matches[0].Headers[0].Name)
+}
+
+func TestGetGRPCHeaderRouteRuleWithOriginalMethods(t *testing.T) {
+	refundService := "payments.v1.Refund"
+	chargeService := "payments.v1.Charge"
+	getMethod := "Get"
+	headerRouting := v1alpha1.SetHeaderRoute{
+		Name: mocks.ManagedRouteName,
+		Match: []v1alpha1.HeaderRoutingMatch{
+			{
+				HeaderName: "X-Test",
+				HeaderValue: &v1alpha1.StringMatch{
+					Exact: "test",
+				},
+			},
+		},
+	}
+	newGatewayAPIConfig := func(grpcMethodMatchList ...gatewayv1.GRPCMethodMatch) (*v1alpha1.Rollout, *GatewayAPITrafficRouting) {
+		rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+			Namespace: mocks.RolloutNamespace,
+			GRPCRoute: mocks.GRPCRouteName,
+			ManagedRoutes: map[string]ManagedRoute{
+				mocks.ManagedRouteName: {
+					GRPCMethods: grpcMethodMatchList,
+				},
+			},
+		})
+		gatewayAPIConfig, err := getGatewayAPITrafficRoutingConfig(rollout)
+		assert.NoError(t, err)
+		return rollout, gatewayAPIConfig
+	}
+	newGRPCRoute := func(grpcMethodMatch gatewayv1.GRPCMethodMatch) *gatewayv1.GRPCRoute {
+		grpcRoute := mocks.GRPCRouteObj.DeepCopy()
+		grpcRoute.Spec.Rules[0].Matches = []gatewayv1.GRPCRouteMatch{
+			{
+				Method: &grpcMethodMatch,
+			},
+		}
+		return grpcRoute
+	}
+	t.Run("Intersected", func(t *testing.T) {
+		rollout, gatewayAPIConfig := newGatewayAPIConfig(
+			gatewayv1.GRPCMethodMatch{
+				Method: &getMethod,
+			},
+			gatewayv1.GRPCMethodMatch{
+				Service: &chargeService,
+			},
+		)
+
+		grpcHeaderRouteRule, rpcError := getGRPCHeaderRouteRule(rollout, &headerRouting, newGRPCRoute(gatewayv1.GRPCMethodMatch{
+			Service: &refundService,
+		}), gatewayAPIConfig)
+
+		assert.Empty(t, rpcError.Error())
+		assert.Equal(t, 1, len(grpcHeaderRouteRule.Matches))
+		assert.Equal(t, refundService, *grpcHeaderRouteRule.Matches[0].Method.Service)
+		assert.Equal(t, getMethod, *grpcHeaderRouteRule.Matches[0].Method.Method)
+	})
+	t.Run("NotRouted", func(t *testing.T) {
+		rollout, gatewayAPIConfig := newGatewayAPIConfig(gatewayv1.GRPCMethodMatch{
+			Service: &chargeService,
+		})
+
+		grpcHeaderRouteRule, rpcError := getGRPCHeaderRouteRule(rollout, &headerRouting, newGRPCRoute(gatewayv1.GRPCMethodMatch{
+			Service: &refundService,
+		}), gatewayAPIConfig)
+
+		assert.Equal(t, fmt.Sprintf(GRPCMethodsAreNotRoutedError, mocks.ManagedRouteName, mocks.GRPCRouteName), rpcError.Error())
+		assert.Nil(t, grpcHeaderRouteRule)
+	})
+	t.Run("RegularExpression", func(t *testing.T) {
+		regularExpressionService := "payments\\.v1\\..*"
+		methodMatchType := gatewayv1.GRPCMethodMatchRegularExpression
+		rollout, gatewayAPIConfig := newGatewayAPIConfig(gatewayv1.GRPCMethodMatch{
+			Service: &refundService,
+		})
+
+		grpcHeaderRouteRule, rpcError := getGRPCHeaderRouteRule(rollout, &headerRouting, newGRPCRoute(gatewayv1.GRPCMethodMatch{
+			Type:    &methodMatchType,
+			Service: &regularExpressionService,
+		}), gatewayAPIConfig)
+
+		assert.Equal(t, fmt.Sprintf(GRPCMethodMatchIntersectionError, mocks.ManagedRouteName, GRPCMethodMatchRegularExpressionError), rpcError.Error())
+		assert.Nil(t, grpcHeaderRouteRule)
+	})
+}
+
+func TestSetHTTPRouteWeightWithCanaryFilters(t *testing.T) {
+	httpRouteClient := gwFake.NewSimpleClientset(&mocks.HTTPRouteObj).GatewayV1().HTTPRoutes(mocks.RolloutNamespace)
+	rpcPluginImp := &RpcPlugin{
+		LogCtx:          utils.SetupLog(),
+		IsTest:          true,
+		HTTPRouteClient: httpRouteClient,
+	}
+	canaryFilter := gatewayv1.HTTPRouteFilter{
+		Type: gatewayv1.HTTPRouteFilterRequestHeaderModifier,
+		RequestHeaderModifier: &gatewayv1.HTTPHeaderFilter{
+			Set: []gatewayv1.HTTPHeader{
+				{
+					Name:  "x-rollout-version",
+					Value: "canary",
+				},
+			},
+		},
+	}
+	rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+		Namespace: mocks.RolloutNamespace,
+		HTTPRoute: mocks.HTTPRouteName,
+		CanaryFilters: CanaryFilters{
+			HTTP: []gatewayv1.HTTPRouteFilter{canaryFilter},
+		},
+	})
+
+	rpcError := rpcPluginImp.SetWeight(rollout, 30, []v1alpha1.WeightDestination{})
+
+	assert.Empty(t, rpcError.Error())
+	backendRefList := rpcPluginImp.UpdatedHTTPRouteMock.Spec.Rules[0].BackendRefs
+	assert.Empty(t, backendRefList[0].Filters)
+	assert.Equal(t, []gatewayv1.HTTPRouteFilter{canaryFilter}, backendRefList[1].Filters)
+
+	rpcError = rpcPluginImp.SetWeight(rollout, 30, []v1alpha1.WeightDestination{})
+
+	assert.Empty(t, rpcError.Error())
+	assert.Equal(t, 1, len(rpcPluginImp.UpdatedHTTPRouteMock.Spec.Rules[0].BackendRefs[1].Filters))
+
+	rpcError = rpcPluginImp.SetWeight(rollout, 0, []v1alpha1.WeightDestination{})
+
+	assert.Empty(t, rpcError.Error())
+	assert.Empty(t, rpcPluginImp.UpdatedHTTPRouteMock.Spec.Rules[0].BackendRefs[1].Filters)
+}
+
+func TestSetHTTPRouteWeightWithChangedCanaryFilters(t *testing.T) {
+	newCanaryFilter := func(value string) gatewayv1.HTTPRouteFilter {
+		return gatewayv1.HTTPRouteFilter{
+			Type: gatewayv1.HTTPRouteFilterRequestHeaderModifier,
+			RequestHeaderModifier: &gatewayv1.HTTPHeaderFilter{
+				Set: []gatewayv1.HTTPHeader{
+					{
+						Name:  "x-rollout-version",
+						Value: value,
+					},
+				},
+			},
+		}
+	}
+	newRolloutWithCanaryFilters := func(canaryFilterList []gatewayv1.HTTPRouteFilter) *v1alpha1.Rollout {
+		return newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+			Namespace: mocks.RolloutNamespace,
+			HTTPRoute: mocks.HTTPRouteName,
+			CanaryFilters: CanaryFilters{
+				HTTP: canaryFilterList,
+			},
+		})
+	}
+	routeFilter := newCanaryFilter("route")
+	httpRoute := mocks.HTTPRouteObj.DeepCopy()
+	httpRoute.Spec.Rules[0].BackendRefs[1].Filters = []gatewayv1.HTTPRouteFilter{routeFilter}
+	rpcPluginImp := &RpcPlugin{
+		LogCtx:          utils.SetupLog(),
+		IsTest:          true,
+		HTTPRouteClient: gwFake.NewSimpleClientset(httpRoute).GatewayV1().HTTPRoutes(mocks.RolloutNamespace),
+	}
+
+	rpcError := rpcPluginImp.SetWeight(newRolloutWithCanaryFilters([]gatewayv1.HTTPRouteFilter{newCanaryFilter("canary")}), 30, []v1alpha1.WeightDestination{})
+
+	assert.Empty(t, rpcError.Error())
+	assert.Equal(t, []gatewayv1.HTTPRouteFilter{routeFilter, newCanaryFilter("canary")}, rpcPluginImp.UpdatedHTTPRouteMock.Spec.Rules[0].BackendRefs[1].Filters)
+	assert.Equal(t, "0/1/1", rpcPluginImp.UpdatedHTTPRouteMock.Annotations[CanaryFiltersAnnotation])
+
+	rollout := newRolloutWithCanaryFilters([]gatewayv1.HTTPRouteFilter{newCanaryFilter("next"), routeFilter})
+	rpcError = rpcPluginImp.SetWeight(rollout, 30, []v1alpha1.WeightDestination{})
+
+	assert.Empty(t, rpcError.Error())
+	assert.Equal(t, []gatewayv1.HTTPRouteFilter{routeFilter, newCanaryFilter("next"), routeFilter}, rpcPluginImp.UpdatedHTTPRouteMock.Spec.Rules[0].BackendRefs[1].Filters)
+	assert.Equal(t, "0/1/1,0/1/2", rpcPluginImp.UpdatedHTTPRouteMock.Annotations[CanaryFiltersAnnotation])
+
+	rpcError = rpcPluginImp.SetWeight(rollout, 0, []v1alpha1.WeightDestination{})
+
+	assert.Empty(t, rpcError.Error())
+	assert.Equal(t, []gatewayv1.HTTPRouteFilter{routeFilter}, rpcPluginImp.UpdatedHTTPRouteMock.Spec.Rules[0].BackendRefs[1].Filters)
+	assert.Equal(t, "", rpcPluginImp.UpdatedHTTPRouteMock.Annotations[CanaryFiltersAnnotation])
+
+	rpcError = rpcPluginImp.SetWeight(newRolloutWithCanaryFilters(nil), 0, []v1alpha1.WeightDestination{})
+
+	assert.Empty(t, rpcError.Error())
+	assert.Equal(t, []gatewayv1.HTTPRouteFilter{routeFilter}, rpcPluginImp.UpdatedHTTPRouteMock.Spec.Rules[0].BackendRefs[1].Filters)
+	assert.NotContains(t, rpcPluginImp.UpdatedHTTPRouteMock.Annotations, CanaryFiltersAnnotation)
+}
+
+func TestSetHTTPRouteWeightWithCanaryFiltersAndHeaderRoute(t *testing.T) {
+	rpcPluginImp := &RpcPlugin{
+		LogCtx:          utils.SetupLog(),
+		IsTest:          true,
+		HTTPRouteClient: gwFake.NewSimpleClientset(&mocks.HTTPRouteObj).GatewayV1().HTTPRoutes(mocks.RolloutNamespace),
+		TestClientset:   fake.NewSimpleClientset(&mocks.ConfigMapObj).CoreV1().ConfigMaps(mocks.RolloutNamespace),
+	}
+	canaryFilter := gatewayv1.HTTPRouteFilter{
+		Type: gatewayv1.HTTPRouteFilterRequestHeaderModifier,
+		RequestHeaderModifier: &gatewayv1.HTTPHeaderFilter{
+			Add: []gatewayv1.HTTPHeader{
+				{
+					Name:  "x-rollout-version",
+					Value: "canary",
+				},
+			},
+		},
+	}
+	rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+		Namespace: mocks.RolloutNamespace,
+		HTTPRoute: mocks.HTTPRouteName,
+		ConfigMap: mocks.ConfigMapName,
+		CanaryFilters: CanaryFilters{
+			HTTP: []gatewayv1.HTTPRouteFilter{canaryFilter},
+		},
+	})
+	headerRouting := v1alpha1.SetHeaderRoute{
+		Name: mocks.ManagedRouteName,
+		Match: []v1alpha1.HeaderRoutingMatch{
+			{
+				HeaderName: "X-Test",
+				HeaderValue: &v1alpha1.StringMatch{
+					Exact: "test",
+				},
+			},
+		},
+	}
+
+	rpcError := rpcPluginImp.SetHeaderRoute(rollout, &headerRouting)
+	assert.False(t, rpcError.HasError())
+	rpcError = rpcPluginImp.SetWeight(rollout, 30, []v1alpha1.WeightDestination{})
+
+	assert.False(t, rpcError.HasError())
+	headerRouteRule := rpcPluginImp.UpdatedHTTPRouteMock.Spec.Rules[1]
+	assert.Equal(t, []gatewayv1.HTTPRouteFilter{canaryFilter}, headerRouteRule.Filters)
+	assert.Empty(t, headerRouteRule.BackendRefs[0].Filters)
+	assert.Equal(t, []gatewayv1.HTTPRouteFilter{canaryFilter}, rpcPluginImp.UpdatedHTTPRouteMock.Spec.Rules[0].BackendRefs[1].Filters)
+}
+
+func TestSetHTTPRouteWeightWithSessionPersistence(t *testing.T) {
+	sessionName := "canary-session"
+	newRpcPlugin := func(httpRoute *gatewayv1.HTTPRoute) (*RpcPlugin, gatewayApiClientv1.HTTPRouteInterface) {
+		httpRouteClient := gwFake.NewSimpleClientset(httpRoute).GatewayV1().HTTPRoutes(mocks.RolloutNamespace)
+		return &RpcPlugin{
+			LogCtx:          utils.SetupLog(),
+			IsTest:          true,
+			HTTPRouteClient: httpRouteClient,
+		}, httpRouteClient
+	}
+	newRolloutWithSessionPersistence := func(sessionPersistence *gatewayv1.SessionPersistence) *v1alpha1.Rollout {
+		return newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+			Namespace:          mocks.RolloutNamespace,
+			HTTPRoute:          mocks.HTTPRouteName,
+			SessionPersistence: sessionPersistence,
+		})
+	}
+	t.Run("SetAndRemoved", func(t *testing.T) {
+		rpcPluginImp, _ := newRpcPlugin(&mocks.HTTPRouteObj)
+		sessionPersistenceType := gatewayv1.CookieBasedSessionPersistence
+		sessionPersistence := &gatewayv1.SessionPersistence{
+			SessionName: &sessionName,
+			Type:        &sessionPersistenceType,
+		}
+		rollout := newRolloutWithSessionPersistence(sessionPersistence)
+
+		rpcError := rpcPluginImp.SetWeight(rollout, 30, []v1alpha1.WeightDestination{})
+
+		assert.Empty(t, rpcError.Error())
+		assert.Equal(t, sessionPersistence, rpcPluginImp.UpdatedHTTPRouteMock.Spec.Rules[0].SessionPersistence)
+		assert.Equal(t, "0", rpcPluginImp.UpdatedHTTPRouteMock.Annotations[SessionPersistenceRulesAnnotation])
+
+		rpcError = rpcPluginImp.SetWeight(rollout, 0, []v1alpha1.WeightDestination{})
+
+		assert.Empty(t, rpcError.Error())
+		assert.Nil(t, rpcPluginImp.UpdatedHTTPRouteMock.Spec.Rules[0].SessionPersistence)
+		assert.NotContains(t, rpcPluginImp.UpdatedHTTPRouteMock.Annotations, SessionPersistenceRulesAnnotation)
+	})
+	t.Run("RemovedWithDefaults", func(t *testing.T) {
+		rpcPluginImp, httpRouteClient := newRpcPlugin(&mocks.HTTPRouteObj)
+		rollout := newRolloutWithSessionPersistence(&gatewayv1.SessionPersistence{
+			SessionName: &sessionName,
+		})
+
+		rpcError := rpcPluginImp.SetWeight(rollout, 30, []v1alpha1.WeightDestination{})
+		assert.Empty(t, rpcError.Error())
+		// The API server sets the default type
+		httpRoute := rpcPluginImp.UpdatedHTTPRouteMock
+		sessionPersistenceType := gatewayv1.CookieBasedSessionPersistence
+		httpRoute.Spec.Rules[0].SessionPersistence.Type = &sessionPersistenceType
+		_, err := httpRouteClient.Update(context.TODO(), httpRoute, metav1.UpdateOptions{})
+		assert.NoError(t, err)
+		rpcError = rpcPluginImp.SetWeight(rollout, 0, []v1alpha1.WeightDestination{})
+
+		assert.Empty(t, rpcError.Error())
+		assert.Nil(t, rpcPluginImp.UpdatedHTTPRouteMock.Spec.Rules[0].SessionPersistence)
+	})
+	t.Run("OwnSessionPersistenceIsKept", func(t *testing.T) {
+		sessionPersistence := &gatewayv1.SessionPersistence{
+			SessionName: &sessionName,
+		}
+		httpRoute := mocks.HTTPRouteObj.DeepCopy()
+		httpRoute.Spec.Rules[0].SessionPersistence = sessionPersistence.DeepCopy()
+		rpcPluginImp, _ := newRpcPlugin(httpRoute)
+		rollout := newRolloutWithSessionPersistence(sessionPersistence)
+
+		rpcError := rpcPluginImp.SetWeight(rollout, 30, []v1alpha1.WeightDestination{})
+
+		assert.Empty(t, rpcError.Error())
+		assert.NotContains(t, rpcPluginImp.UpdatedHTTPRouteMock.Annotations, SessionPersistenceRulesAnnotation)
+
+		rpcError = rpcPluginImp.SetWeight(rollout, 0, []v1alpha1.WeightDestination{})
+
+		assert.Empty(t, rpcError.Error())
+		assert.Equal(t, sessionPersistence, rpcPluginImp.UpdatedHTTPRouteMock.Spec.Rules[0].SessionPersistence)
+	})
+	t.Run("ChangedSessionPersistenceIsKept", func(t *testing.T) {
+		rpcPluginImp, httpRouteClient := newRpcPlugin(&mocks.HTTPRouteObj)
+		rollout := newRolloutWithSessionPersistence(&gatewayv1.SessionPersistence{
+			SessionName: &sessionName,
+		})
+
+		rpcError := rpcPluginImp.SetWeight(rollout, 30, []v1alpha1.WeightDestination{})
+		assert.Empty(t, rpcError.Error())
+		httpRoute := rpcPluginImp.UpdatedHTTPRouteMock
+		changedSessionName := "changed-session"
+		httpRoute.Spec.Rules[0].SessionPersistence.SessionName = &changedSessionName
+		_, err := httpRouteClient.Update(context.TODO(), httpRoute, metav1.UpdateOptions{})
+		assert.NoError(t, err)
+		rpcError = rpcPluginImp.SetWeight(rollout, 0, []v1alpha1.WeightDestination{})
+
+		assert.Empty(t, rpcError.Error())
+		assert.Equal(t, changedSessionName, *rpcPluginImp.UpdatedHTTPRouteMock.Spec.Rules[0].SessionPersistence.SessionName)
+	})
+}
+
+func TestCollectGarbage(t *testing.T) {
+	newRpcPlugin := func(rolloutList ...*v1alpha1.Rollout) (*RpcPlugin, *v1.ConfigMap) {
+		httpRoute := mocks.HTTPRouteObj.DeepCopy()
+		httpRoute.Spec.Rules = append(httpRoute.Spec.Rules, gatewayv1.HTTPRouteRule{
+			BackendRefs: httpRoute.Spec.Rules[0].BackendRefs[1:],
+		})
+		configMap := &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      defaults.ConfigMap,
+				Namespace: mocks.RolloutNamespace,
+				Labels: map[string]string{
+					ManagedByLabel: ManagedByLabelValue,
+				},
+			},
+			Data: map[string]string{
+				HTTPConfigMapKey: `{"` + mocks.ManagedRouteName + `":{"` + mocks.HTTPRouteName + `":1}}`,
+			},
+		}
+		rolloutsClientset := rolloutsFake.NewSimpleClientset()
+		for _, rollout := range rolloutList {
+			_, err := rolloutsClientset.ArgoprojV1alpha1().Rollouts(rollout.Namespace).Create(context.TODO(), rollout, metav1.CreateOptions{})
+			assert.NoError(t, err)
+		}
+		return &RpcPlugin{
+			LogCtx:            utils.SetupLog(),
+			IsTest:            true,
+			HTTPRouteClient:   gwFake.NewSimpleClientset(httpRoute).GatewayV1().HTTPRoutes(mocks.RolloutNamespace),
+			TestClientset:     fake.NewSimpleClientset(configMap).CoreV1().ConfigMaps(mocks.RolloutNamespace),
+			RolloutsClientset: rolloutsClientset,
+		}, configMap
+	}
+	t.Run("OrphanedManagedRoute", func(t *testing.T) {
+		rpcPluginImp, configMap := newRpcPlugin()
+		removedTotal := testutil.ToFloat64(OrphanedManagedRoutesRemovedTotal.WithLabelValues(HTTPRouteKind))
+
+		err := rpcPluginImp.collectGarbage(context.TODO())
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(rpcPluginImp.UpdatedHTTPRouteMock.Spec.Rules))
+		updatedConfigMap, err := rpcPluginImp.TestClientset.Get(context.TODO(), configMap.Name, metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "{}", updatedConfigMap.Data[HTTPConfigMapKey])
+		assert.Equal(t, removedTotal+1, testutil.ToFloat64(OrphanedManagedRoutesRemovedTotal.WithLabelValues(HTTPRouteKind)))
+	})
+	t.Run("LiveManagedRoute", func(t *testing.T) {
+		rpcPluginImp, configMap := newRpcPlugin(newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+			Namespace: mocks.RolloutNamespace,
+			HTTPRoute: mocks.HTTPRouteName,
+		}))
+
+		err := rpcPluginImp.collectGarbage(context.TODO())
+
+		assert.NoError(t, err)
+		assert.Nil(t, rpcPluginImp.UpdatedHTTPRouteMock)
+		updatedConfigMap, err := rpcPluginImp.TestClientset.Get(context.TODO(), configMap.Name, metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, configMap.Data, updatedConfigMap.Data)
+	})
+	t.Run("InvalidRolloutConfig", func(t *testing.T) {
+		rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{})
+		rollout.Spec.Strategy.Canary.TrafficRouting.Plugins[PluginName] = json.RawMessage(`{"httpRoutes":[{"nmae":"route"}]}`)
+		rpcPluginImp, configMap := newRpcPlugin(rollout)
+
+		err := rpcPluginImp.collectGarbage(context.TODO())
+
+		assert.NoError(t, err)
+		assert.Nil(t, rpcPluginImp.UpdatedHTTPRouteMock)
+		updatedConfigMap, err := rpcPluginImp.TestClientset.Get(context.TODO(), configMap.Name, metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, configMap.Data, updatedConfigMap.Data)
+	})
+	t.Run("InvalidRolloutConfigWithOtherConfigMap", func(t *testing.T) {
+		rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{})
+		rollout.Spec.Strategy.Canary.TrafficRouting.Plugins[PluginName] = json.RawMessage(`{"configMap":"other","httpRoutes":[{"nmae":"route"}]}`)
+		rpcPluginImp, configMap := newRpcPlugin(rollout)
+
+		err := rpcPluginImp.collectGarbage(context.TODO())
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(rpcPluginImp.UpdatedHTTPRouteMock.Spec.Rules))
+		updatedConfigMap, err := rpcPluginImp.TestClientset.Get(context.TODO(), configMap.Name, metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "{}", updatedConfigMap.Data[HTTPConfigMapKey])
+	})
+	t.Run("OrphanedWeightGuardrailState", func(t *testing.T) {
+		rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+			Namespace: mocks.RolloutNamespace,
+			HTTPRoute: mocks.HTTPRouteName,
+		})
+		rpcPluginImp, configMap := newRpcPlugin(rollout)
+		configMap.Data[WeightGuardrailsConfigMapKey] = `{"` + getRolloutKey(rollout) + `":{"weight":10},"` + mocks.RolloutNamespace + `/deleted":{"weight":20}}`
+		_, err := rpcPluginImp.TestClientset.Update(context.TODO(), configMap, metav1.UpdateOptions{})
+		assert.NoError(t, err)
+
+		err = rpcPluginImp.collectGarbage(context.TODO())
+
+		assert.NoError(t, err)
+		updatedConfigMap, err := rpcPluginImp.TestClientset.Get(context.TODO(), configMap.Name, metav1.GetOptions{})
+		assert.NoError(t, err)
+		stateMap := make(WeightGuardrailStateMap)
+		err = utils.GetConfigMapData(updatedConfigMap, WeightGuardrailsConfigMapKey, &stateMap)
+		assert.NoError(t, err)
+		assert.Len(t, stateMap, 1)
+		assert.Contains(t, stateMap, getRolloutKey(rollout))
+	})
+	t.Run("UnlabeledConfigMap", func(t *testing.T) {
+		rpcPluginImp, configMap := newRpcPlugin()
+		configMap.Labels = nil
+		_, err := rpcPluginImp.TestClientset.Update(context.TODO(), configMap, metav1.UpdateOptions{})
+		assert.NoError(t, err)
+
+		err = rpcPluginImp.collectGarbage(context.TODO())
+
+		assert.NoError(t, err)
+		assert.Nil(t, rpcPluginImp.UpdatedHTTPRouteMock)
+	})
+	t.Run("BrokenConfigMap", func(t *testing.T) {
+		rpcPluginImp, configMap := newRpcPlugin()
+		_, err := rpcPluginImp.TestClientset.Create(context.TODO(), &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "broken-configmap",
+				Namespace: mocks.RolloutNamespace,
+				Labels: map[string]string{
+					ManagedByLabel: ManagedByLabelValue,
+				},
+			},
+			Data: map[string]string{
+				HTTPConfigMapKey: "{",
+			},
+		}, metav1.CreateOptions{})
+		assert.NoError(t, err)
+
+		err = rpcPluginImp.collectGarbage(context.TODO())
+
+		assert.NoError(t, err)
+		updatedConfigMap, err := rpcPluginImp.TestClientset.Get(context.TODO(), configMap.Name, metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "{}", updatedConfigMap.Data[HTTPConfigMapKey])
+	})
+	t.Run("OrphanedHTTPRoute", func(t *testing.T) {
+		rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+			Namespace: mocks.RolloutNamespace,
+			HTTPRoute: mocks.HTTPRouteName,
+		})
+		rpcPluginImp, _ := newRpcPlugin(rollout)
+		newHTTPRoute := func(name string, labels map[string]string, rolloutKey string) {
+			_, err := rpcPluginImp.HTTPRouteClient.Create(context.TODO(), &gatewayv1.HTTPRoute{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: mocks.RolloutNamespace,
+					Labels:    labels,
+					Annotations: map[string]string{
+						RolloutAnnotation: rolloutKey,
+					},
+				},
+			}, metav1.CreateOptions{})
+			assert.NoError(t, err)
+		}
+		managedByLabels := map[string]string{
+			ManagedByLabel: ManagedByLabelValue,
+		}
+		newHTTPRoute("orphaned-route", managedByLabels, mocks.RolloutNamespace+"/deleted")
+		newHTTPRoute("live-route", managedByLabels, getRolloutKey(rollout))
+		newHTTPRoute("user-route", nil, mocks.RolloutNamespace+"/deleted")
+		removedTotal := testutil.ToFloat64(OrphanedHTTPRoutesRemovedTotal)
+
+		err := rpcPluginImp.collectGarbage(context.TODO())
+
+		assert.NoError(t, err)
+		_, err = rpcPluginImp.HTTPRouteClient.Get(context.TODO(), "orphaned-route", metav1.GetOptions{})
+		assert.True(t, kubeErrors.IsNotFound(err))
+		_, err = rpcPluginImp.HTTPRouteClient.Get(context.TODO(), "live-route", metav1.GetOptions{})
+		assert.NoError(t, err)
+		_, err = rpcPluginImp.HTTPRouteClient.Get(context.TODO(), "user-route", metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, removedTotal+1, testutil.ToFloat64(OrphanedHTTPRoutesRemovedTotal))
+	})
+	t.Run("DryRun", func(t *testing.T) {
+		rpcPluginImp, _ := newRpcPlugin()
+		rpcPluginImp.CommandLineOpts.GarbageCollectorDryRun = true
+
+		err := rpcPluginImp.collectGarbage(context.TODO())
+
+		assert.NoError(t, err)
+		assert.Nil(t, rpcPluginImp.UpdatedHTTPRouteMock)
+	})
+}
+
+func TestSetWeightAfterSetHeaderRoute(t *testing.T) {
+	rpcPluginImp := &RpcPlugin{
+		LogCtx:          utils.SetupLog(),
+		IsTest:          true,
+		HTTPRouteClient: gwFake.NewSimpleClientset(&mocks.HTTPRouteObj).GatewayV1().HTTPRoutes(mocks.RolloutNamespace),
+		TestClientset:   fake.NewSimpleClientset(&mocks.ConfigMapObj).CoreV1().ConfigMaps(mocks.RolloutNamespace),
+	}
+	rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+		Namespace: mocks.RolloutNamespace,
+		HTTPRoute: mocks.HTTPRouteName,
+		ConfigMap: mocks.ConfigMapName,
+	})
+	headerMatch := v1alpha1.StringMatch{
+		Exact: "test",
+	}
+	headerRouting := v1alpha1.SetHeaderRoute{
+		Name: mocks.ManagedRouteName,
+		Match: []v1alpha1.HeaderRoutingMatch{
+			{
+				HeaderName:  "X-Test",
+				HeaderValue: &headerMatch,
+			},
+		},
+	}
+
+	rpcError := rpcPluginImp.SetWeight(rollout, 0, []v1alpha1.WeightDestination{})
+	assert.False(t, rpcError.HasError())
+	rpcError = rpcPluginImp.SetHeaderRoute(rollout, &headerRouting)
+	assert.False(t, rpcError.HasError())
+	rpcError = rpcPluginImp.SetWeight(rollout, 0, []v1alpha1.WeightDestination{})
+
+	assert.False(t, rpcError.HasError(), rpcError.ErrorString)
+	assert.Len(t, rpcPluginImp.UpdatedHTTPRouteMock.Spec.Rules, 2)
+	assert.Equal(t, int32(100), *rpcPluginImp.UpdatedHTTPRouteMock.Spec.Rules[0].BackendRefs[0].Weight)
+}
+
+func TestSetBackendRefWeightsInSharedRouteRule(t *testing.T) {
+	firstRolloutWeight := int32(30)
+	secondRolloutWeight := int32(70)
+	routeRuleList := HTTPRouteRuleList{
+		{
+			BackendRefs: []gatewayv1.HTTPBackendRef{
+				newHTTPBackendRef("first-stable", firstRolloutWeight),
+				newHTTPBackendRef("first-canary", 0),
+				newHTTPBackendRef("second-stable", secondRolloutWeight),
+				newHTTPBackendRef("second-canary", 0),
+			},
+		},
+	}
+
+	options := BackendRefWeightOptions{
+		CanaryBackendRef: BackendRefReference{Name: "first-canary"},
+		StableBackendRef: BackendRefReference{Name: "first-stable"},
+		DesiredWeight:    50,
+		MaxTrafficWeight: defaults.MaxTrafficWeight,
+		WeightScale:      defaults.WeightScale,
+	}
+	err := setBackendRefWeights(routeRuleList, options)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(15), *routeRuleList[0].BackendRefs[0].Weight)
+	assert.Equal(t, int32(15), *routeRuleList[0].BackendRefs[1].Weight)
+	assert.Equal(t, secondRolloutWeight, *routeRuleList[0].BackendRefs[2].Weight)
+	assert.Equal(t, int32(0), *routeRuleList[0].BackendRefs[3].Weight)
+
+	options.DesiredWeight = 0
+	err = setBackendRefWeights(routeRuleList, options)
+
+	assert.NoError(t, err)
+	assert.Equal(t, firstRolloutWeight, *routeRuleList[0].BackendRefs[0].Weight)
+	assert.Equal(t, int32(0), *routeRuleList[0].BackendRefs[1].Weight)
+}
+
+func TestSetBackendRefWeightsWithWeightScale(t *testing.T) {
+	routeRuleList := HTTPRouteRuleList{
+		{
+			BackendRefs: []gatewayv1.HTTPBackendRef{
+				newHTTPBackendRef(mocks.StableServiceName, 0),
+				newHTTPBackendRef(mocks.CanaryServiceName, 0),
+			},
+		},
+	}
+
+	err := setBackendRefWeights(routeRuleList, BackendRefWeightOptions{
+		CanaryBackendRef: BackendRefReference{Name: mocks.CanaryServiceName},
+		StableBackendRef: BackendRefReference{Name: mocks.StableServiceName},
+		DesiredWeight:    1,
+		MaxTrafficWeight: 1000,
+		WeightScale:      10000,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(9990), *routeRuleList[0].BackendRefs[0].Weight)
+	assert.Equal(t, int32(10), *routeRuleList[0].BackendRefs[1].Weight)
+	assert.Equal(t, int32(1), scaleWeight(1, 200, 100))
+	assert.Equal(t, int32(0), scaleWeight(1, 300, 100))
+}
+
+func TestSetBackendRefWeightsWithCanaryBackendRefInsertion(t *testing.T) {
+	port := gatewayv1.PortNumber(8080)
+	stableBackendRef := newHTTPBackendRef(mocks.StableServiceName, 100)
+	stableBackendRef.Port = &port
+	routeRuleList := HTTPRouteRuleList{
+		{
+			BackendRefs: []gatewayv1.HTTPBackendRef{stableBackendRef},
+		},
+	}
+	options := BackendRefWeightOptions{
+		CanaryBackendRef:       BackendRefReference{Name: mocks.CanaryServiceName},
+		StableBackendRef:       BackendRefReference{Name: mocks.StableServiceName},
+		DesiredWeight:          20,
+		MaxTrafficWeight:       defaults.MaxTrafficWeight,
+		WeightScale:            defaults.WeightScale,
+		InsertCanaryBackendRef: true,
+	}
+
+	err := setBackendRefWeights(routeRuleList, options)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(routeRuleList[0].BackendRefs))
+	assert.Equal(t, int32(80), *routeRuleList[0].BackendRefs[0].Weight)
+	assert.Equal(t, gatewayv1.ObjectName(mocks.CanaryServiceName), routeRuleList[0].BackendRefs[1].Name)
+	assert.Equal(t, port, *routeRuleList[0].BackendRefs[1].Port)
+	assert.Equal(t, int32(20), *routeRuleList[0].BackendRefs[1].Weight)
+
+	options.DesiredWeight = 0
+	err = setBackendRefWeights(routeRuleList, options)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(routeRuleList[0].BackendRefs))
+	assert.Equal(t, int32(100), *routeRuleList[0].BackendRefs[0].Weight)
+}
+
+func TestEnsureHTTPRouteFromTemplate(t *testing.T) {
+	hostname := gatewayv1.Hostname("example.com")
+	rpcPluginImp := &RpcPlugin{
+		LogCtx:          utils.SetupLog(),
+		IsTest:          true,
+		HTTPRouteClient: gwFake.NewSimpleClientset().GatewayV1().HTTPRoutes(mocks.RolloutNamespace),
+		TestClientset:   fake.NewSimpleClientset().CoreV1().ConfigMaps(mocks.RolloutNamespace),
+	}
+	route := HTTPRoute{
+		Name: mocks.HTTPRouteName,
+		Template: &HTTPRouteTemplate{
+			ParentRefs: []gatewayv1.ParentReference{
+				{
+					Name: "gateway",
+				},
+			},
+			Hostnames: []gatewayv1.Hostname{hostname},
+			Port:      80,
+		},
+	}
+	rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+		Namespace:  mocks.RolloutNamespace,
+		HTTPRoutes: []HTTPRoute{route},
+	})
+	gatewayAPIConfig, err := getGatewayAPITrafficRoutingConfig(rollout)
+	assert.NoError(t, err)
+	gatewayAPIConfig.HTTPRoute = route.Name
+
+	rpcError := rpcPluginImp.ensureHTTPRoute(rollout, route, gatewayAPIConfig)
+
+	assert.Empty(t, rpcError.Error())
+	createdHTTPRoute := rpcPluginImp.UpdatedHTTPRouteMock
+	assert.Equal(t, RolloutKind, createdHTTPRoute.OwnerReferences[0].Kind)
+	assert.Equal(t, hostname, createdHTTPRoute.Spec.Hostnames[0])
+	assert.Equal(t, gatewayv1.ObjectName(mocks.StableServiceName), createdHTTPRoute.Spec.Rules[0].BackendRefs[0].Name)
+	assert.Equal(t, gatewayv1.ObjectName(mocks.CanaryServiceName), createdHTTPRoute.Spec.Rules[0].BackendRefs[1].Name)
+
+	rpcError = rpcPluginImp.setHTTPRouteWeight(rollout, 10, gatewayAPIConfig)
+
+	assert.Empty(t, rpcError.Error())
+	assert.Equal(t, int32(10), *rpcPluginImp.UpdatedHTTPRouteMock.Spec.Rules[0].BackendRefs[1].Weight)
+}
+
+func TestSetBackendRefWeightsWithBackendRefKind(t *testing.T) {
+	serviceImportGroup := gatewayv1.Group("multicluster.x-k8s.io")
+	serviceImportKind := gatewayv1.Kind("ServiceImport")
+	stableServiceImportBackendRef := newHTTPBackendRef(mocks.StableServiceName, 0)
+	stableServiceImportBackendRef.Group = &serviceImportGroup
+	stableServiceImportBackendRef.Kind = &serviceImportKind
+	canaryServiceImportBackendRef := newHTTPBackendRef(mocks.CanaryServiceName, 0)
+	canaryServiceImportBackendRef.Group = &serviceImportGroup
+	canaryServiceImportBackendRef.Kind = &serviceImportKind
+	routeRuleList := HTTPRouteRuleList{
+		{
+			BackendRefs: []gatewayv1.HTTPBackendRef{
+				newHTTPBackendRef(mocks.StableServiceName, 50),
+				stableServiceImportBackendRef,
+				canaryServiceImportBackendRef,
+			},
+		},
+	}
+
+	err := setBackendRefWeights(routeRuleList, BackendRefWeightOptions{
+		CanaryBackendRef: getBackendRefReference(mocks.CanaryServiceName, &BackendRefReference{
+			Group: string(serviceImportGroup),
+			Kind:  string(serviceImportKind),
+		}),
+		StableBackendRef: getBackendRefReference(mocks.StableServiceName, &BackendRefReference{
+			Group: string(serviceImportGroup),
+			Kind:  string(serviceImportKind),
+		}),
+		RouteNamespace:   mocks.RolloutNamespace,
+		DesiredWeight:    40,
+		MaxTrafficWeight: defaults.MaxTrafficWeight,
+		WeightScale:      defaults.WeightScale,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(50), *routeRuleList[0].BackendRefs[0].Weight)
+	assert.Equal(t, int32(60), *routeRuleList[0].BackendRefs[1].Weight)
+	assert.Equal(t, int32(40), *routeRuleList[0].BackendRefs[2].Weight)
+}
+
+func TestGetGatewayAPITrafficRoutingConfigWithBlueGreenStrategy(t *testing.T) {
+	rollout := &v1alpha1.Rollout{
+		Spec: v1alpha1.RolloutSpec{
+			Strategy: v1alpha1.RolloutStrategy{
+				BlueGreen: &v1alpha1.BlueGreenStrategy{
+					ActiveService:  mocks.StableServiceName,
+					PreviewService: mocks.CanaryServiceName,
+				},
+			},
+		},
+	}
+
+	_, err := getGatewayAPITrafficRoutingConfig(rollout)
+
+	assert.EqualError(t, err, BlueGreenStrategyIsNotSupportedError)
+}
+
+func TestGetGatewayAPITrafficRoutingConfigWithStrictDecoding(t *testing.T) {
+	newRolloutWithRawConfig := func(rawConfig string) *v1alpha1.Rollout {
+		rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{})
+		rollout.Spec.Strategy.Canary.TrafficRouting.Plugins[PluginName] = json.RawMessage(rawConfig)
+		return rollout
+	}
+	t.Run("UnknownFields", func(t *testing.T) {
+		rollout := newRolloutWithRawConfig(`{"httpRoutes":[{"nmae":"route"}],"useHeaderRoute":true}`)
+
+		_, err := getGatewayAPITrafficRoutingConfig(rollout)
+
+		assert.ErrorContains(t, err, `unknown field "httpRoutes[0].nmae"`)
+		assert.ErrorContains(t, err, `unknown field "useHeaderRoute"`)
+		var configError *ConfigError
+		assert.ErrorAs(t, err, &configError)
+		assert.Equal(t, "httpRoutes[0].nmae", configError.FieldErrorList[0].Path)
+	})
+	t.Run("CaseSensitiveFields", func(t *testing.T) {
+		rollout := newRolloutWithRawConfig(`{"HTTPRoute":"route"}`)
+
+		_, err := getGatewayAPITrafficRoutingConfig(rollout)
+
+		assert.ErrorContains(t, err, `unknown field "HTTPRoute"`)
+	})
+	t.Run("ValidationErrors", func(t *testing.T) {
+		rollout := newRolloutWithRawConfig(`{"httpRoutes":[{"name":"route","template":{},"templateRef":{"configMap":"config-map","key":"template"}},{"useHeaderRoutes":true}],"weightScale":2000000}`)
+
+		_, err := getGatewayAPITrafficRoutingConfig(rollout)
+
+		assert.EqualError(t, err, "invalid plugin configuration: httpRoutes[0].template can't be set together with httpRoutes[0].templateRef; httpRoutes[1].name is required; weightScale must be at most 1000000")
+		var configError *ConfigError
+		assert.ErrorAs(t, err, &configError)
+		assert.Equal(t, "httpRoutes[1].name", configError.FieldErrorList[1].Path)
+	})
+	t.Run("DedicatedHeaderRoutesWithoutHeaderRoutes", func(t *testing.T) {
+		rollout := newRolloutWithRawConfig(`{"httpRoutes":[{"name":"route","useDedicatedHeaderRoutes":true},{"name":"other-route","useHeaderRoutes":true,"useDedicatedHeaderRoutes":true}]}`)
+
+		_, err := getGatewayAPITrafficRoutingConfig(rollout)
+
+		assert.EqualError(t, err, "invalid plugin configuration: httpRoutes[0].useDedicatedHeaderRoutes can only be set when httpRoutes[0].useHeaderRoutes is true")
+	})
+}
+
+func TestGetGatewayAPITrafficRoutingConfigWithoutNamespace(t *testing.T) {
+	rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+		HTTPRoute: mocks.HTTPRouteName,
+	})
+
+	gatewayAPIConfig, err := getGatewayAPITrafficRoutingConfig(rollout)
+
+	assert.NoError(t, err)
+	assert.Equal(t, mocks.RolloutNamespace, gatewayAPIConfig.Namespace)
+}
+
+func TestSetWeightErrorHasRouteNamespace(t *testing.T) {
+	rpcPluginImp := &RpcPlugin{
+		LogCtx:          utils.SetupLog(),
+		IsTest:          true,
+		HTTPRouteClient: gwFake.NewSimpleClientset().GatewayV1().HTTPRoutes(mocks.RolloutNamespace),
+	}
+	rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+		HTTPRoute: mocks.HTTPRouteName,
+	})
+
+	rpcError := rpcPluginImp.SetWeight(rollout, 30, []v1alpha1.WeightDestination{})
+
+	assert.True(t, rpcError.HasError())
+	assert.Contains(t, rpcError.ErrorString, "HTTPRoute "+mocks.RolloutNamespace+"/"+mocks.HTTPRouteName+": ")
+	assert.True(t, strings.HasSuffix(rpcError.ErrorString, "not found"))
+}
+
+func TestNamespacePolicy(t *testing.T) {
+	namespacePolicy, err := ParseNamespacePolicy([]byte(`{"team-a": ["gateways"], "platform": ["*"]}`))
+	assert.NoError(t, err)
+	newRpcPlugin := func(commandLineOpts CommandLineOpts, configMapList ...runtime.Object) *RpcPlugin {
+		return &RpcPlugin{
+			LogCtx:          utils.SetupLog(),
+			IsTest:          true,
+			CommandLineOpts: commandLineOpts,
+			HTTPRouteClient: gwFake.NewSimpleClientset(&mocks.HTTPRouteObj).GatewayV1().HTTPRoutes(mocks.RolloutNamespace),
+			TestClientset:   fake.NewSimpleClientset(configMapList...).CoreV1().ConfigMaps(mocks.RolloutNamespace),
+		}
+	}
+	newRolloutInNamespace := func(rolloutNamespace string) *v1alpha1.Rollout {
+		rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+			Namespace: mocks.RolloutNamespace,
+			HTTPRoute: mocks.HTTPRouteName,
+		})
+		rollout.Namespace = rolloutNamespace
+		return rollout
+	}
+	t.Run("IsAllowed", func(t *testing.T) {
+		assert.True(t, namespacePolicy.IsAllowed("team-b", "team-b"))
+		assert.True(t, namespacePolicy.IsAllowed("team-a", "gateways"))
+		assert.True(t, namespacePolicy.IsAllowed("platform", "team-b"))
+		assert.False(t, namespacePolicy.IsAllowed("team-a", "team-b"))
+		assert.False(t, NamespacePolicy(nil).IsAllowed("team-a", "team-b"))
+	})
+	t.Run("InvalidPolicy", func(t *testing.T) {
+		_, err := ParseNamespacePolicy([]byte(`{"team-a": "gateways"}`))
+
+		assert.ErrorContains(t, err, "invalid namespace policy")
+	})
+	t.Run("WithoutPolicy", func(t *testing.T) {
+		rpcPluginImp := newRpcPlugin(CommandLineOpts{})
+
+		rpcError := rpcPluginImp.SetWeight(newRolloutInNamespace("team-b"), 30, []v1alpha1.WeightDestination{})
+
+		assert.False(t, rpcError.HasError())
+	})
+	t.Run("DeniedByFlag", func(t *testing.T) {
+		rpcPluginImp := newRpcPlugin(CommandLineOpts{NamespacePolicy: namespacePolicy})
+
+		rpcError := rpcPluginImp.SetWeight(newRolloutInNamespace("team-b"), 30, []v1alpha1.WeightDestination{})
+
+		assert.Equal(t, fmt.Sprintf(NamespacePolicyDeniedError, "team-b", "rollout", mocks.RolloutNamespace), rpcError.ErrorString)
+		assert.Nil(t, rpcPluginImp.UpdatedHTTPRouteMock)
+	})
+	t.Run("AllowedByConfigMap", func(t *testing.T) {
+		configMap := &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "namespace-policy",
+				Namespace: mocks.RolloutNamespace,
+			},
+			Data: map[string]string{
+				NamespacePolicyConfigMapKey: "team-b:\n  - " + mocks.RolloutNamespace + "\n",
+			},
+		}
+		rpcPluginImp := newRpcPlugin(CommandLineOpts{
+			NamespacePolicy:          namespacePolicy,
+			NamespacePolicyConfigMap: mocks.RolloutNamespace + "/" + configMap.Name,
+		}, configMap)
+
+		rpcError := rpcPluginImp.SetWeight(newRolloutInNamespace("team-b"), 30, []v1alpha1.WeightDestination{})
+
+		assert.False(t, rpcError.HasError())
+		assert.NotNil(t, rpcPluginImp.UpdatedHTTPRouteMock)
+	})
+	t.Run("MissingConfigMap", func(t *testing.T) {
+		rpcPluginImp := newRpcPlugin(CommandLineOpts{NamespacePolicyConfigMap: mocks.RolloutNamespace + "/namespace-policy"})
+
+		rpcError := rpcPluginImp.RemoveManagedRoutes(newRolloutInNamespace("team-b"))
+
+		assert.Contains(t, rpcError.ErrorString, "config map "+mocks.RolloutNamespace+"/namespace-policy: ")
+	})
+}
+
+func TestImpersonation(t *testing.T) {
+	newRpcPlugin := func() *RpcPlugin {
+		return &RpcPlugin{
+			LogCtx: utils.SetupLog(),
+			CommandLineOpts: CommandLineOpts{
+				ImpersonateServiceAccount: "gatewayapi-plugin",
+			},
+			kubeConfig: &rest.Config{
+				Host: "https://127.0.0.1:6443",
+			},
+		}
+	}
+	t.Run("ImpersonationConfig", func(t *testing.T) {
+		impersonationConfig := getImpersonationConfig("team-a", "gatewayapi-plugin")
+
+		assert.Equal(t, "system:serviceaccount:team-a:gatewayapi-plugin", impersonationConfig.UserName)
+		assert.Equal(t, []string{"system:serviceaccounts", "system:serviceaccounts:team-a", "system:authenticated"}, impersonationConfig.Groups)
+	})
+	t.Run("CachedByNamespace", func(t *testing.T) {
+		rpcPluginImp := newRpcPlugin()
+
+		teamAClientsets, err := rpcPluginImp.getNamespaceClientsets("team-a")
+		assert.NoError(t, err)
+		cachedClientsets, err := rpcPluginImp.getNamespaceClientsets("team-a")
+		assert.NoError(t, err)
+		teamBClientsets, err := rpcPluginImp.getNamespaceClientsets("team-b")
+		assert.NoError(t, err)
+
+		assert.Same(t, teamAClientsets, cachedClientsets)
+		assert.NotSame(t, teamAClientsets, teamBClientsets)
+		assert.Empty(t, rpcPluginImp.kubeConfig.Impersonate.UserName)
+	})
+	t.Run("SetNamespaceClientsets", func(t *testing.T) {
+		rpcPluginImp := newRpcPlugin()
+		rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+			HTTPRoute: mocks.HTTPRouteName,
+		})
+		gatewayAPIConfig, err := getGatewayAPITrafficRoutingConfig(rollout)
+		assert.NoError(t, err)
+
+		rpcError := rpcPluginImp.setNamespaceClientsets(rollout, gatewayAPIConfig)
+
+		assert.False(t, rpcError.HasError())
+		assert.NotNil(t, rpcPluginImp.getGatewayAPIClientset(gatewayAPIConfig))
+		assert.NotNil(t, rpcPluginImp.getClientset(gatewayAPIConfig))
+		assert.Same(t, gatewayAPIConfig.clientsets.clientset, rpcPluginImp.getClientset(gatewayAPIConfig))
+	})
+	t.Run("WithoutImpersonation", func(t *testing.T) {
+		rpcPluginImp := newRpcPlugin()
+		rpcPluginImp.CommandLineOpts.ImpersonateServiceAccount = ""
+		gatewayAPIConfig := &GatewayAPITrafficRouting{}
+
+		rpcError := rpcPluginImp.setNamespaceClientsets(newRollout(mocks.StableServiceName, mocks.CanaryServiceName, gatewayAPIConfig), gatewayAPIConfig)
+
+		assert.False(t, rpcError.HasError())
+		assert.Nil(t, gatewayAPIConfig.clientsets)
+	})
+}
+
+func TestWeightGuardrails(t *testing.T) {
+	newRpcPlugin := func(stateMap WeightGuardrailStateMap) *RpcPlugin {
+		configMap := &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      defaults.ConfigMap,
+				Namespace: mocks.RolloutNamespace,
+			},
+		}
+		if stateMap != nil {
+			rawStateMap, err := json.Marshal(stateMap)
+			assert.NoError(t, err)
+			configMap.Data = map[string]string{
+				WeightGuardrailsConfigMapKey: string(rawStateMap),
+			}
+		}
+		return &RpcPlugin{
+			LogCtx:          utils.SetupLog(),
+			IsTest:          true,
+			HTTPRouteClient: gwFake.NewSimpleClientset(&mocks.HTTPRouteObj).GatewayV1().HTTPRoutes(mocks.RolloutNamespace),
+			TestClientset:   fake.NewSimpleClientset(configMap).CoreV1().ConfigMaps(mocks.RolloutNamespace),
+		}
+	}
+	newRolloutWithGuardrails := func(guardrails *WeightGuardrails) *v1alpha1.Rollout {
+		return newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+			HTTPRoute:        mocks.HTTPRouteName,
+			WeightGuardrails: guardrails,
+		})
+	}
+	getStateMap := func(t *testing.T, rpcPluginImp *RpcPlugin) WeightGuardrailStateMap {
+		configMap, err := rpcPluginImp.TestClientset.Get(context.TODO(), defaults.ConfigMap, metav1.GetOptions{})
+		assert.NoError(t, err)
+		stateMap := make(WeightGuardrailStateMap)
+		assert.NoError(t, utils.GetConfigMapData(configMap, WeightGuardrailsConfigMapKey, &stateMap))
+		return stateMap
+	}
+	rolloutKey := fmt.Sprintf("%s/rollout", mocks.RolloutNamespace)
+	t.Run("MaxCanaryWeight", func(t *testing.T) {
+		rpcPluginImp := newRpcPlugin(WeightGuardrailStateMap{rolloutKey: {Weight: 40}})
+
+		rpcError := rpcPluginImp.SetWeight(newRolloutWithGuardrails(&WeightGuardrails{MaxCanaryWeight: 50}), 60, []v1alpha1.WeightDestination{})
+
+		assert.Equal(t, "rollout default/rollout can't set canary weight 60, because weightGuardrails.maxCanaryWeight is 50", rpcError.ErrorString)
+		assert.Nil(t, rpcPluginImp.UpdatedHTTPRouteMock)
+		assert.Equal(t, int32(40), getStateMap(t, rpcPluginImp)[rolloutKey].Weight)
+	})
+	t.Run("MaxWeightIncrease", func(t *testing.T) {
+		rpcPluginImp := newRpcPlugin(WeightGuardrailStateMap{rolloutKey: {Weight: 10}})
+		rollout := newRolloutWithGuardrails(&WeightGuardrails{MaxWeightIncrease: 20})
+
+		rpcError := rpcPluginImp.SetWeight(rollout, 40, []v1alpha1.WeightDestination{})
+
+		assert.Equal(t, "rollout default/rollout can't increase canary weight from 10 to 40, because weightGuardrails.maxWeightIncrease is 20", rpcError.ErrorString)
+		assert.Nil(t, rpcPluginImp.UpdatedHTTPRouteMock)
+
+		rpcError = rpcPluginImp.SetWeight(rollout, 30, []v1alpha1.WeightDestination{})
+
+		assert.False(t, rpcError.HasError())
+		assert.Equal(t, int32(30), *rpcPluginImp.UpdatedHTTPRouteMock.Spec.Rules[0].BackendRefs[1].Weight)
+		state := getStateMap(t, rpcPluginImp)[rolloutKey]
+		assert.Equal(t, int32(30), state.Weight)
+		assert.False(t, state.IncreaseTime.IsZero())
+		configMap, err := rpcPluginImp.TestClientset.Get(context.TODO(), defaults.ConfigMap, metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, ManagedByLabelValue, configMap.Labels[ManagedByLabel])
+	})
+	t.Run("MaxWeightIncreaseWithoutState", func(t *testing.T) {
+		rpcPluginImp := newRpcPlugin(nil)
+		rollout := newRolloutWithGuardrails(&WeightGuardrails{MaxWeightIncrease: 20})
+		rollout.Status.Canary.Weights = &v1alpha1.TrafficWeights{
+			Canary: v1alpha1.WeightDestination{
+				Weight: 20,
+			},
+		}
+
+		rpcError := rpcPluginImp.SetWeight(rollout, 40, []v1alpha1.WeightDestination{})
+
+		assert.False(t, rpcError.HasError())
+	})
+	t.Run("StateUpdateFailed", func(t *testing.T) {
+		rpcPluginImp := newRpcPlugin(nil)
+		clientset := fake.NewSimpleClientset(&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      defaults.ConfigMap,
+				Namespace: mocks.RolloutNamespace,
+			},
+		})
+		clientset.PrependReactor("update", "configmaps", func(action kubeTesting.Action) (bool, runtime.Object, error) {
+			return true, nil, errors.New("config map can't be updated")
+		})
+		rpcPluginImp.TestClientset = clientset.CoreV1().ConfigMaps(mocks.RolloutNamespace)
+
+		rpcError := rpcPluginImp.SetWeight(newRolloutWithGuardrails(&WeightGuardrails{MaxWeightIncrease: 20}), 20, []v1alpha1.WeightDestination{})
+
+		assert.ErrorContains(t, rpcError, "config map can't be updated")
+		assert.Nil(t, rpcPluginImp.UpdatedHTTPRouteMock)
+	})
+	t.Run("RouteUpdateFailed", func(t *testing.T) {
+		increaseTime := metav1.NewTime(time.Now().Add(-10 * time.Minute).Truncate(time.Second))
+		rpcPluginImp := newRpcPlugin(WeightGuardrailStateMap{
+			rolloutKey: {
+				Weight:       10,
+				IncreaseTime: increaseTime,
+			},
+		})
+		rpcPluginImp.HTTPRouteClient = gwFake.NewSimpleClientset().GatewayV1().HTTPRoutes(mocks.RolloutNamespace)
+
+		rpcError := rpcPluginImp.SetWeight(newRolloutWithGuardrails(&WeightGuardrails{MaxWeightIncrease: 20}), 20, []v1alpha1.WeightDestination{})
+
+		assert.True(t, rpcError.HasError())
+		state := getStateMap(t, rpcPluginImp)[rolloutKey]
+		assert.Equal(t, int32(10), state.Weight)
+		assert.True(t, state.IncreaseTime.Equal(&increaseTime))
+	})
+	t.Run("RouteUpdateFailedWithoutState", func(t *testing.T) {
+		rpcPluginImp := newRpcPlugin(nil)
+		rpcPluginImp.HTTPRouteClient = gwFake.NewSimpleClientset().GatewayV1().HTTPRoutes(mocks.RolloutNamespace)
+
+		rpcError := rpcPluginImp.SetWeight(newRolloutWithGuardrails(&WeightGuardrails{MaxWeightIncrease: 20}), 20, []v1alpha1.WeightDestination{})
+
+		assert.True(t, rpcError.HasError())
+		assert.NotContains(t, getStateMap(t, rpcPluginImp), rolloutKey)
+	})
+	t.Run("MinIncreaseInterval", func(t *testing.T) {
+		rpcPluginImp := newRpcPlugin(WeightGuardrailStateMap{
+			rolloutKey: {
+				Weight:       10,
+				IncreaseTime: metav1.NewTime(time.Now().Add(-90 * time.Second)),
+			},
+		})
+
+		rpcError := rpcPluginImp.SetWeight(newRolloutWithGuardrails(&WeightGuardrails{MinIncreaseInterval: "5m"}), 20, []v1alpha1.WeightDestination{})
+
+		assert.ErrorContains(t, rpcError, "can't increase canary weight from 10 to 20 for another 3m")
+		assert.ErrorContains(t, rpcError, "because weightGuardrails.minIncreaseInterval is 5m")
+		assert.Nil(t, rpcPluginImp.UpdatedHTTPRouteMock)
+	})
+	t.Run("MinIncreaseIntervalPassed", func(t *testing.T) {
+		increaseTime := metav1.NewTime(time.Now().Add(-10 * time.Minute))
+		rpcPluginImp := newRpcPlugin(WeightGuardrailStateMap{
+			rolloutKey: {
+				Weight:       10,
+				IncreaseTime: increaseTime,
+			},
+		})
+
+		rpcError := rpcPluginImp.SetWeight(newRolloutWithGuardrails(&WeightGuardrails{MinIncreaseInterval: "5m"}), 20, []v1alpha1.WeightDestination{})
+
+		assert.False(t, rpcError.HasError())
+		assert.True(t, getStateMap(t, rpcPluginImp)[rolloutKey].IncreaseTime.After(increaseTime.Time))
+	})
+	t.Run("Decrease", func(t *testing.T) {
+		rpcPluginImp := newRpcPlugin(WeightGuardrailStateMap{
+			rolloutKey: {
+				Weight:       80,
+				IncreaseTime: metav1.Now(),
+			},
+		})
+
+		rpcError := rpcPluginImp.SetWeight(newRolloutWithGuardrails(&WeightGuardrails{
+			MaxCanaryWeight:     50,
+			MaxWeightIncrease:   10,
+			MinIncreaseInterval: "1h",
+		}), 60, []v1alpha1.WeightDestination{})
+
+		assert.False(t, rpcError.HasError())
+		assert.Equal(t, int32(60), getStateMap(t, rpcPluginImp)[rolloutKey].Weight)
+	})
+	t.Run("FinalPromotion", func(t *testing.T) {
+		rpcPluginImp := newRpcPlugin(WeightGuardrailStateMap{rolloutKey: {Weight: 40}})
+		rollout := newRolloutWithGuardrails(&WeightGuardrails{
+			MaxCanaryWeight:   50,
+			MaxWeightIncrease: 10,
+		})
+		stepWeight := int32(40)
+		rollout.Spec.Strategy.Canary.Steps = []v1alpha1.CanaryStep{
+			{
+				SetWeight: &stepWeight,
+			},
+		}
+		currentStepIndex := int32(0)
+		rollout.Status.CurrentStepIndex = &currentStepIndex
+
+		rpcError := rpcPluginImp.SetWeight(rollout, 100, []v1alpha1.WeightDestination{})
+
+		assert.Equal(t, "rollout default/rollout can't set canary weight 100, because weightGuardrails.maxCanaryWeight is 50", rpcError.ErrorString)
+
+		currentStepIndex = 1
+		rpcError = rpcPluginImp.SetWeight(rollout, 100, []v1alpha1.WeightDestination{})
+
+		assert.False(t, rpcError.HasError())
+	})
+	t.Run("StateRemovedAtZero", func(t *testing.T) {
+		rpcPluginImp := newRpcPlugin(WeightGuardrailStateMap{rolloutKey: {Weight: 40}})
+
+		rpcError := rpcPluginImp.SetWeight(newRolloutWithGuardrails(&WeightGuardrails{MaxCanaryWeight: 50}), 0, []v1alpha1.WeightDestination{})
+
+		assert.False(t, rpcError.HasError())
+		assert.NotContains(t, getStateMap(t, rpcPluginImp), rolloutKey)
+	})
+	t.Run("InvalidMinIncreaseInterval", func(t *testing.T) {
+		_, err := getGatewayAPITrafficRoutingConfig(newRolloutWithGuardrails(&WeightGuardrails{MinIncreaseInterval: "5 minutes"}))
+
+		assert.EqualError(t, err, "invalid plugin configuration: weightGuardrails.minIncreaseInterval must be a duration like 30s or 5m")
+	})
+}
+
+func TestGetDeprecationWarningList(t *testing.T) {
+	rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{
+		HTTPRoute: mocks.HTTPRouteName,
+		HTTPRoutes: []HTTPRoute{
+			{
+				Name: "other-route",
+			},
+		},
+		GRPCRoute: mocks.GRPCRouteName,
+	})
+	gatewayAPIConfig, err := getGatewayAPITrafficRoutingConfig(rollout)
+	assert.NoError(t, err)
+
+	warningList := getDeprecationWarningList(gatewayAPIConfig)
+
+	assert.Equal(t, []string{`"httpRoute" and "httpRoutes" are both set. "httpRoute" is deprecated, add the route to "httpRoutes" instead`}, warningList)
+}
+
+func TestGetDeprecationWarningListWithUseHeaderRoutes(t *testing.T) {
+	rollout := newRollout(mocks.StableServiceName, mocks.CanaryServiceName, &GatewayAPITrafficRouting{})
+	rollout.Spec.Strategy.Canary.TrafficRouting.Plugins[PluginName] = json.RawMessage(`{"httpRoute":"` + mocks.HTTPRouteName + `","useHeaderRoutes":true}`)
+	gatewayAPIConfig, err := getGatewayAPITrafficRoutingConfig(rollout)
+	assert.NoError(t, err)
+
+	warningList := getDeprecationWarningList(gatewayAPIConfig)
+
+	assert.Equal(t, []string{DeprecatedUseHeaderRoutesWarning}, warningList)
+	assert.True(t, gatewayAPIConfig.HTTPRoutes[0].UseHeaderRoutes)
+}
+
+func TestGetServiceNamesInPingPongMode(t *testing.T) {
+	pingServiceName := "ping-service"
+	pongServiceName := "pong-service"
+	rollout := newRollout("", "", &GatewayAPITrafficRouting{
+		Namespace: mocks.RolloutNamespace,
+		HTTPRoute: mocks.HTTPRouteName,
+	})
+	rollout.Spec.Strategy.Canary.PingPong = &v1alpha1.PingPongSpec{
+		PingService: pingServiceName,
+		PongService: pongServiceName,
+	}
+
+	canaryServiceName, stableServiceName := getServiceNames(rollout)
+
+	assert.Equal(t, pongServiceName, canaryServiceName)
+	assert.Equal(t, pingServiceName, stableServiceName)
+
+	rollout.Status.Canary.StablePingPong = v1alpha1.PPPong
+	canaryServiceName, stableServiceName = getServiceNames(rollout)
+
+	assert.Equal(t, pingServiceName, canaryServiceName)
+	assert.Equal(t, pongServiceName, stableServiceName)
+}
+
+func newHTTPBackendRef(name string, weight int32) gatewayv1.HTTPBackendRef {
+	return gatewayv1.HTTPBackendRef{
+		BackendRef: gatewayv1.BackendRef{
+			BackendObjectReference: gatewayv1.BackendObjectReference{
+				Name: gatewayv1.ObjectName(name),
+			},
+			Weight: &weight,
+		},
+	}
+}
+
 func newRollout(stableSvc, canarySvc string, config *GatewayAPITrafficRouting) *v1alpha1.Rollout {
 	encodedConfig, err := json.Marshal(config)
 	if err != nil {
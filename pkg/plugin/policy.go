@@ -0,0 +1,94 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+	pluginTypes "github.com/argoproj/argo-rollouts/utils/plugin/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// NamespacePolicyConfigMapKey refers to the key of the namespace policy in its config map
+	NamespacePolicyConfigMapKey = "policy"
+	// AnyNamespace allows a rollout namespace to control routes in all namespaces
+	AnyNamespace = "*"
+)
+
+// NamespacePolicy refers to the namespaces rollouts of a namespace may control routes in, by rollout namespace.
+// Rollouts may always control routes in their own namespace. The policy of "*" applies to rollouts of all namespaces
+type NamespacePolicy map[string][]string
+
+// ParseNamespacePolicy reads the policy from YAML or JSON, e.g. {"team-a": ["gateways"], "platform": ["*"]}
+func ParseNamespacePolicy(data []byte) (NamespacePolicy, error) {
+	namespacePolicy := NamespacePolicy{}
+	err := yaml.UnmarshalStrict(data, &namespacePolicy)
+	if err != nil {
+		return nil, fmt.Errorf(InvalidNamespacePolicyError, err)
+	}
+	return namespacePolicy, nil
+}
+
+// IsAllowed returns whether rollouts of rolloutNamespace may control routes in targetNamespace
+func (p NamespacePolicy) IsAllowed(rolloutNamespace string, targetNamespace string) bool {
+	if rolloutNamespace == targetNamespace {
+		return true
+	}
+	for _, policyNamespace := range []string{rolloutNamespace, AnyNamespace} {
+		targetNamespaceList := p[policyNamespace]
+		if slices.Contains(targetNamespaceList, targetNamespace) || slices.Contains(targetNamespaceList, AnyNamespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// isNamespacePolicyEnabled returns whether a policy was set by a flag. Without policy every namespace is allowed
+func (r *RpcPlugin) isNamespacePolicyEnabled() bool {
+	return r.CommandLineOpts.NamespacePolicy != nil || r.CommandLineOpts.NamespacePolicyConfigMap != ""
+}
+
+// checkNamespacePolicy returns an error if the rollout isn't allowed to control the routes and the config map
+// in the namespace of its plugin configuration. The policy of the config map is read on every check,
+// so changes apply without restarting the controller
+func (r *RpcPlugin) checkNamespacePolicy(rollout *v1alpha1.Rollout, gatewayAPIConfig *GatewayAPITrafficRouting) pluginTypes.RpcError {
+	if !r.isNamespacePolicyEnabled() || rollout.Namespace == gatewayAPIConfig.Namespace {
+		return pluginTypes.RpcError{}
+	}
+	if r.CommandLineOpts.NamespacePolicy.IsAllowed(rollout.Namespace, gatewayAPIConfig.Namespace) {
+		return pluginTypes.RpcError{}
+	}
+	if r.CommandLineOpts.NamespacePolicyConfigMap != "" {
+		namespacePolicy, err := r.getNamespacePolicyFromConfigMap()
+		if err != nil {
+			return pluginTypes.RpcError{
+				ErrorString: err.Error(),
+			}
+		}
+		if namespacePolicy.IsAllowed(rollout.Namespace, gatewayAPIConfig.Namespace) {
+			return pluginTypes.RpcError{}
+		}
+	}
+	r.LogCtx.Warn(fmt.Sprintf("[NamespacePolicy] rollout %s/%s was denied access to namespace %q", rollout.Namespace, rollout.Name, gatewayAPIConfig.Namespace))
+	return pluginTypes.RpcError{
+		ErrorString: fmt.Sprintf(NamespacePolicyDeniedError, rollout.Namespace, rollout.Name, gatewayAPIConfig.Namespace),
+	}
+}
+
+// getNamespacePolicyFromConfigMap reads the policy from the config map set by "namespace/name"
+func (r *RpcPlugin) getNamespacePolicyFromConfigMap() (NamespacePolicy, error) {
+	namespace, name, _ := strings.Cut(r.CommandLineOpts.NamespacePolicyConfigMap, "/")
+	configMapClient := r.TestClientset
+	if !r.IsTest {
+		configMapClient = r.Clientset.CoreV1().ConfigMaps(namespace)
+	}
+	configMap, err := configMapClient.Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf(ConfigMapError, namespace, name, err.Error())
+	}
+	return ParseNamespacePolicy([]byte(configMap.Data[NamespacePolicyConfigMapKey]))
+}
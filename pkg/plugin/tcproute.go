@@ -3,17 +3,19 @@ package plugin
 import (
 	"context"
 	"errors"
+	"slices"
 
 	"github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
 	pluginTypes "github.com/argoproj/argo-rollouts/utils/plugin/types"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
 )
 
 func (r *RpcPlugin) setTCPRouteWeight(rollout *v1alpha1.Rollout, desiredWeight int32, gatewayAPIConfig *GatewayAPITrafficRouting) pluginTypes.RpcError {
 	ctx := context.TODO()
 	tcpRouteClient := r.TCPRouteClient
 	if !r.IsTest {
-		gatewayClientV1alpha2 := r.GatewayAPIClientset.GatewayV1alpha2()
+		gatewayClientV1alpha2 := r.getGatewayAPIClientset(gatewayAPIConfig).GatewayV1alpha2()
 		tcpRouteClient = gatewayClientV1alpha2.TCPRoutes(gatewayAPIConfig.Namespace)
 	}
 	tcpRoute, err := tcpRouteClient.Get(ctx, gatewayAPIConfig.TCPRoute, metav1.GetOptions{})
@@ -22,28 +24,22 @@ func (r *RpcPlugin) setTCPRouteWeight(rollout *v1alpha1.Rollout, desiredWeight i
 			ErrorString: err.Error(),
 		}
 	}
-	canaryServiceName := rollout.Spec.Strategy.Canary.CanaryService
-	stableServiceName := rollout.Spec.Strategy.Canary.StableService
+	canaryServiceName, stableServiceName := getServiceNames(rollout)
 	routeRuleList := TCPRouteRuleList(tcpRoute.Spec.Rules)
-	canaryBackendRefs, err := getBackendRefs(canaryServiceName, routeRuleList)
+	err = setBackendRefWeights(routeRuleList, BackendRefWeightOptions{
+		CanaryBackendRef:       getBackendRefReference(canaryServiceName, gatewayAPIConfig.CanaryBackendRef),
+		StableBackendRef:       getBackendRefReference(stableServiceName, gatewayAPIConfig.StableBackendRef),
+		RouteNamespace:         tcpRoute.Namespace,
+		DesiredWeight:          desiredWeight,
+		MaxTrafficWeight:       gatewayAPIConfig.MaxTrafficWeight,
+		WeightScale:            gatewayAPIConfig.WeightScale,
+		InsertCanaryBackendRef: gatewayAPIConfig.InsertCanaryBackendRef,
+	})
 	if err != nil {
 		return pluginTypes.RpcError{
 			ErrorString: err.Error(),
 		}
 	}
-	for _, ref := range canaryBackendRefs {
-		ref.Weight = &desiredWeight
-	}
-	stableBackendRefs, err := getBackendRefs(stableServiceName, routeRuleList)
-	if err != nil {
-		return pluginTypes.RpcError{
-			ErrorString: err.Error(),
-		}
-	}
-	restWeight := 100 - desiredWeight
-	for _, ref := range stableBackendRefs {
-		ref.Weight = &restWeight
-	}
 	updatedTCPRoute, err := tcpRouteClient.Update(ctx, tcpRoute, metav1.UpdateOptions{})
 	if r.IsTest {
 		r.UpdatedTCPRouteMock = updatedTCPRoute
@@ -70,6 +66,22 @@ func (r *TCPRouteRule) Iterator() (GatewayAPIRouteRuleIterator[*TCPBackendRef],
 	return next, len(backendRefList) > index
 }
 
+// AddBackendRef appends a copy of the backendRef with zero weight that refers to another backend.
+// Port, group, kind are taken from the copied backendRef unless the reference sets them
+func (r *TCPRouteRule) AddBackendRef(backendRef *TCPBackendRef, backendRefReference BackendRefReference) {
+	var weight int32
+	newBackendRef := (*gatewayv1.BackendRef)(backendRef).DeepCopy()
+	backendRefReference.Apply(&newBackendRef.BackendObjectReference)
+	newBackendRef.Weight = &weight
+	r.BackendRefs = append(r.BackendRefs, *newBackendRef)
+}
+
+func (r *TCPRouteRule) RemoveBackendRefs(backendRefReference BackendRefReference, routeNamespace string) {
+	r.BackendRefs = slices.DeleteFunc(r.BackendRefs, func(backendRef gatewayv1.BackendRef) bool {
+		return backendRefReference.IsMatched(backendRef.BackendObjectReference, routeNamespace)
+	})
+}
+
 func (r TCPRouteRuleList) Iterator() (GatewayAPIRouteRuleListIterator[*TCPBackendRef, *TCPRouteRule], bool) {
 	routeRuleList := r
 	index := 0
@@ -92,6 +104,25 @@ func (r *TCPBackendRef) GetName() string {
 	return string(r.Name)
 }
 
+func (r *TCPBackendRef) GetObjectReference() gatewayv1.BackendObjectReference {
+	return r.BackendObjectReference
+}
+
+func (r *TCPBackendRef) GetWeight() int32 {
+	if r.Weight == nil {
+		return 1
+	}
+	return *r.Weight
+}
+
+func (r *TCPBackendRef) SetWeight(weight int32) {
+	r.Weight = &weight
+}
+
 func (r TCPRoute) GetName() string {
 	return r.Name
 }
+
+func (r TCPRoute) GetKind() string {
+	return TCPRouteKind
+}
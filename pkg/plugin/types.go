@@ -2,10 +2,14 @@ package plugin
 
 import (
 	"sync"
+	"time"
 
+	rolloutsClientset "github.com/argoproj/argo-rollouts/pkg/client/clientset/versioned"
 	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	v1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
 	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
 	"sigs.k8s.io/gateway-api/apis/v1alpha2"
 	gatewayAPIClientset "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned"
@@ -16,6 +20,18 @@ import (
 type CommandLineOpts struct {
 	KubeClientQPS   float32
 	KubeClientBurst int
+	// GarbageCollectorInterval refers to the interval of removing orphaned managed routes.
+	// The garbage collector is disabled when it is 0
+	GarbageCollectorInterval time.Duration
+	// GarbageCollectorDryRun indicates orphaned managed routes are only logged
+	GarbageCollectorDryRun bool
+	// NamespacePolicy refers to the namespaces rollouts may control routes in besides their own namespace
+	NamespacePolicy NamespacePolicy
+	// NamespacePolicyConfigMap refers to the config map with the namespace policy as "namespace/name"
+	NamespacePolicyConfigMap string
+	// ImpersonateServiceAccount refers to the service account the plugin impersonates in the namespace of each rollout.
+	// The identity of the controller is used when it is empty
+	ImpersonateServiceAccount string
 }
 
 type RpcPlugin struct {
@@ -26,11 +42,21 @@ type RpcPlugin struct {
 	TestClientset        v1.ConfigMapInterface
 	GatewayAPIClientset  *gatewayAPIClientset.Clientset
 	Clientset            *kubernetes.Clientset
+	RolloutsClientset    rolloutsClientset.Interface
 	UpdatedHTTPRouteMock *gatewayv1.HTTPRoute
 	UpdatedTCPRouteMock  *v1alpha2.TCPRoute
 	UpdatedGRPCRouteMock *gatewayv1.GRPCRoute
 	LogCtx               *logrus.Entry
 	IsTest               bool
+	garbageCollectorOnce sync.Once
+	// deprecationWarningSet refers to the deprecation warnings that were already logged
+	deprecationWarningSet sync.Map
+	// kubeConfig refers to the config of the controller the impersonated clientsets are created from
+	kubeConfig *rest.Config
+	// namespaceClientsetsMap refers to the impersonated clientsets by rollout namespace
+	namespaceClientsetsMap sync.Map
+	// configMapRWMutexMap refers to the mutexes of the plugin config maps by namespace and name
+	configMapRWMutexMap sync.Map
 }
 
 type GatewayAPITrafficRouting struct {
@@ -43,30 +69,126 @@ type GatewayAPITrafficRouting struct {
 	// TCPRoute refers to the name of the TCPRoute used to route traffic to the
 	// service
 	TCPRoute string `json:"tcpRoute,omitempty"`
-	// Namespace refers to the namespace of the specified resource
+	// UseHeaderRoutes is deprecated and has no effect. httpRoute and grpcRoute always use header routes,
+	// the routes of httpRoutes and grpcRoutes use them with their own useHeaderRoutes
+	UseHeaderRoutes bool `json:"useHeaderRoutes,omitempty"`
+	// Namespace refers to the namespace of the specified resource and the config map.
+	// Defaults to the namespace of the rollout
 	Namespace string `json:"namespace,omitempty"`
 	// ConfigMap refers to the config map where plugin stores data about managed routes
 	ConfigMap string `json:"configMap,omitempty"`
 	// HTTPRoutes refer to names of HTTPRoute resources used to route traffic to the
 	// service
-	HTTPRoutes []HTTPRoute `json:"httpRoutes,omitempty"`
+	HTTPRoutes []HTTPRoute `json:"httpRoutes,omitempty" validate:"dive"`
 	// TCPRoutes refer to names of TCPRoute resources used to route traffic to the
 	// service
-	TCPRoutes []TCPRoute `json:"tcpRoutes,omitempty"`
+	TCPRoutes []TCPRoute `json:"tcpRoutes,omitempty" validate:"dive"`
 	// GRPCRoutes refer to names of GRPCRoute resources used to route traffic to the
 	// service
-	GRPCRoutes []GRPCRoute `json:"grpcRoutes,omitempty"`
+	GRPCRoutes []GRPCRoute `json:"grpcRoutes,omitempty" validate:"dive"`
+	// WeightScale refers to the sum of the canary and stable backendRef weights.
+	// It allows canary steps finer than 1%, e.g. 1000 gives 0.1% steps
+	WeightScale int32 `json:"weightScale,omitempty" validate:"omitempty,min=1,max=1000000"`
+	// MaxTrafficWeight refers to the total weight the rollout uses for its steps.
+	// It has to match maxTrafficWeight of the rollout if it is set there
+	MaxTrafficWeight int32 `json:"maxTrafficWeight,omitempty" validate:"omitempty,min=1"`
+	// StableBackendRef refers to the group, kind, namespace and port of the stable backendRefs.
+	// By default stable backendRefs are Services in the namespace of the route
+	StableBackendRef *BackendRefReference `json:"stableBackendRef,omitempty"`
+	// CanaryBackendRef refers to the group, kind, namespace and port of the canary backendRefs.
+	// By default canary backendRefs are Services in the namespace of the route
+	CanaryBackendRef *BackendRefReference `json:"canaryBackendRef,omitempty"`
+	// InsertCanaryBackendRef indicates the plugin adds the canary backendRef next to the
+	// stable one when it is missing in the rule and removes it when the canary weight is 0
+	InsertCanaryBackendRef bool `json:"insertCanaryBackendRef,omitempty"`
+	// CanaryFilters refers to the filters that are added to the canary backendRef and the header routes during the canary
+	CanaryFilters CanaryFilters `json:"canaryFilters,omitempty"`
+	// CanaryTimeouts refers to the timeouts of the header routes of HTTPRoutes
+	CanaryTimeouts *gatewayv1.HTTPRouteTimeouts `json:"canaryTimeouts,omitempty"`
+	// SessionPersistence refers to the session persistence of the weighted rules while the canary gets traffic
+	SessionPersistence *gatewayv1.SessionPersistence `json:"sessionPersistence,omitempty"`
+	// ManagedRoutes refers to the extra matches of managed routes by the managed route name
+	ManagedRoutes map[string]ManagedRoute `json:"managedRoutes,omitempty" validate:"dive"`
+	// WeightGuardrails refers to the limits of the canary weight the rollout may set before its final promotion
+	WeightGuardrails *WeightGuardrails `json:"weightGuardrails,omitempty"`
 	// ConfigMapRWMutex refers to the RWMutex that we use to enter to the critical section
-	// critical section is config map
-	ConfigMapRWMutex sync.RWMutex
+	// critical section is config map. It is shared by all rollouts and the garbage collector using the config map
+	ConfigMapRWMutex *sync.RWMutex `json:"-"`
+	// clientsets refers to the clientsets impersonating the service account of the rollout namespace.
+	// The clientsets of the controller are used when it is nil
+	clientsets *namespaceClientsets
+}
+
+type WeightGuardrails struct {
+	// MaxCanaryWeight refers to the highest canary weight in the units of the setWeight steps.
+	// The final promotion of the rollout isn't limited
+	MaxCanaryWeight int32 `json:"maxCanaryWeight,omitempty" validate:"omitempty,min=1"`
+	// MaxWeightIncrease refers to the largest increase of the canary weight by one step
+	MaxWeightIncrease int32 `json:"maxWeightIncrease,omitempty" validate:"omitempty,min=1"`
+	// MinIncreaseInterval refers to the minimum time between two increases of the canary weight, e.g. 5m
+	MinIncreaseInterval string `json:"minIncreaseInterval,omitempty" validate:"omitempty,duration"`
 }
 
+// WeightGuardrailState refers to the last canary weight the plugin set for a rollout and
+// the time it was last increased
+type WeightGuardrailState struct {
+	Weight       int32       `json:"weight"`
+	IncreaseTime metav1.Time `json:"increaseTime"`
+}
+
+// WeightGuardrailStateMap refers to the guardrail states by "namespace/name" of the rollout
+type WeightGuardrailStateMap map[string]WeightGuardrailState
+
 type HTTPRoute struct {
 	// Name refers to the HTTPRoute name
 	Name string `json:"name" validate:"required"`
 	// UseHeaderRoutes defines header routes will be added to this route or not
 	// during setHeaderRoute step
 	UseHeaderRoutes bool `json:"useHeaderRoutes,omitempty"`
+	// UseDedicatedHeaderRoutes indicates header routes are put into separate HTTPRoutes
+	// created by the plugin instead of being added to this route. It requires useHeaderRoutes
+	UseDedicatedHeaderRoutes bool `json:"useDedicatedHeaderRoutes,omitempty" validate:"excluded_unless=UseHeaderRoutes true"`
+	// Template refers to the template the HTTPRoute is created from
+	// when it doesn't exist
+	Template *HTTPRouteTemplate `json:"template,omitempty" validate:"excluded_with=TemplateRef"`
+	// TemplateRef refers to the config map key with the template the HTTPRoute
+	// is created from when it doesn't exist
+	TemplateRef *HTTPRouteTemplateRef `json:"templateRef,omitempty"`
+	// CanaryHostname refers to the HTTPRoute that sends all requests
+	// for the canary hostnames to the canary
+	CanaryHostname *CanaryHostname `json:"canaryHostname,omitempty"`
+}
+
+type CanaryHostname struct {
+	// Prefix refers to the prefix of the original hostnames, for example "canary."
+	Prefix string `json:"prefix" validate:"required"`
+	// ManagedRoute refers to the managed route that creates and removes the canary HTTPRoute.
+	// Without it the canary HTTPRoute exists as long as the rollout
+	ManagedRoute string `json:"managedRoute,omitempty"`
+}
+
+// IsManagedBy returns whether the canary HTTPRoute is created and removed by the managed route
+func (c *CanaryHostname) IsManagedBy(managedRouteName string) bool {
+	return c != nil && c.ManagedRoute != "" && c.ManagedRoute == managedRouteName
+}
+
+type HTTPRouteTemplate struct {
+	// ParentRefs refers to the gateways the created HTTPRoute is attached to
+	ParentRefs []gatewayv1.ParentReference `json:"parentRefs" validate:"required,min=1"`
+	// Hostnames refers to the hostnames of the created HTTPRoute
+	Hostnames []gatewayv1.Hostname `json:"hostnames,omitempty"`
+	// Matches refers to the matches of the rule with stable and canary backendRefs
+	Matches []gatewayv1.HTTPRouteMatch `json:"matches,omitempty"`
+	// Port refers to the port of the stable and canary services
+	Port gatewayv1.PortNumber `json:"port" validate:"required"`
+}
+
+type HTTPRouteTemplateRef struct {
+	// ConfigMap refers to the config map with the template. It has to be
+	// in the same namespace as the HTTPRoute
+	ConfigMap string `json:"configMap" validate:"required"`
+	// Key refers to the config map key with the template in YAML or JSON format
+	Key string `json:"key" validate:"required"`
 }
 
 type TCPRoute struct {
@@ -85,6 +207,61 @@ type GRPCRoute struct {
 	UseHeaderRoutes bool `json:"useHeaderRoutes"`
 }
 
+type CanaryFilters struct {
+	// HTTP refers to the filters of HTTPRoutes
+	HTTP []gatewayv1.HTTPRouteFilter `json:"http,omitempty"`
+	// GRPC refers to the filters of GRPCRoutes
+	GRPC []gatewayv1.GRPCRouteFilter `json:"grpc,omitempty"`
+}
+
+type ManagedRoute struct {
+	// QueryParams refers to the query parameter matches that send requests to the canary
+	// in addition to the header matches of the managed route
+	QueryParams []gatewayv1.HTTPQueryParamMatch `json:"queryParams,omitempty"`
+	// Cookies refers to the cookies that send requests to the canary
+	// in addition to the header matches of the managed route
+	Cookies []CookieMatch `json:"cookies,omitempty" validate:"dive"`
+	// GRPCMethods refers to the gRPC methods that are sent to the canary together with the header matches
+	// of the managed route. They are restricted to the methods of the GRPCRoute rule
+	GRPCMethods []gatewayv1.GRPCMethodMatch `json:"grpcMethods,omitempty"`
+}
+
+type CookieMatch struct {
+	// Name refers to the cookie name
+	Name string `json:"name" validate:"required"`
+	// Value refers to the exact cookie value
+	Value string `json:"value" validate:"required"`
+}
+
+type BackendRefReference struct {
+	// Group refers to the API group of the backend, e.g. multicluster.x-k8s.io.
+	// Empty group refers to the core API group
+	Group string `json:"group,omitempty"`
+	// Kind refers to the kind of the backend, e.g. ServiceImport. Defaults to Service
+	Kind string `json:"kind,omitempty"`
+	// Namespace refers to the namespace of the backend. Defaults to the namespace of the route
+	Namespace string `json:"namespace,omitempty"`
+	// Port refers to the port of the backend. If it isn't set, backendRefs with any port match
+	Port *gatewayv1.PortNumber `json:"port,omitempty"`
+	// Name refers to the name of the backend. It is always taken from the rollout
+	Name string `json:"-"`
+}
+
+type BackendRefWeightOptions struct {
+	CanaryBackendRef BackendRefReference
+	StableBackendRef BackendRefReference
+	// RouteNamespace refers to the namespace of the route backendRefs belong to
+	RouteNamespace string
+	// DesiredWeight refers to the canary weight out of MaxTrafficWeight
+	DesiredWeight    int32
+	MaxTrafficWeight int32
+	// WeightScale refers to the sum of the canary and stable weights
+	WeightScale int32
+	// InsertCanaryBackendRef indicates the canary backendRef is added or removed
+	// depending on the desired weight
+	InsertCanaryBackendRef bool
+}
+
 type ManagedRouteMap map[string]map[string]int
 
 type HTTPRouteRule gatewayv1.HTTPRouteRule
@@ -108,11 +285,14 @@ type TCPBackendRef gatewayv1.BackendRef
 type GatewayAPIRoute interface {
 	HTTPRoute | GRPCRoute | TCPRoute
 	GetName() string
+	GetKind() string
 }
 
 type GatewayAPIRouteRule[T1 GatewayAPIBackendRef] interface {
 	*HTTPRouteRule | *GRPCRouteRule | *TCPRouteRule
 	Iterator() (GatewayAPIRouteRuleIterator[T1], bool)
+	AddBackendRef(backendRef T1, backendRefReference BackendRefReference)
+	RemoveBackendRefs(backendRefReference BackendRefReference, routeNamespace string)
 }
 
 type GatewayAPIRouteRuleList[T1 GatewayAPIBackendRef, T2 GatewayAPIRouteRule[T1]] interface {
@@ -124,6 +304,9 @@ type GatewayAPIRouteRuleList[T1 GatewayAPIBackendRef, T2 GatewayAPIRouteRule[T1]
 type GatewayAPIBackendRef interface {
 	*HTTPBackendRef | *GRPCBackendRef | *TCPBackendRef
 	GetName() string
+	GetObjectReference() gatewayv1.BackendObjectReference
+	GetWeight() int32
+	SetWeight(weight int32)
 }
 
 type GatewayAPIRouteRuleListIterator[T1 GatewayAPIBackendRef, T2 GatewayAPIRouteRule[T1]] func() (T2, bool)